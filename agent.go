@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// These are the HTTP trailers the agent uses to report the outcome of a
+// build (since the status code is sent before the build starts).
+const (
+	agentStatusTrailer = "X-Hidalgo-Status"
+	agentErrorTrailer  = "X-Hidalgo-Error"
+	agentImageTrailer  = "X-Hidalgo-Image"
+)
+
+// AgentCommand describes the command line options for 'hidalgo agent',
+// which runs a build agent.  An agent receives (compiled) build contexts
+// from hidalgo over mutual TLS and builds the Docker images locally.
+// This allows compilation to happen on a different machine than the
+// image build.
+type AgentCommand struct {
+	Listen   string `short:"l" long:"listen" description:"Address to listen on" default:":7345"`
+	Docker   string `short:"d" long:"docker" description:"Docker command" default:"docker"`
+	Cert     string `long:"cert" description:"Agent TLS certificate" required:"true"`
+	Key      string `long:"key" description:"Agent TLS key" required:"true"`
+	CA       string `long:"ca" description:"CA certificate used to verify clients" required:"true"`
+	Platform string `long:"platform" description:"Platform the agent builds images for (default: linux/<arch of agent>)"`
+	Isolate  bool   `long:"isolate" description:"Run each build with a private HOME, TMPDIR and Docker config"`
+
+	// The number of builds currently in progress
+	builds int32
+}
+
+// AgentStatus is what an agent reports about itself so that clients can
+// choose which agent to send a build to.
+type AgentStatus struct {
+	// The platform (e.g., linux/arm64) the agent natively builds for
+	Platform string `json:"platform"`
+	// The number of builds currently in progress
+	Builds int `json:"builds"`
+}
+
+// The loadTLS function creates a TLS configuration with the given
+// certificate and key.  The CA certificate is used to verify the other
+// end of the connection (whether it is the client or the server).
+func loadTLS(cert string, key string, ca string) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load certificate %s: %v", cert, err)
+	}
+
+	pem, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read CA certificate %s: %v", ca, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", ca)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// The Execute method runs the agent (it only returns on error).
+func (a *AgentCommand) Execute(args []string) error {
+	config, err := loadTLS(a.Cert, a.Key, a.CA)
+	if err != nil {
+		return err
+	}
+	// Only clients with a certificate signed by our CA can connect
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	// The images built by Docker are linux images, so by default we
+	// assume we build for linux on our own architecture.
+	if a.Platform == "" {
+		a.Platform = "linux/" + runtime.GOARCH
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/build", a.build)
+	mux.HandleFunc("/status", a.status)
+
+	server := &http.Server{
+		Addr:      a.Listen,
+		Handler:   mux,
+		TLSConfig: config,
+	}
+
+	infof("Build agent for %s listening on %s", a.Platform, a.Listen)
+	return server.ListenAndServeTLS("", "")
+}
+
+// A flushWriter flushes every write to the client so that the build
+// output is streamed rather than buffered.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// The status method reports the platform and current load of the agent.
+func (a *AgentCommand) status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AgentStatus{
+		Platform: a.Platform,
+		Builds:   int(atomic.LoadInt32(&a.builds)),
+	})
+}
+
+// The build method handles a build request.  The body of the request is
+// the (gzip'd tar) build context.  The output of the build is streamed
+// back and the outcome is reported in the trailers.
+func (a *AgentCommand) build(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Builds must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Keep track of how many builds are in progress
+	atomic.AddInt32(&a.builds, 1)
+	defer atomic.AddInt32(&a.builds, -1)
+
+	// Every build gets its own workspace, which is removed when the
+	// build is done
+	workspace, err := ioutil.TempDir("", "hidalgo-agent")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(workspace)
+
+	// Receive the entire context before we start the build (so an
+	// interrupted upload doesn't result in a partial build)
+	context, err := os.Create(filepath.Join(workspace, "context.tar.gz"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer context.Close()
+
+	_, err = io.Copy(context, r.Body)
+	if err == nil {
+		_, err = context.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error receiving build context: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Now perform the build (exactly as hidalgo would)
+	args := []string{"build"}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		args = append(args, "-t", tag)
+	}
+	if platform := r.URL.Query().Get("platform"); platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	if epoch := r.URL.Query().Get("epoch"); epoch != "" {
+		if _, err := strconv.ParseInt(epoch, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid epoch: %s", epoch), http.StatusBadRequest)
+			return
+		}
+		args = append(args, "--build-arg", "SOURCE_DATE_EPOCH="+epoch)
+	}
+	for _, arg := range r.URL.Query()["buildarg"] {
+		// Values must be given (we don't pass on our environment)
+		if i := strings.Index(arg, "="); i < 0 || !buildArgName.MatchString(arg[:i]) {
+			http.Error(w, fmt.Sprintf("Invalid build argument: %s", arg), http.StatusBadRequest)
+			return
+		}
+		args = append(args, "--build-arg", arg)
+	}
+	iidfile := filepath.Join(workspace, "iid")
+	args = append(args, "--iidfile", iidfile, "-")
+	build := exec.Command(a.Docker, args...)
+	build.Dir = workspace
+	build.Stdin = context
+	if a.Isolate {
+		build.Env, err = isolatedEnv(workspace)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	infof("Build requested by %s: '%s'", client(r), cmdString(build))
+
+	w.Header().Set("Trailer", agentStatusTrailer+", "+agentErrorTrailer+", "+agentImageTrailer)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	out := &flushWriter{w: w}
+	build.Stdout = out
+	build.Stderr = out
+
+	err = build.Run()
+	if err != nil {
+		errorf("Build failed: %v", err)
+		w.Header().Set(agentStatusTrailer, "1")
+		w.Header().Set(agentErrorTrailer, err.Error())
+		return
+	}
+	infof("Build complete")
+	w.Header().Set(agentStatusTrailer, "0")
+	w.Header().Set(agentImageTrailer, readIIDFile(iidfile))
+}
+
+// These are the environment variables that are passed through to
+// isolated builds (everything needed to find and talk to Docker).
+var isolatedVars = []string{"PATH", "DOCKER_HOST", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH", "SYSTEMROOT"}
+
+// The isolatedEnv function creates a minimal environment for a build
+// that only has access to its own workspace.  In particular, HOME,
+// TMPDIR and DOCKER_CONFIG (and, on Windows, USERPROFILE, TEMP and TMP)
+// all point inside the workspace so that
+// concurrent builds can't see each other's files or the credentials of
+// the user running the agent.
+func isolatedEnv(workspace string) ([]string, error) {
+	tmp := filepath.Join(workspace, "tmp")
+	dconfig := filepath.Join(workspace, ".docker")
+	for _, dir := range []string{tmp, dconfig} {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	env := []string{
+		"HOME=" + workspace,
+		"TMPDIR=" + tmp,
+		"DOCKER_CONFIG=" + dconfig,
+	}
+	// Windows uses different variables for the same things
+	if runtime.GOOS == "windows" {
+		env = append(env, "USERPROFILE="+workspace, "TEMP="+tmp, "TMP="+tmp)
+	}
+	for _, name := range isolatedVars {
+		if val, exists := os.LookupEnv(name); exists {
+			env = append(env, name+"="+val)
+		}
+	}
+	return env, nil
+}
+
+// The client function identifies the client making a request (by the
+// common name of its certificate)
+func client(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return r.RemoteAddr
+}
+
+// The selectAgent function asks each of the agents for its status and
+// chooses the least busy one that builds for the given platform.  Agents
+// that can't be reached are skipped.
+func selectAgent(client *http.Client, agents []string, platform string) (string, error) {
+	best := ""
+	load := 0
+	for _, agent := range agents {
+		agent = strings.TrimSuffix(agent, "/")
+		resp, err := client.Get(agent + "/status")
+		if err != nil {
+			warnf("Unable to contact build agent %s: %v", agent, err)
+			continue
+		}
+		status := AgentStatus{}
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			warnf("Invalid status from build agent %s: %v", agent, err)
+			continue
+		}
+		verbosef("  Agent %s: platform %s, %d build(s) in progress", agent, status.Platform, status.Builds)
+		if status.Platform != platform {
+			continue
+		}
+		if best == "" || status.Builds < load {
+			best = agent
+			load = status.Builds
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("None of the build agents %v are available to build for %s", agents, platform)
+	}
+	return best, nil
+}
+
+// The agentBuild function archives the build directory and sends it to a
+// build agent, which performs the Docker build and streams back the
+// output.  If several agents are given, the least busy one that builds
+// for the given platform (os/arch) is used.  It returns the ID of the
+// image that was built (if the agent reports it).
+func agentBuild(Options Options, c buildContext, platform Platform) (string, error) {
+	config, err := loadTLS(Options.AgentCert, Options.AgentKey, Options.AgentCA)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config},
+	}
+
+	// Pick the agent to send the build to
+	status := &http.Client{
+		Transport: client.Transport,
+		Timeout:   10 * time.Second,
+	}
+	agent, err := selectAgent(status, Options.Agent, platform.OS+"/"+platform.Arch)
+	if err != nil {
+		return "", err
+	}
+
+	// Archive the build directory (just like we do for a local build).
+	// Any error archiving it makes the upload fail (rather than sending
+	// a truncated context).
+	reader, err := contextArchive(c, Options.record)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	query := url.Values{}
+	if Options.Tag != "" {
+		query.Set("tag", Options.Tag)
+	}
+	if platform.String() != defaultPlatform {
+		query.Set("platform", platform.String())
+	}
+	if Options.Reproducible {
+		query.Set("epoch", strconv.FormatInt(Options.epoch, 10))
+	}
+	bargs, _ := parseBuildArgs(Options.BuildArg)
+	for _, name := range sortedKeys(bargs) {
+		query.Add("buildarg", name+"="+bargs[name])
+	}
+	u := agent + "/build"
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	debugf("  Sending build context to agent: %s", u)
+
+	resp, err := client.Post(u, "application/gzip", reader)
+	if err != nil {
+		return "", fmt.Errorf("Error contacting build agent %s: %v", agent, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Build agent refused build: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	// Stream the build output as it arrives
+	out := newBuildProgress()
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		err = fmt.Errorf("Error reading output from build agent: %v", err)
+	} else if resp.Trailer.Get(agentStatusTrailer) != "0" {
+		// The trailers are only available once the body has been read
+		err = fmt.Errorf("Build on agent %s failed: %s", agent, resp.Trailer.Get(agentErrorTrailer))
+	}
+	out.finish(err)
+	if err != nil {
+		return "", err
+	}
+	return resp.Trailer.Get(agentImageTrailer), nil
+}
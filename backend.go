@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+)
+
+// A backend describes how to build an image with a particular tool.
+type backend struct {
+	// The arguments that start a build
+	build []string
+	// Whether the build context is streamed to the build command (as a
+	// gzip'd tar on stdin), which works with remote Docker hosts.
+	// Otherwise, the build directory is given to the build command
+	// (which builds the image locally).
+	stream bool
+	// The arguments that write an image to stdout in docker-archive
+	// format (or nil if this isn't supported)
+	save []string
+	// Whether hidalgo assembles the image itself (so no build tool is
+	// run at all)
+	daemonless bool
+}
+
+// These are the tools that we know how to build images with.  For the
+// docker backend, the command that is actually run is given with -d.
+// The sdocker backend is the docker backend using the (deprecated)
+// sdocker client.
+var backends = map[string]backend{
+	"docker":  {build: []string{"build"}, stream: true, save: []string{"save"}},
+	"sdocker": {build: []string{"build"}, stream: true, save: []string{"save"}},
+	"podman":  {build: []string{"build"}, save: []string{"save", "--format", "docker-archive"}},
+	"buildah": {build: []string{"bud"}},
+	"nerdctl": {build: []string{"build"}, save: []string{"save"}},
+	// This isn't really a tool (see assembleImage)
+	daemonlessBackend: {daemonless: true},
+}
+
+// The dockerCommand function returns the Docker client to run for the
+// docker (and sdocker) backends.
+func dockerCommand(Options Options) string {
+	if Options.Backend == "sdocker" {
+		return "sdocker"
+	}
+	return Options.Docker
+}
+
+// The sdockerHint function suggests how to stop using sdocker (which
+// used to be the default Docker client).  Remote Docker hosts can now be
+// reached without it (with -H or DOCKER_HOST).
+func sdockerHint(Options Options) {
+	if Options.Backend == "sdocker" {
+		warnf("The sdocker backend is deprecated")
+	} else {
+		warnf("Using sdocker with -d is deprecated (use --backend sdocker until you can stop using it)")
+	}
+	warnf("  Remote Docker hosts can be used without sdocker with -H (or DOCKER_HOST), e.g., -H ssh://user@host")
+}
+
+// The backendNames function returns the names of all the backends (for
+// error messages).
+func backendNames() []string {
+	ret := []string{}
+	for name := range backends {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// The backendBuild function builds the image from the build directory
+// using one of the (local) backends other than docker.  It returns the
+// ID of the image that was built.
+func backendBuild(Options Options, dir string, platform string) (string, error) {
+	be := backends[Options.Backend]
+	args := append([]string{}, be.build...)
+	if Options.Tag != "" {
+		args = append(args, "-t", Options.Tag)
+	}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	// Podman and buildah fix the timestamps in the image themselves
+	// (nerdctl uses BuildKit, which uses the build argument)
+	if Options.Reproducible && (Options.Backend == "podman" || Options.Backend == "buildah") {
+		args = append(args, "--timestamp", strconv.FormatInt(Options.epoch, 10))
+	}
+	bargs := buildArgs(Options)
+	for _, key := range sortedKeys(bargs) {
+		args = append(args, "--build-arg", key+"="+bargs[key])
+	}
+	iidfile, err := newIIDFile()
+	if err != nil {
+		return "", err
+	}
+	args = append(args, "--iidfile", iidfile, dir)
+
+	build := exec.Command(Options.Backend, args...)
+	out := newBuildProgress()
+	build.Stdout = out
+	build.Stderr = out
+
+	debugf("  Complete build command: '%s'", cmdString(build))
+
+	err = build.Run()
+	out.finish(err)
+	id := readIIDFile(iidfile)
+	if err != nil {
+		return "", fmt.Errorf("Error running cmd '%s': %v", cmdString(build), err)
+	}
+	return id, nil
+}
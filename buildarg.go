@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Build arguments are referred to as ${NAME} in the Dockerfile, so their
+// names are restricted to what Docker substitutes
+var buildArgName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// The parseBuildArgs function parses the build arguments given with
+// --build-arg.  Each one is either NAME=value or just NAME, in which case
+// (just like with 'docker build') the value is taken from the
+// environment (and the argument is left out if it isn't set).
+func parseBuildArgs(list []string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, arg := range list {
+		name := arg
+		value, set := "", false
+		if i := strings.Index(arg, "="); i >= 0 {
+			name, value, set = arg[:i], arg[i+1:], true
+		}
+		if !buildArgName.MatchString(name) {
+			return nil, fmt.Errorf("Invalid build argument name: %q", name)
+		}
+		if !set {
+			value, set = os.LookupEnv(name)
+			if !set {
+				continue
+			}
+		}
+		ret[name] = value
+	}
+	return ret, nil
+}
+
+// The buildArgs function returns the build arguments passed to the
+// Docker build, i.e., those given with --build-arg (which have already
+// been checked by checkBuildArgs) and, for a reproducible build,
+// SOURCE_DATE_EPOCH (which BuildKit uses for the time the image was
+// created, instead of the current time).
+func buildArgs(Options Options) map[string]string {
+	ret, _ := parseBuildArgs(Options.BuildArg)
+	if Options.Reproducible {
+		ret["SOURCE_DATE_EPOCH"] = strconv.FormatInt(Options.epoch, 10)
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// The checkBuildArgs function checks the build arguments given with
+// --build-arg (before the time consuming build).  An argument that isn't
+// declared in the configuration (with 'buildarg') isn't used by the
+// built in template, which is almost certainly a mistake.
+func checkBuildArgs(Options Options, config Config) error {
+	args, err := parseBuildArgs(Options.BuildArg)
+	if err != nil {
+		return err
+	}
+	for _, arg := range Options.BuildArg {
+		if _, given := args[arg]; !given && !strings.Contains(arg, "=") {
+			warnf("Build argument %s is not set, so it is not passed to the build", arg)
+		}
+	}
+	if Options.Template != "" {
+		// A custom template may declare its own
+		return nil
+	}
+	for _, name := range sortedKeys(args) {
+		if _, declared := config.BuildArgs[name]; !declared {
+			warnf("Build argument %s is not declared in the configuration (with 'buildarg'), so it is not used", name)
+		}
+	}
+	return nil
+}
+
+// The buildArgValues function returns the values of the build arguments
+// declared in the configuration, i.e., their defaults overridden by any
+// given with --build-arg.
+func buildArgValues(Options Options, config Config) map[string]string {
+	ret := map[string]string{}
+	for name, value := range config.BuildArgs {
+		ret[name] = value
+	}
+	given, _ := parseBuildArgs(Options.BuildArg)
+	for name, value := range given {
+		if _, declared := config.BuildArgs[name]; declared {
+			ret[name] = value
+		}
+	}
+	return ret
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The customBuild function returns true if the main executable is built
+// with the build command given in the configuration (instead of 'go
+// build').  A harness is always built with 'go test -c'.
+func customBuild(Options Options, config Config) bool {
+	return config.Build != "" && !Options.Harness
+}
+
+// The runBuild function builds the executable for bin (in the build
+// directory) with the build command given in the configuration.  The
+// command is run by the shell in the package directory with the same
+// environment as 'go build' (i.e., GOOS, GOARCH, etc. for the target
+// platform), along with the linker flags we would have used and where
+// the executable should be written.  If the configuration says where
+// the command writes the executable instead, it is copied from there.
+func runBuild(config Config, bin Binary, apdir string, dir string, goenv []string, ldflags string) error {
+	out := filepath.Join(dir, bin.Name)
+	cmd := shellCommand(config.Build)
+	cmd.Dir = apdir
+	cmd.Env = append(goenv,
+		"HIDALGO_OUTPUT="+out,
+		"HIDALGO_PACKAGE="+bin.Package,
+		"HIDALGO_LDFLAGS="+ldflags)
+
+	verbosef("Running build command: '%s'", config.Build)
+	output, err := combinedOutput(cmd)
+	if err != nil {
+		return fmt.Errorf("Error running build command '%s':\n%s\n%v", config.Build, output, err)
+	}
+
+	if config.BuildOutput != "" {
+		src := filepath.Join(apdir, filepath.FromSlash(config.BuildOutput))
+		err = copyFile(src, out)
+		if err != nil {
+			return fmt.Errorf("Unable to copy the output of the build command: %v", err)
+		}
+		err = os.Chmod(out, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(out); err != nil {
+		return fmt.Errorf("The build command '%s' didn't write the executable to $HIDALGO_OUTPUT (%s)",
+			config.Build, out)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// This is the name of the CA bundle in the build directory
+const certsFile = "ca-certificates.crt"
+
+// These are the places the CA bundle is found on the build machine (on
+// Debian/Ubuntu/Alpine, Fedora/RHEL, openSUSE and macOS/BSD).
+var certBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// The certBundle function finds the CA bundle on the build machine that
+// is copied into images (with 'certs true;').  SSL_CERT_FILE is used if
+// it is set (so a different bundle can be given).
+func certBundle() (string, error) {
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		if _, err := os.Stat(file); err != nil {
+			return "", fmt.Errorf("CA bundle given by SSL_CERT_FILE does not exist: %s", file)
+		}
+		return file, nil
+	}
+	for _, file := range certBundles {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to find a CA bundle (set SSL_CERT_FILE to the one to use)")
+}
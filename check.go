@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CheckCommand describes 'hidalgo check', which checks the configuration
+// of one or more packages without compiling anything or contacting
+// Docker (so it is quick enough to run as a pre-commit hook).
+type CheckCommand struct {
+	// The (global) options hidalgo was run with
+	options *Options
+}
+
+// The Execute method checks the configuration of the packages in the
+// given directories (or the current directory).  All the problems that
+// are found are reported, not just the first one.
+func (c *CheckCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	dirs, err := packageDirs(args)
+	if err != nil {
+		return &UsageError{err}
+	}
+
+	failed := 0
+	for _, dir := range dirs {
+		problems, err := checkPackage(dir, Options)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			infof("%s: ok", dir)
+			continue
+		}
+		failed++
+		errorf("%s:", dir)
+		for _, p := range problems {
+			errorf("  %s", p)
+		}
+	}
+
+	if failed > 0 {
+		return &ConfigError{fmt.Errorf("Problems found in the configuration of %d of %d packages", failed, len(dirs))}
+	}
+	return nil
+}
+
+// The checkPackage function checks the configuration of the package in
+// dir (with the given profiles) and returns a description of each
+// problem found.  An error is only returned if the package can't be
+// checked at all.
+func checkPackage(dir string, Options Options) ([]string, error) {
+	adir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, &UsageError{err}
+	}
+	if info, err := os.Stat(adir); err != nil || !info.IsDir() {
+		return nil, &UsageError{fmt.Errorf("No such package directory: %s", dir)}
+	}
+
+	// Parsing the configuration (including checking it against the
+	// grammar and validating the values in it) is the first check...
+	config, err := loadConfig(adir, Options)
+	if err != nil {
+		return []string{err.Error()}, nil
+	}
+
+	// ...and then we check that it matches the world around it
+	problems := []string{}
+
+	// The environment variables should have values (or they won't be in
+	// the image, and the build fails for the required ones)
+	required := map[string]bool{}
+	for _, r := range config.Required {
+		required[r] = true
+	}
+	for _, e := range config.Env {
+		if config.getenv(e) == "" && required[e] {
+			problems = append(problems, fmt.Sprintf("Required environment variable %s is not set", e))
+		} else if config.getenv(e) == "" {
+			problems = append(problems, fmt.Sprintf("Environment variable %s is not set", e))
+		}
+	}
+
+	// Each port should only be exposed once
+	seen := map[string]bool{}
+	for _, p := range config.Ports {
+		if seen[p.String()] {
+			problems = append(problems, fmt.Sprintf("Port %s is listed more than once", p))
+		}
+		seen[p.String()] = true
+	}
+
+	// The files should exist (relative to the package directory) and
+	// those that are downloaded should be verified
+	for _, f := range config.Files {
+		if f.remote() {
+			if f.Sha256 == "" {
+				problems = append(problems, fmt.Sprintf("File %s has no sha256 checksum, so it isn't verified", f.Src))
+			}
+			continue
+		}
+		if _, err := collectFiles(adir, []string{f.Src}); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	// We need a CA bundle to add to the image
+	if config.Certs {
+		if _, err := certBundle(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	// We need a time zone database to add to the image
+	if config.Tzdata {
+		if _, err := zoneinfo(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	// The job packages should exist
+	names := []string{}
+	for name := range config.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		jdir := filepath.FromSlash(config.Jobs[name])
+		if !filepath.IsAbs(jdir) {
+			jdir = filepath.Join(adir, jdir)
+		}
+		if info, err := os.Stat(jdir); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("Package %s for job %s does not exist", config.Jobs[name], name))
+		}
+	}
+	return problems, nil
+}
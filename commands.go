@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// BuildCommand describes 'hidalgo build', which does exactly what
+// hidalgo does when no command is given.
+type BuildCommand struct {
+	// The (global) options hidalgo was run with
+	options *Options
+	// Where the exit status is recorded
+	status *int
+}
+
+// The Execute method builds the images for the packages in the given
+// directories (or the current directory).
+func (c *BuildCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	*c.status = build(Options, args)
+	return nil
+}
+
+// PushCommand describes 'hidalgo push', which builds images and then
+// pushes them (along with their debug variants and jobs, if any).
+type PushCommand struct {
+	// The (global) options hidalgo was run with
+	options *Options
+	// Where the exit status is recorded
+	status *int
+}
+
+// The Execute method builds and pushes the images for the packages in
+// the given directories (or the current directory).
+func (c *PushCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	Options.push = true
+	*c.status = build(Options, args)
+	return nil
+}
+
+// RunCommand describes 'hidalgo run', which builds the image for a
+// package and then runs it locally (with its ports published and its
+// environment variables passed through).
+type RunCommand struct {
+	Name    string   `long:"name" description:"Name to give the container"`
+	Publish []string `short:"p" long:"publish" description:"Additional port to publish (host:container, may be repeated)"`
+	Env     []string `short:"e" long:"env" description:"Additional environment variable to set (NAME=value, may be repeated)"`
+	NoPorts bool     `long:"no-ports" description:"Don't publish the ports in the configuration"`
+
+	// The (global) options hidalgo was run with
+	options *Options
+	// Where the exit status is recorded
+	status *int
+}
+
+// This matches the characters that can't appear in an image name
+var invalidName = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// The runTag function returns the tag for an image that is only being
+// built to run it locally (when no tag is given).
+func runTag(dir string) string {
+	adir, err := filepath.Abs(dir)
+	if err != nil {
+		adir = dir
+	}
+	name := strings.Trim(invalidName.ReplaceAllString(strings.ToLower(filepath.Base(adir)), "-"), "-._")
+	if name == "" {
+		name = "app"
+	}
+	return "hidalgo/" + name
+}
+
+// The Execute method builds and runs the image for the package in the
+// given directory (or the current directory).
+func (c *RunCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	if len(args) > 1 || Options.Watch {
+		*c.status = report(Options, "", &UsageError{fmt.Errorf("Only a single package can be run")})
+		return nil
+	}
+	dir := "."
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	// The image has to be tagged so we can refer to it
+	Options, err := profileTag(Options, dir)
+	if err == nil {
+		Options, err = expandTag(Options, dir)
+	}
+	if err != nil {
+		*c.status = report(Options, dir, err)
+		return nil
+	}
+	if Options.Tag == "" {
+		Options.Tag = runTag(dir)
+		verbosef("Tagging image as %s", Options.Tag)
+	}
+
+	*c.status = reportWarnings(Options, run(Options, dir))
+	if *c.status != ExitOK || Options.Dry {
+		return nil
+	}
+
+	err = c.runImage(Options, dir)
+	if err != nil {
+		*c.status = report(Options, dir, err)
+	}
+	return nil
+}
+
+// The runArgs method returns the arguments that run the image for the
+// package in dir.  The ports in its configuration are published on the
+// same ports of the host and the environment variables in its
+// configuration are passed through (if they are set).
+func (c *RunCommand) runArgs(Options Options, dir string) ([]string, error) {
+	apdir, _, err := packageName(dir)
+	if err != nil {
+		return nil, &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return nil, &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	config, err = checkPProf(Options, apdir, config)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"run", "--rm"}
+	if c.Name != "" {
+		args = append(args, "--name", c.Name)
+	}
+	if !c.NoPorts {
+		for _, p := range config.Ports {
+			mapping := fmt.Sprintf("%d:%s", p.Number, p)
+			verbosef("  Publishing port %s", mapping)
+			args = append(args, "-p", mapping)
+		}
+	}
+	for _, p := range c.Publish {
+		args = append(args, "-p", p)
+	}
+	for _, e := range config.Env {
+		if _, given := config.envOverrides[e]; given {
+			// The value given with -e is already in the image
+			continue
+		}
+		if os.Getenv(e) != "" {
+			verbosef("  Passing environment variable %s", e)
+			args = append(args, "-e", e)
+		} else if value := config.getenv(e); value != "" {
+			// The container doesn't see our environment files
+			verbosef("  Passing environment variable %s (from an environment file)", e)
+			args = append(args, "-e", e+"="+value)
+		}
+	}
+	for _, e := range c.Env {
+		args = append(args, "-e", e)
+	}
+	return append(args, Options.Tag), nil
+}
+
+// The runImage method runs the (just built) image for the package in dir
+// (using the same tool that built it).  The output of the container is
+// streamed until it exits (or is interrupted).
+func (c *RunCommand) runImage(Options Options, dir string) error {
+	if len(Options.Agent) > 0 {
+		return &UsageError{fmt.Errorf("Images built by a build agent cannot be run locally")}
+	}
+
+	tool := Options.Backend
+	env := os.Environ()
+	switch tool {
+	case "buildah":
+		return &UsageError{fmt.Errorf("Images built with buildah cannot be run (use podman)")}
+	case daemonlessBackend:
+		return &UsageError{fmt.Errorf("Images built without a daemon cannot be run (use docker or podman)")}
+	case "docker", "sdocker":
+		tool = dockerCommand(Options)
+		if Options.Host != "" {
+			env = append(env, "DOCKER_HOST="+Options.Host)
+		}
+	}
+
+	args, err := c.runArgs(Options, dir)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(tool, args...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	debugf("  Complete run command: '%s'", cmdString(cmd))
+	infof("Running %s (press Ctrl-C to stop it)", Options.Tag)
+
+	// An interrupt goes to the run command as well (which stops the
+	// container), so we just wait for it to exit
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+
+	err = cmd.Run()
+	if err != nil {
+		return &DockerError{fmt.Errorf("Error running image %s: %v", Options.Tag, err)}
+	}
+	return nil
+}
+
+// CleanCommand describes 'hidalgo clean', which removes build
+// directories.
+type CleanCommand struct {
+	// The (global) options hidalgo was run with
+	options *Options
+}
+
+// This matches the names of the temporary build directories we create
+var tempBuildDir = regexp.MustCompile(`^hidalgo[0-9]+$`)
+
+// The Execute method removes the build directory given with -b or, if
+// there isn't one, any temporary build directories that were kept (with
+// -k).  For a dry run, the directories are only listed.
+func (c *CleanCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	dirs := []string{}
+	if Options.Build != "" {
+		if _, err := os.Stat(Options.Build); err == nil {
+			dirs = append(dirs, Options.Build)
+		}
+	} else {
+		entries, err := ioutil.ReadDir(os.TempDir())
+		if err != nil {
+			return &BuildError{fmt.Errorf("Unable to read %s: %v", os.TempDir(), err)}
+		}
+		for _, e := range entries {
+			if e.IsDir() && tempBuildDir.MatchString(e.Name()) {
+				dirs = append(dirs, filepath.Join(os.TempDir(), e.Name()))
+			}
+		}
+	}
+
+	if len(dirs) == 0 {
+		infof("Nothing to clean")
+		return nil
+	}
+	for _, dir := range dirs {
+		if Options.Dry {
+			infof("Would remove %s", dir)
+			continue
+		}
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return &BuildError{fmt.Errorf("Unable to remove %s: %v", dir, err)}
+		}
+		infof("Removed %s", dir)
+	}
+	return nil
+}
+
+// InspectCommand describes 'hidalgo inspect', which reports what would be
+// built for a package.
+type InspectCommand struct {
+	// The (global) options hidalgo was run with
+	options *Options
+}
+
+// A Plan describes what would be built for a package (and is what
+// 'hidalgo inspect' reports).
+type Plan struct {
+	Package     string            `json:"package"`
+	Directory   string            `json:"directory"`
+	Platform    string            `json:"platform"`
+	Tag         string            `json:"tag,omitempty"`
+	From        string            `json:"from"`
+	Binaries    []string          `json:"binaries"`
+	Run         string            `json:"run"`
+	Env         []string          `json:"env,omitempty"`
+	Ports       []string          `json:"ports,omitempty"`
+	Volumes     []string          `json:"volumes,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	BuildArgs   map[string]string `json:"buildargs,omitempty"`
+	Jobs        map[string]string `json:"jobs,omitempty"`
+	Certs       bool              `json:"certs,omitempty"`
+	Tzdata      bool              `json:"tzdata,omitempty"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// The Execute method writes the plan for the package in the given
+// directory (or the current directory) to stdout.
+func (c *InspectCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	if len(args) > 1 {
+		return &UsageError{fmt.Errorf("Only a single package can be inspected")}
+	}
+	dir := "."
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	plan, err := inspect(Options, dir)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return &BuildError{err}
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// The inspect function determines what would be built for the package in
+// pdir (in the same way buildImage does, but without building anything).
+func inspect(Options Options, pdir string) (Plan, error) {
+	Options, err := profileTag(Options, pdir)
+	if err != nil {
+		return Plan{}, err
+	}
+	Options, err = expandTag(Options, pdir)
+	if err != nil {
+		return Plan{}, err
+	}
+	apdir, name, err := packageName(pdir)
+	if err != nil {
+		return Plan{}, &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+	platform, err := parsePlatform(Options.Platform)
+	if err != nil {
+		return Plan{}, &ConfigError{err}
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return Plan{}, &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	config, err = checkPProf(Options, apdir, config)
+	if err != nil {
+		return Plan{}, err
+	}
+	Options, err = reproducible(Options, apdir)
+	if err != nil {
+		return Plan{}, &BuildError{err}
+	}
+	// Work out what goes into the image just as the build would
+	p, err := planImage(Options, platform, apdir, name, config)
+	if err != nil {
+		return Plan{}, err
+	}
+	config, from, env := p.Config, p.From, p.Env
+	fp, err := newFingerprint(apdir, config, Options, env, from)
+	if err != nil {
+		return Plan{}, &BuildError{fmt.Errorf("Unable to compute build fingerprint: %v", err)}
+	}
+
+	// A tag given with -t overrides the one given by the profile
+	if Options.Tag != "" {
+		config.Tag = Options.Tag
+	}
+	plan := Plan{
+		Package:     name,
+		Directory:   apdir,
+		Platform:    platform.String(),
+		Tag:         config.Tag,
+		From:        from,
+		Run:         p.Default.Path,
+		Volumes:     config.Volumes,
+		Jobs:        config.Jobs,
+		Certs:       config.Certs,
+		Tzdata:      config.Tzdata,
+		Fingerprint: fp.String(),
+		Labels:      p.Labels,
+	}
+	for _, bin := range p.Bins {
+		plan.Binaries = append(plan.Binaries, bin.Name)
+	}
+	// Only the names of the environment variables are reported (since
+	// their values may be secrets)
+	for key := range env {
+		plan.Env = append(plan.Env, key)
+	}
+	sort.Strings(plan.Env)
+	for _, port := range config.Ports {
+		plan.Ports = append(plan.Ports, port.String())
+	}
+	err = checkBuildArgs(Options, config)
+	if err != nil {
+		return Plan{}, &UsageError{err}
+	}
+	if len(config.BuildArgs) > 0 {
+		plan.BuildArgs = buildArgValues(Options, config)
+	}
+	return plan, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// The compressBinaries function compresses the executables (in dir) with
+// upx (if it is installed), which makes them (and so the image) much
+// smaller, at the cost of a slightly slower start.  Executables that
+// upx can't compress (e.g., for architectures it doesn't support) are
+// left as they are.
+func compressBinaries(Options Options, dir string, bins []Binary) {
+	if !Options.Compress {
+		return
+	}
+	upx, err := exec.LookPath("upx")
+	if err != nil {
+		warnf("upx is not installed, so the executables are not compressed")
+		return
+	}
+	for _, bin := range bins {
+		file := filepath.Join(dir, bin.Name)
+		before, err := os.Stat(file)
+		if err != nil {
+			warnf("Unable to compress %s: %v", bin.Name, err)
+			continue
+		}
+
+		cmd := exec.Command(upx, "-q", file)
+		debugf("  Complete compress command: '%s'", cmdString(cmd))
+		output, err := combinedOutput(cmd)
+		if err != nil {
+			warnf("Unable to compress %s: %v", bin.Name, err)
+			verbosef("%s", output)
+			continue
+		}
+
+		after, err := os.Stat(file)
+		if err != nil {
+			warnf("Unable to compress %s: %v", bin.Name, err)
+			continue
+		}
+		infof("Compressed %s from %s to %s (%.0f%%)", bin.Name, megabytes(before.Size()),
+			megabytes(after.Size()), 100*float64(after.Size())/float64(before.Size()))
+	}
+}
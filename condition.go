@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A Conditional is a set of directives that only apply when a condition
+// holds (e.g., ports that are only exposed in development images).
+type Conditional struct {
+	// The condition: profile=NAME (which holds when the profile is
+	// given with --profile) or env=NAME (which holds when the
+	// environment variable is set).  Either can be negated with '!'.
+	If string `yaml:"if" json:"if"`
+
+	Files    []File   `yaml:"file" json:"file"`
+	Env      []string `yaml:"env" json:"env"`
+	Required []string `yaml:"required" json:"required"`
+	Ports    []Port   `yaml:"port" json:"port"`
+	Volumes  []string `yaml:"volume" json:"volume"`
+	Packages []string `yaml:"package" json:"package"`
+}
+
+// The parseCondition function splits a condition into whether it is
+// negated, what kind of condition it is (profile or env) and the name of
+// the profile or environment variable.
+func parseCondition(cond string) (bool, string, string, error) {
+	negate := strings.HasPrefix(cond, "!")
+	parts := strings.SplitN(strings.TrimPrefix(cond, "!"), "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return false, "", "", fmt.Errorf("Invalid condition: %s (must be profile=NAME or env=NAME)", cond)
+	}
+	switch parts[0] {
+	case "profile", "env":
+		return negate, parts[0], parts[1], nil
+	default:
+		return false, "", "", fmt.Errorf("Invalid condition: %s (must be profile=NAME or env=NAME)", cond)
+	}
+}
+
+// The holds method determines whether the condition holds for the given
+// profiles (and the current environment).
+func (c Conditional) holds(profiles []string) (bool, error) {
+	negate, kind, name, err := parseCondition(c.If)
+	if err != nil {
+		return false, err
+	}
+
+	ret := false
+	switch kind {
+	case "profile":
+		for _, p := range profiles {
+			if p == name {
+				ret = true
+			}
+		}
+	case "env":
+		ret = os.Getenv(name) != ""
+	}
+	return ret != negate, nil
+}
+
+// The resolve method applies the given profiles (in order) to the
+// configuration and then evaluates the conditionals in it and adds the
+// directives of those that hold to it.  The result has no profiles or
+// conditionals left in it.
+func (c Config) resolve(profiles []string) (Config, error) {
+	ret := c
+	ret.When = nil
+	ret.Profiles = nil
+	for _, name := range profiles {
+		if p, defined := c.Profiles[name]; defined {
+			verbosef("  Applying profile %s", name)
+			ret = p.apply(ret)
+		} else if len(c.Profiles) > 0 && !c.known(name) {
+			warnf("Profile %s is not defined in the configuration", name)
+		}
+	}
+	for _, w := range c.When {
+		holds, err := w.holds(profiles)
+		if err != nil {
+			return ret, err
+		}
+		if !holds {
+			verbosef("  Condition %s does not hold", w.If)
+			continue
+		}
+		verbosef("  Condition %s holds", w.If)
+		ret.Files = append(ret.Files, w.Files...)
+		ret.Env = append(ret.Env, w.Env...)
+		ret.Required = append(ret.Required, w.Required...)
+		ret.Ports = append(ret.Ports, w.Ports...)
+		ret.Volumes = append(ret.Volumes, w.Volumes...)
+		ret.Packages = append(ret.Packages, w.Packages...)
+	}
+	return ret, nil
+}
@@ -0,0 +1,835 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xogeny/denada-go"
+	"gopkg.in/yaml.v2"
+)
+
+// This is the (Denada) grammar for the configuration file.
+const configGrammar = `
+include "include*";
+
+env _ "env*";
+
+required env _ "required*";
+
+file _ "file*";
+
+file _ "filespec*" {
+  dest "dest?";
+  mode "mode?";
+  owner "owner?";
+  sha256 "sha256?";
+}
+
+filedest "filedest?";
+
+port '[0-9]+(/[a-z]+)?' "port*";
+
+volume _ "volume*";
+
+arg "arg*";
+
+entrypoint "entrypoint?";
+
+harness "harness*";
+
+package _ "package*";
+
+default _ "default?";
+
+binary "binary?";
+
+bindir "bindir?";
+
+version "version?";
+
+test _ "test?";
+
+generate _ "generate?";
+
+vet _ "vet?";
+
+lint "lint?";
+
+hook _ "hook*";
+
+build "build?";
+
+registry _ "registry*" {
+  username "username?";
+  password "password?";
+  helper "helper?";
+}
+
+buildoutput "buildoutput?";
+
+certs _ "certs?";
+
+tzdata _ "tzdata?";
+
+from _ "from*";
+
+buildarg _ "buildarg*";
+
+var _ "var*";
+
+job _ "job*";
+
+profile _ "profile*" {
+  env _ "env*";
+  required env _ "required*";
+  port '[0-9]+(/[a-z]+)?' "port*";
+  from _ "from*";
+  tag "tag?";
+}
+
+when _ "when*" {
+  env _ "env*";
+  required env _ "required*";
+  port '[0-9]+(/[a-z]+)?' "port*";
+  volume _ "volume*";
+  file _ "file*";
+  package _ "package*";
+}
+`
+
+// These are the names of the configuration files we look for in the
+// package directory, in order of precedence.  If more than one of them
+// exists, only the first is used.
+var configFiles = []string{"hidalgo.cfg", "hidalgo.yaml", "hidalgo.yml", "hidalgo.json"}
+
+// Config is a structure that contains information parsed from the configuration
+// file.  This is information that would be otherwise inconvenient to include
+// in the command line because it is either repetitive (always required) or extensive
+// (involves a lot of information).
+//
+// The same structure is used for the YAML and JSON configuration files,
+// where the keys are the names of the corresponding Denada directives.
+type Config struct {
+	// Configuration files (relative to this one) that this one is based
+	// on
+	Includes []string `yaml:"include" json:"include"`
+
+	Files []File `yaml:"file" json:"file"`
+	// Where the files are added in the image (empty means /app)
+	FileDest string   `yaml:"filedest" json:"filedest"`
+	Env      []string `yaml:"env" json:"env"`
+	// Environment variables that must be set (which are in Env as well)
+	Required []string `yaml:"required" json:"required"`
+	Ports    []Port   `yaml:"port" json:"port"`
+	Volumes  []string `yaml:"volume" json:"volume"`
+	// Arguments passed to the executable
+	Args []string `yaml:"arg" json:"arg"`
+	// Whether to use the ENTRYPOINT+CMD form (instead of just CMD)
+	Entrypoint bool `yaml:"entrypoint" json:"entrypoint"`
+	// Arguments passed to the test binary in a harness image
+	Harness []string `yaml:"harness" json:"harness"`
+	// Additional packages to build and include in the image
+	Packages []string `yaml:"package" json:"package"`
+	// Name of the binary to run by default (empty means the main package)
+	Default string `yaml:"default" json:"default"`
+	// Name of the main package's executable in the image (empty means
+	// the base name of the package)
+	Binary string `yaml:"binary" json:"binary"`
+	// Directory the executables are installed in (in the image)
+	BinDir string `yaml:"bindir" json:"bindir"`
+	// Version to stamp the build with
+	Version string `yaml:"version" json:"version"`
+	// Whether to run the tests before building
+	Test bool `yaml:"test" json:"test"`
+	// Whether to run 'go generate' before building
+	Generate bool `yaml:"generate" json:"generate"`
+	// Whether to run 'go vet' before building
+	Vet bool `yaml:"vet" json:"vet"`
+	// Linter command to run before building
+	Lint string `yaml:"lint" json:"lint"`
+	// Shell command to build the main executable with (instead of 'go
+	// build') and where it writes the executable (relative to the
+	// package directory, empty if it writes it to $HIDALGO_OUTPUT)
+	Build       string `yaml:"build" json:"build"`
+	BuildOutput string `yaml:"buildoutput" json:"buildoutput"`
+	// Credentials to push images with, by registry (e.g.,
+	// registry.example.com or docker.io)
+	Registries map[string]Registry `yaml:"registry" json:"registry"`
+	// Shell commands to run at points in the build (pre-build or
+	// post-build), by the name of the point
+	Hooks map[string][]string `yaml:"hook" json:"hook"`
+	// Whether to add a CA bundle to the image (so it can make TLS
+	// connections)
+	Certs bool `yaml:"certs" json:"certs"`
+	// Whether to add the time zone database to the image (so it can
+	// load time zones)
+	Tzdata bool `yaml:"tzdata" json:"tzdata"`
+	// Base images for specific platforms (os/arch[/variant], os/arch or
+	// "*" for any other platform)
+	From map[string]string `yaml:"from" json:"from"`
+	// Build arguments (ARG instructions) by name, with their default
+	// values (which can be overridden with --build-arg)
+	BuildArgs map[string]string `yaml:"buildarg" json:"buildarg"`
+	// Variables (by name) available to the Dockerfile template
+	Vars map[string]string `yaml:"var" json:"var"`
+	// Packages (given relative to the package directory) to build job
+	// images (e.g., migrations) from, by job name
+	Jobs map[string]string `yaml:"job" json:"job"`
+	// Directives that only apply when some condition holds
+	When []Conditional `yaml:"when" json:"when"`
+	// Directives that override the others for a profile, by name
+	Profiles map[string]Profile `yaml:"profile" json:"profile"`
+	// Name to tag the image with (only given by a profile)
+	Tag string `yaml:"-" json:"-"`
+
+	// Values of environment variables read from environment files and
+	// given with -e (see getenv)
+	envValues    map[string]string
+	envOverrides map[string]string
+}
+
+// The parseConfig function walks the elements in the (Denada) config file
+// and uses them to populate an instance of the Config structure.
+func parseConfig(config denada.ElementList) (Config, error) {
+	// Initial configuration is empty
+	ret := Config{}
+
+	// Look for any "include" elements (the file is the description)
+	for _, e := range config.OfRule("include", false) {
+		ret.Includes = append(ret.Includes, e.Description)
+	}
+
+	// Look for any elements that match the "env" rule and add their
+	// name to the Config.Env array
+	for _, e := range config.OfRule("env", false) {
+		ret.Env = append(ret.Env, e.Name)
+	}
+
+	// Look for any elements that match the "required" rule (i.e.,
+	// required env) and add their name to the Config.Required array
+	for _, e := range config.OfRule("required", false) {
+		ret.Required = append(ret.Required, e.Name)
+	}
+
+	// Look for any elements that match the "port" rule, turn their
+	// name into a port number (and protocol) and then add them to the
+	// Config.Ports array.  The description (if any) says what the port
+	// is for.
+	for _, e := range config.OfRule("port", false) {
+		port, err := parsePort(e.Name)
+		if err != nil {
+			return ret, err
+		}
+		port.Name = e.Description
+		ret.Ports = append(ret.Ports, port)
+	}
+
+	// Look for any elements that match the "file" rule and add them
+	// to the Config.Files array.
+	for _, e := range config.OfRule("file", false) {
+		ret.Files = append(ret.Files, File{Src: e.Name})
+	}
+
+	// Look for any elements that match the "filespec" rule (i.e., a file
+	// directive with contents giving its destination, mode, owner and
+	// checksum) and add them to the Config.Files array as well.
+	for _, e := range config.OfRule("filespec", false) {
+		f := File{Src: e.Name}
+		for _, d := range e.Contents.OfRule("dest", false) {
+			f.Dest = d.Description
+		}
+		for _, d := range e.Contents.OfRule("mode", false) {
+			f.Mode = d.Description
+		}
+		for _, d := range e.Contents.OfRule("owner", false) {
+			f.Owner = d.Description
+		}
+		for _, d := range e.Contents.OfRule("sha256", false) {
+			f.Sha256 = d.Description
+		}
+		ret.Files = append(ret.Files, f)
+	}
+
+	// Look for a "filedest" element (the directory is the description)
+	for _, e := range config.OfRule("filedest", false) {
+		ret.FileDest = e.Description
+	}
+
+	// Look for any elements that match the "volume" rule and add them
+	// to the Config.Volumes array.
+	for _, e := range config.OfRule("volume", false) {
+		ret.Volumes = append(ret.Volumes, e.Name)
+	}
+
+	// Look for any elements that match the "arg" rule and add their
+	// descriptions (in order) to the Config.Args array
+	for _, e := range config.OfRule("arg", false) {
+		ret.Args = append(ret.Args, e.Description)
+	}
+
+	// Look for any elements that match the "harness" rule and add their
+	// descriptions (in order) to the Config.Harness array
+	for _, e := range config.OfRule("harness", false) {
+		ret.Harness = append(ret.Harness, e.Description)
+	}
+
+	// Check whether the "entrypoint" rule is present
+	ret.Entrypoint = len(config.OfRule("entrypoint", false)) > 0
+
+	// Look for any elements that match the "package" rule and add them
+	// to the Config.Packages array.
+	for _, e := range config.OfRule("package", false) {
+		ret.Packages = append(ret.Packages, e.Name)
+	}
+
+	// Look for a "default" element indicating which binary to run
+	for _, e := range config.OfRule("default", false) {
+		ret.Default = e.Name
+	}
+
+	// Look for a "binary" element (the name is the description)
+	for _, e := range config.OfRule("binary", false) {
+		ret.Binary = e.Description
+	}
+
+	// Look for a "bindir" element (the directory is the description)
+	for _, e := range config.OfRule("bindir", false) {
+		ret.BinDir = e.Description
+	}
+
+	// Look for a "version" element (the version is the description)
+	for _, e := range config.OfRule("version", false) {
+		ret.Version = e.Description
+	}
+
+	// Look for a "test" element indicating whether to run the tests
+	for _, e := range config.OfRule("test", false) {
+		val, err := strconv.ParseBool(e.Name)
+		if err != nil {
+			return ret, fmt.Errorf("Invalid value for test: %s", e.Name)
+		}
+		ret.Test = val
+	}
+
+	// Look for a "generate" element indicating whether to run 'go
+	// generate'
+	for _, e := range config.OfRule("generate", false) {
+		val, err := strconv.ParseBool(e.Name)
+		if err != nil {
+			return ret, fmt.Errorf("Invalid value for generate: %s", e.Name)
+		}
+		ret.Generate = val
+	}
+
+	// Look for a "vet" element indicating whether to run 'go vet'
+	for _, e := range config.OfRule("vet", false) {
+		val, err := strconv.ParseBool(e.Name)
+		if err != nil {
+			return ret, fmt.Errorf("Invalid value for vet: %s", e.Name)
+		}
+		ret.Vet = val
+	}
+
+	// Look for a "lint" element (the command is the description)
+	for _, e := range config.OfRule("lint", false) {
+		ret.Lint = e.Description
+	}
+
+	// Look for a "build" element (the command is the description) and
+	// a "buildoutput" element (the path is the description)
+	for _, e := range config.OfRule("build", false) {
+		ret.Build = e.Description
+	}
+	for _, e := range config.OfRule("buildoutput", false) {
+		ret.BuildOutput = e.Description
+	}
+
+	// Look for any "registry" elements giving the credentials (the
+	// contents) for a registry (the name)
+	for _, e := range config.OfRule("registry", false) {
+		r := Registry{}
+		for _, d := range e.Contents.OfRule("username", false) {
+			r.Username = d.Description
+		}
+		for _, d := range e.Contents.OfRule("password", false) {
+			r.Password = d.Description
+		}
+		for _, d := range e.Contents.OfRule("helper", false) {
+			r.Helper = d.Description
+		}
+		if ret.Registries == nil {
+			ret.Registries = map[string]Registry{}
+		}
+		ret.Registries[e.Name] = r
+	}
+
+	// Look for any "hook" elements giving a command (the description)
+	// to run at a point in the build (the name)
+	for _, e := range config.OfRule("hook", false) {
+		if ret.Hooks == nil {
+			ret.Hooks = map[string][]string{}
+		}
+		ret.Hooks[e.Name] = append(ret.Hooks[e.Name], e.Description)
+	}
+
+	// Look for a "certs" element indicating whether to add a CA bundle
+	for _, e := range config.OfRule("certs", false) {
+		val, err := strconv.ParseBool(e.Name)
+		if err != nil {
+			return ret, fmt.Errorf("Invalid value for certs: %s", e.Name)
+		}
+		ret.Certs = val
+	}
+
+	// Look for a "tzdata" element indicating whether to add the time
+	// zone database
+	for _, e := range config.OfRule("tzdata", false) {
+		val, err := strconv.ParseBool(e.Name)
+		if err != nil {
+			return ret, fmt.Errorf("Invalid value for tzdata: %s", e.Name)
+		}
+		ret.Tzdata = val
+	}
+
+	// Look for any "from" elements giving the base image (the
+	// description) for a platform (the name)
+	for _, e := range config.OfRule("from", false) {
+		if ret.From == nil {
+			ret.From = map[string]string{}
+		}
+		ret.From[e.Name] = e.Description
+	}
+
+	// Look for any "buildarg" elements declaring a build argument (the
+	// name) and its default value (the description)
+	for _, e := range config.OfRule("buildarg", false) {
+		if ret.BuildArgs == nil {
+			ret.BuildArgs = map[string]string{}
+		}
+		ret.BuildArgs[e.Name] = e.Description
+	}
+
+	// Look for any "var" elements giving the value (the description) of
+	// a template variable (the name)
+	for _, e := range config.OfRule("var", false) {
+		if ret.Vars == nil {
+			ret.Vars = map[string]string{}
+		}
+		ret.Vars[e.Name] = e.Description
+	}
+
+	// Look for any "job" elements giving the package (the description)
+	// to build the image for a job (the name) from
+	for _, e := range config.OfRule("job", false) {
+		if ret.Jobs == nil {
+			ret.Jobs = map[string]string{}
+		}
+		ret.Jobs[e.Name] = e.Description
+	}
+
+	// Look for a "tag" element (which only appears in profiles, where
+	// the tag is the description)
+	for _, e := range config.OfRule("tag", false) {
+		ret.Tag = e.Description
+	}
+
+	// Look for any "profile" elements.  The name is the name of the
+	// profile and the contents are the directives it overrides (which
+	// are parsed just like the top level ones).
+	for _, e := range config.OfRule("profile", false) {
+		contents, err := parseConfig(e.Contents)
+		if err != nil {
+			return ret, err
+		}
+		if ret.Profiles == nil {
+			ret.Profiles = map[string]Profile{}
+		}
+		ret.Profiles[e.Name] = Profile{
+			Env:      contents.Env,
+			Required: contents.Required,
+			Ports:    contents.Ports,
+			From:     contents.From,
+			Tag:      contents.Tag,
+		}
+	}
+
+	// Look for any "when" elements.  The name is the condition and the
+	// contents are the directives that apply when it holds (which are
+	// parsed just like the top level ones).
+	for _, e := range config.OfRule("when", false) {
+		contents, err := parseConfig(e.Contents)
+		if err != nil {
+			return ret, err
+		}
+		ret.When = append(ret.When, Conditional{
+			If:       e.Name,
+			Files:    contents.Files,
+			Env:      contents.Env,
+			Required: contents.Required,
+			Ports:    contents.Ports,
+			Volumes:  contents.Volumes,
+			Packages: contents.Packages,
+		})
+	}
+
+	// Return all the data that was collected (which is checked once the
+	// whole file has been parsed)
+	return ret, nil
+}
+
+// The finish function expands the references to environment variables
+// in a configuration that has just been read and then validates it
+// (regardless of which format it came from).
+func finish(c Config) (Config, error) {
+	c, err := c.expand()
+	if err != nil {
+		return c, err
+	}
+	// Required environment variables are environment variables as well
+	c.Env = appendMissing(c.Env, c.Required)
+	for i := range c.When {
+		c.When[i].Env = appendMissing(c.When[i].Env, c.When[i].Required)
+	}
+	for name, p := range c.Profiles {
+		if p.Required != nil {
+			p.Env = appendMissing(p.Env, p.Required)
+			c.Profiles[name] = p
+		}
+	}
+	return c, c.validate()
+}
+
+// The appendMissing function adds the given names (e.g., of required
+// environment variables) to a list of names, unless they are already in
+// it.
+func appendMissing(list []string, names []string) []string {
+	for _, name := range names {
+		listed := false
+		for _, l := range list {
+			listed = listed || l == name
+		}
+		if !listed {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+// The validate method checks the values in the configuration (regardless
+// of which format they came from).
+func (c Config) validate() error {
+	// Ports must be in range (and use a valid protocol)
+	for _, p := range c.Ports {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+
+	// If there is a linter, we need to know what to run
+	if c.Lint != "" && strings.TrimSpace(c.Lint) == "" {
+		return fmt.Errorf("Empty lint command")
+	}
+
+	// If there is a build command, we need to know what to run (and
+	// where to find what it builds)
+	if c.Build != "" && strings.TrimSpace(c.Build) == "" {
+		return fmt.Errorf("Empty build command")
+	}
+	if c.BuildOutput != "" && c.Build == "" {
+		return fmt.Errorf("Output of the build command given without a build command: %s", c.BuildOutput)
+	}
+	if path.IsAbs(c.BuildOutput) || strings.HasPrefix(path.Clean(c.BuildOutput), "../") {
+		return fmt.Errorf("Output of the build command must be within the package directory: %s", c.BuildOutput)
+	}
+
+	// The credentials for registries must be complete
+	for host, r := range c.Registries {
+		if err := r.validate(host); err != nil {
+			return err
+		}
+	}
+
+	// Hooks can only be run at the points we know about (and need a
+	// command to run)
+	for which, cmds := range c.Hooks {
+		if !validHook(which) {
+			return fmt.Errorf("Unknown hook %s (must be %s or %s)", which, preBuildHook, postBuildHook)
+		}
+		for _, cmd := range cmds {
+			if strings.TrimSpace(cmd) == "" {
+				return fmt.Errorf("Empty command for %s hook", which)
+			}
+		}
+	}
+
+	// The executables must be installed somewhere sensible
+	if err := c.validateBinary(); err != nil {
+		return err
+	}
+
+	// Files are added to an absolute path (within the image)
+	if c.FileDest != "" && (!path.IsAbs(c.FileDest) || strings.ContainsAny(c.FileDest, " \t\r\n")) {
+		return fmt.Errorf("Destination for files must be an absolute path (without spaces): %s", c.FileDest)
+	}
+
+	// Files must be added with valid destinations, modes and owners
+	for _, f := range c.Files {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+
+	// Volumes must be absolute paths (within the image)
+	for _, v := range c.Volumes {
+		if !path.IsAbs(v) {
+			return fmt.Errorf("Volume must be an absolute path: %s", v)
+		}
+	}
+
+	// Base images must be for valid platforms
+	for p, image := range c.From {
+		if image == "" {
+			return fmt.Errorf("No base image given for %s", p)
+		}
+		if p == "*" {
+			continue
+		}
+		if _, err := parsePlatform(p); err != nil {
+			return err
+		}
+	}
+
+	// Build arguments are substituted in the Dockerfile (and their
+	// defaults are written to it)
+	for name, value := range c.BuildArgs {
+		if !buildArgName.MatchString(name) {
+			return fmt.Errorf("Invalid build argument name: %s", name)
+		}
+		if _, err := dockerQuote(value); err != nil {
+			return fmt.Errorf("Invalid default for build argument %s: %v", name, err)
+		}
+	}
+
+	// Template variables are referred to by name in templates
+	for name := range c.Vars {
+		if !templateVarName.MatchString(name) {
+			return fmt.Errorf("Invalid variable name: %s", name)
+		}
+	}
+
+	// Job names become part of the image name
+	for name, dir := range c.Jobs {
+		if !jobName.MatchString(name) {
+			return fmt.Errorf("Invalid job name: %s", name)
+		}
+		if dir == "" {
+			return fmt.Errorf("No package given for job %s", name)
+		}
+	}
+
+	// Profiles must be valid as well
+	for name, p := range c.Profiles {
+		if name == "" {
+			return fmt.Errorf("Empty profile name")
+		}
+		err := Config{Ports: p.Ports, From: p.From}.validate()
+		if err != nil {
+			return fmt.Errorf("Profile %s: %v", name, err)
+		}
+	}
+
+	// Conditions must be ones we know how to evaluate (and the
+	// directives that depend on them must be valid as well)
+	for _, w := range c.When {
+		if _, _, _, err := parseCondition(w.If); err != nil {
+			return err
+		}
+		err := Config{Ports: w.Ports, Volumes: w.Volumes, Files: w.Files}.validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This matches the names executables can be installed with
+var binaryName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// The validateBinary method checks the name and directory of the
+// executables (which are written to the Dockerfile).
+func (c Config) validateBinary() error {
+	if c.Binary != "" && !binaryName.MatchString(c.Binary) {
+		return fmt.Errorf("Invalid name for the executable: %s", c.Binary)
+	}
+	if c.BinDir != "" && (!path.IsAbs(c.BinDir) || strings.ContainsAny(c.BinDir, " \t\r\n")) {
+		return fmt.Errorf("Directory for the executables must be an absolute path (without spaces): %s", c.BinDir)
+	}
+	return nil
+}
+
+// The readDenadaConfig function parses a (Denada) configuration file and
+// checks it against the grammar to make sure we know exactly what is in
+// it before extracting the information we need.
+func readDenadaConfig(cfile string) (Config, error) {
+	// Parse the *grammar* for the configuration file
+	grammar, err := denada.ParseString(configGrammar)
+	if err != nil {
+		// This should not happen
+		return Config{}, fmt.Errorf("Internal error in grammar specification: %v", err)
+	}
+
+	conf, err := denada.ParseFile(cfile)
+	if err != nil {
+		return Config{}, fmt.Errorf("Error reading configuration file %s: %v", cfile, err)
+	}
+
+	err = denada.Check(conf, grammar, false)
+	if err != nil {
+		return Config{}, err
+	}
+
+	return parseConfig(conf)
+}
+
+// The readYAMLConfig function reads a YAML configuration file.  Unknown
+// keys are treated as errors (just like they are in Denada files).
+func readYAMLConfig(cfile string) (Config, error) {
+	ret := Config{}
+	data, err := ioutil.ReadFile(cfile)
+	if err != nil {
+		return ret, err
+	}
+	err = yaml.UnmarshalStrict(data, &ret)
+	if err != nil {
+		return ret, fmt.Errorf("Error reading configuration file %s: %v", cfile, err)
+	}
+	return ret, nil
+}
+
+// The readJSONConfig function reads a JSON configuration file.  Unknown
+// keys are treated as errors (just like they are in Denada files).
+func readJSONConfig(cfile string) (Config, error) {
+	ret := Config{}
+	data, err := ioutil.ReadFile(cfile)
+	if err != nil {
+		return ret, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&ret)
+	if err != nil {
+		return ret, fmt.Errorf("Error reading configuration file %s: %v", cfile, err)
+	}
+	return ret, nil
+}
+
+// The readConfigFile function reads a configuration file (in the format
+// given by its extension) along with the files it includes.  The names
+// of the files that (directly or indirectly) include it are given so
+// that include cycles can be detected.
+func readConfigFile(cfile string, including []string) (Config, error) {
+	for _, f := range including {
+		if f == cfile {
+			return Config{}, fmt.Errorf("Configuration file %s includes itself", cfile)
+		}
+	}
+
+	config, err := parseConfigFile(cfile)
+	if err != nil {
+		return config, err
+	}
+	return config.include(cfile, append(including, cfile))
+}
+
+// The parseConfigFile function reads the configuration in cfile (in
+// whichever format its extension says it is in), without reading the
+// files it includes.
+func parseConfigFile(cfile string) (Config, error) {
+	switch filepath.Ext(cfile) {
+	case ".yaml", ".yml":
+		return readYAMLConfig(cfile)
+	case ".json":
+		return readJSONConfig(cfile)
+	default:
+		return readDenadaConfig(cfile)
+	}
+}
+
+// The loadConfig function looks for a configuration file in the package
+// directory and reads it.  If there is no configuration file, the
+// configuration is empty.  Any conditional directives are resolved
+// (using the profiles in the options) and the values in environment files
+// are read.
+func loadConfig(apdir string, Options Options) (Config, error) {
+	// Find all the configuration files that exist
+	found := []string{}
+	for _, name := range configFiles {
+		cfile := filepath.Join(apdir, name)
+		if _, err := os.Stat(cfile); err == nil {
+			found = append(found, cfile)
+		}
+	}
+
+	// Assume no configuration options...
+	config := Config{}
+	var err error
+
+	// ...unless a configuration file exists.  If there are several,
+	// the first one takes precedence.
+	if len(found) > 0 {
+		cfile := found[0]
+		if len(found) > 1 {
+			warnf("Using configuration file %s and ignoring %v", cfile, found[1:])
+		}
+		verbosef("Configuration file: %s", cfile)
+
+		config, err = readConfigFile(cfile, nil)
+		if err == nil {
+			config, err = finish(config)
+		}
+		if err != nil {
+			return config, err
+		}
+		config, err = config.resolve(Options.Profile)
+		if err != nil {
+			return config, err
+		}
+		config.envValues, err = loadEnvFiles(Options, apdir)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	// Environment variables given with -e are added to the image
+	// whether the configuration lists them or not
+	config.envOverrides, err = parseEnvOverrides(Options.Env)
+	if err != nil {
+		return config, err
+	}
+	config.Env = appendMissing(config.Env, sortedKeys(config.envOverrides))
+
+	// ...and so are ports given with --port
+	ports, err := parsePorts(Options.Port)
+	if err != nil {
+		return config, err
+	}
+	config.Ports = mergePorts(config.Ports, ports)
+
+	// The name and directory of the executable given with --binary and
+	// --bindir override the ones in the configuration
+	if Options.Binary != "" {
+		config.Binary = Options.Binary
+	}
+	if Options.BinDir != "" {
+		config.BinDir = Options.BinDir
+	}
+	return config, config.validateBinary()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An ignorePattern is one line of a .dockerignore file
+type ignorePattern struct {
+	// The (slash separated) pattern, relative to the build context
+	pattern string
+	// Whether this is an exception (i.e., the line started with '!')
+	negate bool
+}
+
+// The readIgnore function reads the patterns in a .dockerignore file.
+// Blank lines and comments are skipped.  If the file doesn't exist,
+// there are no patterns.
+func readIgnore(file string) ([]ignorePattern, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := []ignorePattern{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = strings.TrimSpace(line[1:])
+		}
+		p.pattern = strings.TrimPrefix(path.Clean(filepath.ToSlash(line)), "/")
+		if _, err := path.Match(p.pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %s in %s: %v", line, file, err)
+		}
+		ret = append(ret, p)
+	}
+	return ret, scanner.Err()
+}
+
+// The ignored function determines whether the file with the given
+// (slash separated) path, relative to the build context, is excluded by
+// the patterns.  Like Docker, the last pattern that matches the file (or
+// any of the directories it is in) wins.  Unlike Docker, "**" is not
+// supported.
+func ignored(patterns []ignorePattern, rel string) bool {
+	ret := false
+	for _, p := range patterns {
+		for dir := rel; dir != "."; dir = path.Dir(dir) {
+			if matched, _ := path.Match(p.pattern, dir); matched {
+				ret = !p.negate
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// The writeDockerignore function generates the .dockerignore file for the
+// build directory.  Only the Dockerfile and the executables (names) are
+// needed by the build, so everything else is ignored.  Any patterns in
+// the .dockerignore file in the package directory (apdir) are added as
+// well.
+func writeDockerignore(dir string, apdir string, names []string) error {
+	lines := []string{"# Generated by hidalgo", "*", "!Dockerfile"}
+	for _, name := range names {
+		lines = append(lines, "!"+name)
+	}
+
+	pfile := filepath.Join(apdir, ".dockerignore")
+	contents, err := ioutil.ReadFile(pfile)
+	if err == nil {
+		verbosef("Adding the patterns in %s to .dockerignore", pfile)
+		lines = append(lines, "", "# From "+pfile, strings.TrimSpace(string(contents)))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, ".dockerignore"),
+		[]byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// The contextFiles function returns the (slash separated) paths of all
+// the files in the build directory that are not excluded by its
+// .dockerignore file (if any).  These are the files that are sent to
+// Docker.
+func contextFiles(dir string) ([]string, error) {
+	patterns, err := readIgnore(filepath.Join(dir, ".dockerignore"))
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []string{}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// Docker always needs these (even if they are ignored)
+		if rel == "Dockerfile" || rel == ".dockerignore" || !ignored(patterns, rel) {
+			ret = append(ret, rel)
+		} else {
+			debugf("  Not sending %s to Docker", rel)
+		}
+		return nil
+	})
+	sort.Strings(ret)
+	return ret, err
+}
+
+// The contextArchive function returns a reader for the build context
+// (the files in the build directory that are sent to Docker) as a gzip'd
+// tar.  The archive is written (in the background) as it is read, and
+// any error writing it is returned by the reader.  How long that takes
+// (i.e., until everything has been sent) is recorded (if there is a
+// record of the build).
+func contextArchive(c buildContext, record *BuildRecord) (io.ReadCloser, error) {
+	files, err := contextFiles(c.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to determine the build context: %v", err)
+	}
+	debugf("  Build context: %v", files)
+
+	reader, writer := io.Pipe()
+	go func() {
+		start := time.Now()
+		err := writeArchive(c.Dir, files, c.Modes, writer)
+		record.phase("tar", start)
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// The writeArchive function writes the given files (slash separated
+// paths relative to dir) to w as a gzip'd tar, with the given modes (for
+// any that have one).
+func writeArchive(dir string, files []string, modes map[string]os.FileMode, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range files {
+		err := addFile(tw, dir, name, modes[name])
+		if err != nil {
+			return err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// The archiveMode function returns the mode a file (on a build machine
+// running goos) has in the build context, given the mode it has on the
+// build machine.  A mode given for it in the configuration always wins.
+// Otherwise, Windows doesn't have permission bits, so we have to make
+// sure the executables can be run in the image.
+func archiveMode(goos string, current int64, mode os.FileMode) int64 {
+	if mode != 0 {
+		return int64(mode.Perm())
+	}
+	if goos == "windows" {
+		return 0755
+	}
+	return current
+}
+
+// The addFile function adds a single file to the tar archive (with the
+// given mode, if it isn't 0).
+func addFile(tw *tar.Writer, dir string, name string, mode os.FileMode) error {
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	// Who owns the files on the build machine doesn't matter (and would
+	// make otherwise identical contexts differ)
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.Mode = archiveMode(runtime.GOOS, hdr.Mode, mode)
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	if err != nil {
+		return fmt.Errorf("Error archiving %s: %v", name, err)
+	}
+	return nil
+}
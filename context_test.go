@@ -0,0 +1,84 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestArchiveMode(t *testing.T) {
+	cases := []struct {
+		goos    string
+		current int64
+		mode    os.FileMode
+		want    int64
+	}{
+		{"linux", 0644, 0, 0644},
+		{"linux", 0755, 0, 0755},
+		{"linux", 0644, 0600, 0600},
+		{"windows", 0666, 0, 0755},
+		{"windows", 0666, 0600, 0600},
+		{"windows", 0666, 0440, 0440},
+	}
+	for _, c := range cases {
+		got := archiveMode(c.goos, c.current, c.mode)
+		if got != c.want {
+			t.Errorf("archiveMode(%s, %o, %o) = %o, expected %o", c.goos, c.current, c.mode, got, c.want)
+		}
+	}
+}
+
+// The modes given in the configuration end up in the build context
+// (whatever the files on the build machine have)
+func TestWriteArchiveModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidalgo-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"app", "files-1/app.cfg"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	modes := map[string]os.FileMode{"files-1/app.cfg": 0600}
+	err = writeArchive(dir, []string{"app", "files-1/app.cfg"}, modes, &buf)
+	if err != nil {
+		t.Fatalf("Archiving failed: %v", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	found := map[string]int64{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		found[hdr.Name] = hdr.Mode
+	}
+	if found["files-1/app.cfg"] != 0600 {
+		t.Errorf("files-1/app.cfg has mode %o, expected 600", found["files-1/app.cfg"])
+	}
+	if want := archiveMode(runtime.GOOS, 0644, 0); found["app"] != want {
+		t.Errorf("app has mode %o, expected %o", found["app"], want)
+	}
+}
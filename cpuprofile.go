@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+)
+
+// The startCPUProfile function starts profiling hidalgo itself (with
+// --cpu-profile), which helps to find out why builds are slow.  It
+// returns the function that stops profiling (and writes the profile).
+func startCPUProfile(Options Options) (func(), error) {
+	if Options.CPUProfile == "" {
+		return func() {}, nil
+	}
+	f, err := os.Create(Options.CPUProfile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create CPU profile: %v", err)
+	}
+	err = pprof.StartCPUProfile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to start CPU profile: %v", err)
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+		verbosef("CPU profile written to %s (see 'go tool pprof')", Options.CPUProfile)
+	}, nil
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// This is the backend that assembles the image itself (rather than
+// having a daemon or build tool build it from the Dockerfile)
+const daemonlessBackend = "daemonless"
+
+// These are the files (in the build directory) that the layers added to
+// the base image are written to.  Everything but the executables (which
+// change the most often) goes in the lower one, so that it can be reused
+// by the next build (rather than pushed and pulled again).
+const (
+	filesLayer = "files.tar"
+	binLayer   = "executables.tar"
+)
+
+// The checkDaemonless function makes sure that, if the image is to be
+// assembled without a daemon, we are able to do that.  There is no
+// daemon to leave the image in, so it must be pushed or saved, and only
+// what the built in template does can be done.
+func checkDaemonless(Options Options, config Config) error {
+	if !backends[Options.Backend].daemonless {
+		return nil
+	}
+	if !Options.push && !saving(Options) && !Options.Dry {
+		return fmt.Errorf("Images built without a daemon must be pushed or saved (with --save-to, --oci-layout or --ssh-copy-to)")
+	}
+	if len(Options.Agent) > 0 {
+		return fmt.Errorf("Images can't be built without a daemon by a build agent")
+	}
+	if Options.Template != "" {
+		return fmt.Errorf("Images built without a daemon can't use a custom template")
+	}
+	if Options.DebugVariant {
+		return fmt.Errorf("Debug variants can't be built without a daemon")
+	}
+	if Options.Tag != "" {
+		if _, err := name.ParseReference(Options.Tag); err != nil {
+			return fmt.Errorf("Invalid tag %s: %v", Options.Tag, err)
+		}
+	}
+	// Names can only be looked up in the image, which we don't run
+	for _, f := range config.Files {
+		if _, _, err := numericOwner(f.Owner); err != nil {
+			return fmt.Errorf("File %s: %v", f.Src, err)
+		}
+	}
+	return nil
+}
+
+// The numericOwner function parses the owner of a file (given as
+// uid[:gid]).  Without a group, the group ID is the same as the user ID
+// (just as it is for COPY --chown).
+func numericOwner(owner string) (int, int, error) {
+	if owner == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(owner, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Owner %s must be given by ID to build without a daemon", owner)
+	}
+	gid := uid
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("Owner %s must be given by ID to build without a daemon", owner)
+		}
+	}
+	return uid, gid, nil
+}
+
+// A layerWriter writes the files added to the base image to a layer
+// (i.e., a tar file), along with the directories they are in.
+type layerWriter struct {
+	tw *tar.Writer
+	// The directories that have been written so far
+	dirs map[string]bool
+	// The number of files written so far
+	files int
+	// The modification time of the directories
+	mtime time.Time
+	// Whether the files keep their own modification times (otherwise,
+	// they get mtime as well)
+	keepTimes bool
+}
+
+// The newLayerWriter function creates a layerWriter that writes to w.
+func newLayerWriter(w io.Writer, mtime time.Time, keepTimes bool) *layerWriter {
+	return &layerWriter{tw: tar.NewWriter(w), dirs: map[string]bool{}, mtime: mtime, keepTimes: keepTimes}
+}
+
+// The dir method writes the given directory (in the image) and any of
+// its parents that haven't been written yet.
+func (l *layerWriter) dir(name string) error {
+	name = strings.Trim(path.Clean(name), "/")
+	if name == "" || name == "." || l.dirs[name] {
+		return nil
+	}
+	err := l.dir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	l.dirs[name] = true
+	return l.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  l.mtime,
+		Format:   tar.FormatPAX,
+	})
+}
+
+// The file method writes the file src (in the build directory) to the
+// given place in the image, with the given mode (if any) and owner.
+func (l *layerWriter) file(src string, dest string, mode string, uid int, gid int) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimPrefix(path.Clean(dest), "/")
+	err = l.dir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(info.Mode().Perm()),
+		Size:     info.Size(),
+		ModTime:  l.mtime,
+		Uid:      uid,
+		Gid:      gid,
+		Format:   tar.FormatPAX,
+	}
+	if mode != "" {
+		m, err := strconv.ParseInt(mode, 8, 32)
+		if err != nil {
+			return err
+		}
+		hdr.Mode = m
+	}
+	if l.keepTimes {
+		hdr.ModTime = info.ModTime()
+	}
+	l.files++
+	err = l.tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(l.tw, f)
+	return err
+}
+
+// The add method adds src (in the build directory) to the image the way
+// an ADD (or COPY) instruction does.  The contents of a directory are
+// added to the destination, and a file is added as the destination
+// (or to it, if it ends with '/').
+func (l *layerWriter) add(src string, dest string, mode string, owner string) error {
+	uid, gid, err := numericOwner(owner)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if strings.HasSuffix(dest, "/") {
+			dest = path.Join(dest, filepath.Base(src))
+		}
+		return l.file(src, dest, mode, uid, gid)
+	}
+	err = l.dir(dest)
+	if err != nil {
+		return err
+	}
+	// Walk visits the files in lexical order, so the layer is always
+	// the same
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == src {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return l.dir(target)
+		}
+		return l.file(p, target, mode, uid, gid)
+	})
+}
+
+// The writeLayer function writes a layer (to the named file in the build
+// directory) with whatever the given function adds to it.  It returns
+// the layer file, unless nothing was added (in which case there is no
+// layer).
+func writeLayer(dir string, name string, mtime time.Time, keepTimes bool, add func(l *layerWriter) error) (string, error) {
+	file := filepath.Join(dir, name)
+	f, err := os.Create(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	l := newLayerWriter(f, mtime, keepTimes)
+	err = add(l)
+	if err != nil {
+		return "", err
+	}
+	err = l.tw.Close()
+	if err != nil {
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+	if l.files == 0 {
+		return "", os.Remove(file)
+	}
+	return file, nil
+}
+
+// The writeLayers function writes the layers with everything the built
+// in template adds to the image (as given in the template context) to
+// the build directory, in the same order as the Dockerfile adds them (so
+// a later file replaces an earlier one in the same place).  The files
+// in the lower layer all get the same (fixed) modification time, so the
+// layer doesn't change unless their contents do.  It returns the layer
+// files (from the bottom up).
+func writeLayers(Options Options, dir string, context map[string]interface{}) ([]string, error) {
+	ret := []string{}
+	files, err := writeLayer(dir, filesLayer, time.Unix(0, 0), false, func(l *layerWriter) error {
+		if certs := context["certs"].(string); certs != "" {
+			err := l.add(filepath.Join(dir, certs), "/etc/ssl/certs/ca-certificates.crt", "", "")
+			if err != nil {
+				return err
+			}
+		}
+		if tzdata := context["tzdata"].(string); tzdata != "" {
+			err := l.add(filepath.Join(dir, tzdata), "/usr/local/go/lib/time/zoneinfo.zip", "", "")
+			if err != nil {
+				return err
+			}
+		}
+		if files := context["files"].(string); files != "" {
+			err := l.add(filepath.Join(dir, files), context["filedest"].(string), "", "")
+			if err != nil {
+				return err
+			}
+		}
+		for _, c := range context["copies"].([]FileCopy) {
+			err := l.add(filepath.Join(dir, filepath.FromSlash(c.Paths[0])), c.Paths[1], c.Mode, c.Owner)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if files != "" {
+		ret = append(ret, files)
+	}
+
+	// The executables keep their modification times (which are fixed
+	// for a reproducible build), but not their modes (which, on Windows,
+	// wouldn't let them be run)
+	bins, err := writeLayer(dir, binLayer, buildTime(Options), true, func(l *layerWriter) error {
+		for _, bin := range context["executables"].([]Binary) {
+			err := l.add(filepath.Join(dir, bin.Name), bin.Path, "0755", "")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bins != "" {
+		ret = append(ret, bins)
+	}
+	return ret, nil
+}
+
+// The setEnv function sets an environment variable (given as KEY=value,
+// like they are in an image configuration), replacing any value it
+// already has (just like an ENV instruction).
+func setEnv(env []string, key string, value string) []string {
+	ret := []string{}
+	for _, e := range env {
+		if !strings.HasPrefix(e, key+"=") {
+			ret = append(ret, e)
+		}
+	}
+	return append(ret, key+"="+value)
+}
+
+// The imageConfig function applies the configuration the built in
+// template gives the image (as given in the template context) to the
+// configuration of the base image.
+func imageConfig(c v1.Config, context map[string]interface{}) v1.Config {
+	if context["certs"].(string) != "" {
+		c.Env = setEnv(c.Env, "SSL_CERT_FILE", "/etc/ssl/certs/ca-certificates.crt")
+	}
+	if context["tzdata"].(string) != "" {
+		c.Env = setEnv(c.Env, "ZONEINFO", "/usr/local/go/lib/time/zoneinfo.zip")
+	}
+	env := context["env"].(map[string]string)
+	for _, key := range sortedKeys(env) {
+		c.Env = setEnv(c.Env, key, env[key])
+	}
+
+	labels := context["labels"].(map[string]string)
+	if c.Labels == nil {
+		c.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		c.Labels[key] = value
+	}
+
+	if context["files"].(string) != "" {
+		c.WorkingDir = context["filedest"].(string)
+	}
+	for _, p := range context["ports"].([]Port) {
+		if c.ExposedPorts == nil {
+			c.ExposedPorts = map[string]struct{}{}
+		}
+		key := p.String()
+		if !strings.Contains(key, "/") {
+			key += "/tcp"
+		}
+		c.ExposedPorts[key] = struct{}{}
+	}
+	for _, v := range context["volumes"].([]string) {
+		if c.Volumes == nil {
+			c.Volumes = map[string]struct{}{}
+		}
+		c.Volumes[v] = struct{}{}
+	}
+
+	// An ENTRYPOINT resets the CMD of the base image
+	if ep := context["entrypoint"].([]string); ep != nil {
+		c.Entrypoint = ep
+		c.Cmd = nil
+	}
+	if cmd := context["cmd"].([]string); cmd != nil {
+		c.Cmd = cmd
+	}
+	return c
+}
+
+// The baseImageFor function fetches the base image (from its registry)
+// for the given platform.  Nothing is fetched for scratch.
+func baseImageFor(from string, platform Platform) (v1.Image, error) {
+	if from == "scratch" {
+		return empty.Image, nil
+	}
+	ref, err := name.ParseReference(from)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base image %s: %v", from, err)
+	}
+	verbosef("Fetching base image %s", from)
+	img, err := remote.Image(ref,
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithPlatform(v1.Platform{OS: platform.OS, Architecture: platform.Arch, Variant: platform.Variant}))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch base image %s: %v", from, err)
+	}
+	return img, nil
+}
+
+// The pushKeychain function returns the credentials to push the tagged
+// image with.  These are the ones given in the options or configuration
+// (if any) or otherwise those stored by 'docker login'.
+func pushKeychain(Options Options, tag string) (remote.Option, error) {
+	auth, found, err := pushAuth(Options, tag)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return remote.WithAuthFromKeychain(authn.DefaultKeychain), nil
+	}
+	return remote.WithAuth(authn.FromConfig(authn.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+	})), nil
+}
+
+// The assembleImage function builds the image without a daemon, ko
+// style: the files the built in template adds (as given in the template
+// context) become two layers on top of the base image (one with the
+// executables and one with everything else), the configuration of the
+// base image is updated to match, and the result is pushed and/or
+// saved.  It returns what is known about the image.
+func assembleImage(Options Options, platform Platform, dir string, config Config,
+	context map[string]interface{}) ([]builtImage, error) {
+	images := []builtImage{{Tag: Options.Tag}}
+	if Options.Dry {
+		return images, nil
+	}
+	start := time.Now()
+
+	// Start with the base image (with any build arguments substituted,
+	// as they would be in the Dockerfile)...
+	args := buildArgValues(Options, config)
+	from := os.Expand(context["from"].(string), func(key string) string { return args[key] })
+	var base v1.Image
+	err := retry(Options, "fetch of "+from, Options.BuildRetries, func() error {
+		var err error
+		base, err = baseImageFor(from, platform)
+		return err
+	})
+	if err != nil {
+		return nil, &DockerError{err}
+	}
+
+	// ...add the layers with everything else and the executables...
+	files, err := writeLayers(Options, dir, context)
+	if err != nil {
+		return nil, &BuildError{fmt.Errorf("Unable to write image layers: %v", err)}
+	}
+	created := v1.Time{Time: buildTime(Options)}
+	adds := []mutate.Addendum{}
+	for _, file := range files {
+		layer, err := tarball.LayerFromFile(file)
+		if err != nil {
+			return nil, &BuildError{fmt.Errorf("Unable to read image layer: %v", err)}
+		}
+		what := "files"
+		if filepath.Base(file) == binLayer {
+			what = "executables"
+		}
+		adds = append(adds, mutate.Addendum{
+			Layer: layer,
+			History: v1.History{
+				Created:   created,
+				CreatedBy: "hidalgo " + context["package"].(string) + " (" + what + ")",
+			},
+		})
+	}
+	img, err := mutate.Append(base, adds...)
+	if err != nil {
+		return nil, &BuildError{err}
+	}
+
+	// ...and then configure the image to run it
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, &DockerError{fmt.Errorf("Invalid configuration for base image %s: %v", from, err)}
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Created = created
+	cfg.OS = platform.OS
+	cfg.Architecture = platform.Arch
+	cfg.Variant = platform.Variant
+	cfg.Config = imageConfig(cfg.Config, context)
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		return nil, &BuildError{err}
+	}
+	id, err := img.ConfigName()
+	if err != nil {
+		return nil, &BuildError{err}
+	}
+	Options.record.phase("build", start)
+	verbosef("Image assembled!")
+	images[0].ID = id.String()
+
+	ref, err := name.ParseReference(Options.Tag)
+	if err != nil {
+		return nil, &UsageError{fmt.Errorf("Invalid tag %s: %v", Options.Tag, err)}
+	}
+	if Options.push {
+		auth, err := pushKeychain(Options, Options.Tag)
+		if err != nil {
+			return nil, &DockerError{err}
+		}
+		digest, err := retryPush(Options, Options.Tag, func(tag string) (string, error) {
+			err := remote.Write(ref, img, auth)
+			if err != nil {
+				return "", fmt.Errorf("Error pushing %s: %v", tag, err)
+			}
+			d, err := img.Digest()
+			return d.String(), err
+		})
+		if err != nil {
+			return nil, &DockerError{err}
+		}
+		infof("Image pushed: %s@%s", Options.Tag, digest)
+		images[0].Digest = digest
+	}
+	if saving(Options) {
+		err := saveImage(Options, func(w io.Writer) error {
+			return tarball.Write(ref, img, w)
+		})
+		if err != nil {
+			return nil, &DockerError{err}
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The executables can be run in the image, whatever their modes are on
+// the build machine (e.g., 0666 on Windows)
+func TestExecutablesLayerMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidalgo-layers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "app"), []byte("binary"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	context := map[string]interface{}{
+		"certs":       "",
+		"tzdata":      "",
+		"files":       "",
+		"filedest":    "/app",
+		"copies":      []FileCopy{},
+		"executables": []Binary{{Name: "app", Path: "/usr/local/bin/app"}},
+	}
+	layers, err := writeLayers(Options{}, dir, context)
+	if err != nil {
+		t.Fatalf("Writing layers failed: %v", err)
+	}
+	if len(layers) != 1 || filepath.Base(layers[0]) != binLayer {
+		t.Fatalf("Expected just %s, got %v", binLayer, layers)
+	}
+
+	f, err := os.Open(layers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "usr/local/bin/app" {
+			found = true
+			if hdr.Mode != 0755 {
+				t.Errorf("Executable has mode %o, expected 755", hdr.Mode)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Executable is missing from %s", binLayer)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This is the image that the debugging tools are taken from.  The musl
+// build of busybox is statically linked, so it works in any image
+// (including one built from scratch).
+const debugTools = "busybox:musl"
+
+// This is the Dockerfile for the debug variant of an image.  It starts
+// from the image itself (so the layers with the executables are shared)
+// and adds busybox (which provides sh, ps, top, netstat, nslookup, wget,
+// vi, etc.) in /busybox.
+const debugDockerfile = `# The debug variant of %s
+FROM %s AS tools
+
+FROM %s
+COPY --from=tools /bin/busybox /busybox/busybox
+RUN ["/busybox/busybox", "--install", "-s", "/busybox"]
+ENV PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/busybox
+`
+
+// The debugTag function returns the tag for the debug variant of the
+// image with the given tag (e.g., app:1.2 becomes app:1.2-debug and app
+// becomes app:debug).
+func debugTag(tag string) string {
+	// A ':' after the last '/' separates the tag from the name (any
+	// other ':' is part of a registry host name)
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		return tag + "-debug"
+	}
+	return tag + ":debug"
+}
+
+// The debugContext function creates the build context (in a subdirectory
+// of the build directory) for the debug variant of the image with the
+// given tag (which must not be empty).
+func debugContext(dir string, tag string) (buildContext, error) {
+	ddir := filepath.Join(dir, "debug")
+	err := os.MkdirAll(ddir, os.ModePerm)
+	if err != nil {
+		return buildContext{}, fmt.Errorf("Unable to create directory %s: %v", ddir, err)
+	}
+
+	contents := fmt.Sprintf(debugDockerfile, tag, debugTools, tag)
+	err = ioutil.WriteFile(filepath.Join(ddir, "Dockerfile"), []byte(contents), 0644)
+	if err != nil {
+		return buildContext{}, fmt.Errorf("Error writing debug Dockerfile: %v", err)
+	}
+
+	dtag := debugTag(tag)
+	verbosef("Debug variant: %s", dtag)
+	debugf("===== Debug Dockerfile =====\n%s", contents)
+	return buildContext{Dir: ddir, Tag: dtag}, nil
+}
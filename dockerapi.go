@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// The defaultDockerHost function returns where the Docker daemon listens
+// if DOCKER_HOST isn't set.  On Windows, this is a named pipe (which we
+// can't connect to, so the docker command is used instead).
+func defaultDockerHost() string {
+	if runtime.GOOS == "windows" {
+		return "npipe:////./pipe/docker_engine"
+	}
+	return "unix:///var/run/docker.sock"
+}
+
+// An engineClient talks directly to the Docker Engine API (rather than
+// running the docker command).  This lets us report meaningful errors
+// when the daemon can't be reached and capture the ID of the image that
+// was built.
+type engineClient struct {
+	// The DOCKER_HOST the client is connected to
+	host string
+	// The URL that API paths are relative to
+	base   string
+	client *http.Client
+}
+
+// The newEngineClient function creates a client for the Docker daemon
+// at the given DOCKER_HOST.  Only unix://, tcp:// and ssh:// hosts are
+// supported (for anything else the docker command must be used).  For
+// tcp:// hosts, TLS is used if certificates are given in the options or
+// if DOCKER_TLS_VERIFY is set (in which case the certificates are found
+// in DOCKER_CERT_PATH, just like they are by the docker command).
+func newEngineClient(host string, Options Options) (*engineClient, error) {
+	if host == "" {
+		host = defaultDockerHost()
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DOCKER_HOST %s: %v", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		// The host name is ignored, all requests go to the socket
+		sock := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		}
+		return &engineClient{
+			host:   host,
+			base:   "http://docker",
+			client: &http.Client{Transport: transport},
+		}, nil
+	case "ssh":
+		// We run 'docker system dial-stdio' on the remote host (which is
+		// how the docker command does it) and talk to the daemon over
+		// its stdin and stdout.
+		args := []string{}
+		if u.Port() != "" {
+			args = append(args, "-p", u.Port())
+		}
+		dest := u.Hostname()
+		if u.User != nil {
+			dest = u.User.Username() + "@" + dest
+		}
+		args = append(args, dest, "--", "docker", "system", "dial-stdio")
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialSSH(args)
+			},
+		}
+		return &engineClient{
+			host:   host,
+			base:   "http://docker",
+			client: &http.Client{Transport: transport},
+		}, nil
+	case "tcp":
+		if Options.TLSCert != "" || Options.TLSKey != "" || Options.TLSCACert != "" {
+			if Options.TLSCert == "" || Options.TLSKey == "" || Options.TLSCACert == "" {
+				return nil, fmt.Errorf("The --tlscacert, --tlscert and --tlskey options must all be given")
+			}
+			config, err := loadTLS(Options.TLSCert, Options.TLSKey, Options.TLSCACert)
+			if err != nil {
+				return nil, err
+			}
+			return &engineClient{
+				host:   host,
+				base:   "https://" + u.Host,
+				client: &http.Client{Transport: &http.Transport{TLSClientConfig: config}},
+			}, nil
+		}
+		if os.Getenv("DOCKER_TLS_VERIFY") == "" {
+			return &engineClient{
+				host:   host,
+				base:   "http://" + u.Host,
+				client: &http.Client{},
+			}, nil
+		}
+		certs := os.Getenv("DOCKER_CERT_PATH")
+		if certs == "" {
+			home, _ := os.UserHomeDir()
+			certs = filepath.Join(home, ".docker")
+		}
+		config, err := loadTLS(filepath.Join(certs, "cert.pem"), filepath.Join(certs, "key.pem"),
+			filepath.Join(certs, "ca.pem"))
+		if err != nil {
+			return nil, err
+		}
+		return &engineClient{
+			host:   host,
+			base:   "https://" + u.Host,
+			client: &http.Client{Transport: &http.Transport{TLSClientConfig: config}},
+		}, nil
+	default:
+		return nil, fmt.Errorf("The Docker Engine API cannot be used with DOCKER_HOST=%s", host)
+	}
+}
+
+// An sshConn is a connection to a remote Docker daemon that goes through
+// the standard input and output of an ssh command.
+type sshConn struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.WriteCloser
+}
+
+// The dialSSH function runs ssh with the given arguments and returns a
+// connection to the remote command.
+func dialSSH(args []string) (net.Conn, error) {
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	debugf("  Connecting to Docker daemon with '%s'", cmdString(cmd))
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Error running cmd '%s': %v", cmdString(cmd), err)
+	}
+	return &sshConn{cmd: cmd, Reader: stdout, WriteCloser: stdin}, nil
+}
+
+func (c *sshConn) Close() error {
+	c.WriteCloser.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+// The remaining methods are needed to be a net.Conn (deadlines are not
+// supported)
+func (c *sshConn) LocalAddr() net.Addr                { return sshAddr{} }
+func (c *sshConn) RemoteAddr() net.Addr               { return sshAddr{} }
+func (c *sshConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type sshAddr struct{}
+
+func (sshAddr) Network() string { return "ssh" }
+func (sshAddr) String() string  { return "ssh" }
+
+// The ping method checks that the daemon is reachable (so that we can
+// give a clear error message if it isn't).
+func (e *engineClient) ping() error {
+	resp, err := e.client.Get(e.base + "/_ping")
+	if err != nil {
+		return fmt.Errorf("Unable to reach the Docker daemon at %s: %v", e.host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker daemon at %s is not available: %s", e.host, resp.Status)
+	}
+	return nil
+}
+
+// A buildMessage is one of the (JSON) progress messages streamed back by
+// the daemon during a build.
+type buildMessage struct {
+	Stream      string `json:"stream"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux struct {
+		ID string `json:"ID"`
+	} `json:"aux"`
+}
+
+// The build method sends the (gzip'd tar) build context (and any build
+// arguments) to the daemon and streams the output of the build to out.
+// It returns the ID of the image that was built.
+func (e *engineClient) build(body io.Reader, tag string, platform string, bargs map[string]string, out io.Writer) (string, error) {
+	query := url.Values{}
+	if tag != "" {
+		query.Set("t", tag)
+	}
+	if platform != "" {
+		query.Set("platform", platform)
+	}
+	if len(bargs) > 0 {
+		encoded, err := json.Marshal(bargs)
+		if err != nil {
+			return "", err
+		}
+		query.Set("buildargs", string(encoded))
+	}
+
+	req, err := http.NewRequest("POST", e.base+"/build?"+query.Encode(), body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	// Pass along any credentials the user has (so that private base
+	// images can be pulled)
+	auth, err := registryConfig()
+	if err != nil {
+		warnf("Unable to read Docker credentials: %v", err)
+	} else if auth != "" {
+		req.Header.Set("X-Registry-Config", auth)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to reach the Docker daemon at %s: %v", e.host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Docker daemon refused build: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	// Relay the output of the build as it arrives
+	id := ""
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := buildMessage{}
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Error reading output from Docker daemon: %v", err)
+		}
+		if msg.Error != "" {
+			if msg.ErrorDetail.Message != "" {
+				return "", fmt.Errorf("%s", msg.ErrorDetail.Message)
+			}
+			return "", fmt.Errorf("%s", msg.Error)
+		}
+		if msg.Aux.ID != "" {
+			id = msg.Aux.ID
+		}
+		io.WriteString(out, msg.Stream)
+	}
+	return id, nil
+}
+
+// The dockerConfig type is the part of the Docker client configuration
+// file (~/.docker/config.json) that holds registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth string `json:"auth"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// An authConfig holds the credentials for a registry (in the form the
+// Docker Engine API expects them).
+type authConfig struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress"`
+}
+
+// The readDockerConfig function reads the Docker client configuration
+// (which is empty if there isn't one).
+func readDockerConfig() (dockerConfig, error) {
+	config := dockerConfig{}
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return config, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(contents, &config)
+	if err != nil {
+		return config, fmt.Errorf("Invalid Docker configuration: %v", err)
+	}
+	return config, nil
+}
+
+// The registryAuths function reads the credentials stored by 'docker
+// login' (by registry).  Credentials kept in a credential helper are not
+// included (see registryAuth).
+func registryAuths() (map[string]authConfig, error) {
+	auths := map[string]authConfig{}
+	config, err := readDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	for server, entry := range config.Auths {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			continue
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		auths[server] = authConfig{Username: parts[0], Password: parts[1], ServerAddress: server}
+	}
+	return auths, nil
+}
+
+// The registryConfig function encodes all the credentials stored by
+// 'docker login' for the X-Registry-Config header.  It returns an empty
+// string if there are no (usable) credentials.
+func registryConfig() (string, error) {
+	auths, err := registryAuths()
+	if err != nil || len(auths) == 0 {
+		return "", err
+	}
+	encoded, err := json.Marshal(auths)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+// The engineBuild function archives the build directory and builds the
+// image from it (with the given build arguments) using the Docker Engine
+// API.  It returns the ID of the
+// image that was built.
+func engineBuild(engine *engineClient, c buildContext, platform string, bargs map[string]string,
+	record *BuildRecord) (string, error) {
+	err := engine.ping()
+	if err != nil {
+		return "", err
+	}
+
+	// Archive the build directory (just like we do for the docker
+	// command).  Any error archiving it makes the build fail (rather
+	// than using a truncated context).
+	reader, err := contextArchive(c, record)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	out := newBuildProgress()
+	id, err := engine.build(reader, c.Tag, platform, bargs, out)
+	out.finish(err)
+	return id, err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// These are the functions available in the Dockerfile template.  Most
+// of them make sure that values are properly quoted and escaped so that
+// they can't break (or inject instructions into) the generated
+// Dockerfile.
+var dockerfileFuncs = template.FuncMap{
+	"key":     dockerKey,
+	"quote":   dockerQuote,
+	"json":    jsonArray,
+	"default": defaultValue,
+	"join":    joinValues,
+}
+
+// The dockerKey function checks that a string can be used as the key
+// of an ENV or LABEL instruction.  Keys are not quoted so they can't
+// contain whitespace, quotes, escapes, variable references or '='.
+func dockerKey(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("Empty key in Dockerfile")
+	}
+	if strings.ContainsAny(key, " \t\r\n=\"'\\$") {
+		return "", fmt.Errorf("Invalid key %q in Dockerfile", key)
+	}
+	return key, nil
+}
+
+// The dockerQuote function renders a value as a double quoted string
+// suitable for ENV and LABEL instructions.  Backslashes and quotes are
+// escaped, as are dollar signs (so Docker doesn't perform variable
+// substitution on them).  Docker has no way to represent a newline in
+// these values, so values containing newlines are rejected rather than
+// silently changed.
+func dockerQuote(value string) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("Value %q contains a newline, which cannot be represented in a Dockerfile", value)
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + r.Replace(value) + `"`, nil
+}
+
+// The defaultValue function returns the given value unless it is empty
+// (e.g., an empty string or list, or a missing git branch), in which case
+// it returns the default.  The value comes last so it can be piped in,
+// e.g., {{.git.branch | default "main"}}.
+func defaultValue(def interface{}, value interface{}) interface{} {
+	if value == nil {
+		return def
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return def
+		}
+	default:
+		if v.IsZero() {
+			return def
+		}
+	}
+	return value
+}
+
+// The joinValues function joins a list of strings (or a single string)
+// with the given separator.  The list comes last so it can be piped
+// in, e.g., {{.binaries | join ","}}.
+func joinValues(sep string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []string:
+		return strings.Join(v, sep), nil
+	default:
+		return "", fmt.Errorf("Cannot join %v", value)
+	}
+}
+
+// The jsonArray function renders a list of strings (or a single string)
+// in the JSON (exec) form used by the CMD, ENTRYPOINT and VOLUME
+// Dockerfile instructions.  In this form, Docker doesn't perform any
+// variable substitution and the JSON escaping takes care of quotes,
+// backslashes and newlines.
+func jsonArray(value interface{}) (string, error) {
+	elems := []string{}
+	switch v := value.(type) {
+	case string:
+		elems = append(elems, v)
+	case []string:
+		elems = v
+	default:
+		return "", fmt.Errorf("Cannot render %v as a JSON array", value)
+	}
+
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	// Docker doesn't need HTML safe output and it makes the
+	// Dockerfile harder to read
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(elems)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
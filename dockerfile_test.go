@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The adversarial values the generated Dockerfile must survive
+func TestDockerQuote(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+		fails bool
+	}{
+		{value: "plain", want: `"plain"`},
+		{value: "", want: `""`},
+		{value: `say "hi"`, want: `"say \"hi\""`},
+		{value: `C:\path\`, want: `"C:\\path\\"`},
+		{value: "$HOME and ${PATH}", want: `"\$HOME and \${PATH}"`},
+		{value: `\"$`, want: `"\\\"\$"`},
+		{value: "first\nsecond", fails: true},
+		{value: "first\r\nsecond", fails: true},
+		{value: "ends with\r", fails: true},
+	}
+	for _, c := range cases {
+		got, err := dockerQuote(c.value)
+		if c.fails {
+			if err == nil {
+				t.Errorf("dockerQuote(%q) = %s, expected an error", c.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("dockerQuote(%q) failed: %v", c.value, err)
+		} else if got != c.want {
+			t.Errorf("dockerQuote(%q) = %s, expected %s", c.value, got, c.want)
+		}
+	}
+}
+
+func TestDockerKey(t *testing.T) {
+	cases := []struct {
+		key   string
+		fails bool
+	}{
+		{key: "PORT"},
+		{key: "org.opencontainers.image.version"},
+		{key: "", fails: true},
+		{key: "A B", fails: true},
+		{key: "A=B", fails: true},
+		{key: `A"`, fails: true},
+		{key: "A'", fails: true},
+		{key: `A\`, fails: true},
+		{key: "$A", fails: true},
+		{key: "A\nRUN rm -rf /", fails: true},
+	}
+	for _, c := range cases {
+		_, err := dockerKey(c.key)
+		if c.fails && err == nil {
+			t.Errorf("dockerKey(%q) should have failed", c.key)
+		}
+		if !c.fails && err != nil {
+			t.Errorf("dockerKey(%q) failed: %v", c.key, err)
+		}
+	}
+}
+
+// The renderDockerfile function renders the built in template with the
+// given environment variables, labels and arguments.
+func renderDockerfile(t *testing.T, env map[string]string, labels map[string]string, args []string) (string, error) {
+	return renderConfig(t, env, labels, Config{Args: args})
+}
+
+// The renderConfig function renders the built in template for the given
+// configuration (along with the environment variables and labels).
+func renderConfig(t *testing.T, env map[string]string, labels map[string]string, config Config) (string, error) {
+	tmpl, err := loadTemplate(Options{})
+	if err != nil {
+		t.Fatalf("Unable to load template: %v", err)
+	}
+	bin := Binary{Package: "example.com/app", Name: "app", Path: "/usr/local/bin/app"}
+	context := templateContext("example.com/app", Stamp{}, "scratch", env, labels, []Binary{bin}, bin, config)
+	buf := bytes.Buffer{}
+	err = tmpl.Execute(&buf, context)
+	return buf.String(), err
+}
+
+func TestRenderedInstructions(t *testing.T) {
+	cases := []struct {
+		name   string
+		env    map[string]string
+		labels map[string]string
+		args   []string
+		want   []string
+		fails  bool
+	}{
+		{
+			name: "quotes",
+			env:  map[string]string{"GREETING": `say "hi"`},
+			want: []string{`ENV GREETING="say \"hi\""`},
+		},
+		{
+			name: "dollars",
+			env:  map[string]string{"SECRET": "$HOME"},
+			want: []string{`ENV SECRET="\$HOME"`},
+		},
+		{
+			name:   "backslashes",
+			labels: map[string]string{"path": `C:\app`},
+			want:   []string{`LABEL path="C:\\app"`},
+		},
+		{
+			name:  "newline in env",
+			env:   map[string]string{"BAD": "x\nRUN rm -rf /"},
+			fails: true,
+		},
+		{
+			name:   "newline in label",
+			labels: map[string]string{"bad": "x\nRUN rm -rf /"},
+			fails:  true,
+		},
+		{
+			name:  "injected key",
+			env:   map[string]string{"A=1\nRUN": "x"},
+			fails: true,
+		},
+		{
+			name: "arguments",
+			args: []string{`-msg="hi"`, "$HOME", `a\b`, "two\nlines"},
+			want: []string{`CMD ["/usr/local/bin/app","-msg=\"hi\"","$HOME","a\\b","two\nlines"]`},
+		},
+		{
+			name: "html",
+			args: []string{"<a & b>"},
+			want: []string{`CMD ["/usr/local/bin/app","<a & b>"]`},
+		},
+	}
+	for _, c := range cases {
+		got, err := renderDockerfile(t, c.env, c.labels, c.args)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s: rendering should have failed, got:\n%s", c.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: rendering failed: %v", c.name, err)
+			continue
+		}
+		for _, line := range c.want {
+			if !strings.Contains(got, "\n"+line+"\n") {
+				t.Errorf("%s: expected line %s in:\n%s", c.name, line, got)
+			}
+		}
+		// Nothing can sneak an instruction of its own in
+		if strings.Contains(got, "\nRUN") {
+			t.Errorf("%s: unexpected RUN instruction in:\n%s", c.name, got)
+		}
+	}
+}
+
+// The Engine API builds with the classic builder, which doesn't
+// understand COPY --chmod, so the modes of files are set in the build
+// context instead (and only the owner is in the Dockerfile)
+func TestRenderedCopies(t *testing.T) {
+	config := Config{Files: []File{
+		{Src: "config/app.cfg", Dest: "/etc/app/app.cfg", Mode: "0600", Owner: "app:app"},
+		{Src: "conf/**/*.yml", Dest: "/etc/app/conf/", Mode: "0644"},
+		{Src: "static"},
+	}}
+	got, err := renderConfig(t, nil, nil, config)
+	if err != nil {
+		t.Fatalf("Rendering failed: %v", err)
+	}
+	want := []string{
+		`ADD files /app`,
+		`COPY --chown=app:app ["files-1/app.cfg","/etc/app/app.cfg"]`,
+		`COPY ["files-2/","/etc/app/conf/"]`,
+	}
+	for _, line := range want {
+		if !strings.Contains(got, "\n"+line+"\n") {
+			t.Errorf("Expected line %s in:\n%s", line, got)
+		}
+	}
+	if strings.Contains(got, "--chmod") {
+		t.Errorf("The classic builder doesn't support --chmod:\n%s", got)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// A dockerEnvironment describes a local Docker environment that we know
+// how to find (by looking for its socket).
+type dockerEnvironment struct {
+	// A human readable name for the environment
+	Name string
+	// The path of the socket, relative to the home directory (unless
+	// it is absolute)
+	Socket string
+	// A hint about how to run amd64 images on Apple silicon
+	Hint string
+}
+
+// These are the common OSX Docker environments, in the order we look
+// for them.
+var macEnvironments = []dockerEnvironment{
+	{
+		Name:   "Docker Desktop",
+		Socket: ".docker/run/docker.sock",
+		Hint:   "enable 'Use Rosetta for x86/amd64 emulation' in the Docker Desktop settings",
+	},
+	{
+		Name:   "Colima",
+		Socket: ".colima/default/docker.sock",
+		Hint:   "start Colima with 'colima start --arch x86_64' (or '--vm-type vz --vz-rosetta')",
+	},
+	{
+		Name:   "Rancher Desktop",
+		Socket: ".rd/docker.sock",
+		Hint:   "select the Rosetta emulation option in the Rancher Desktop preferences",
+	},
+	{
+		Name:   "Docker Desktop",
+		Socket: "/var/run/docker.sock",
+		Hint:   "enable 'Use Rosetta for x86/amd64 emulation' in the Docker Desktop settings",
+	},
+}
+
+// The detectDockerEnvironment function looks for the socket of a local
+// Docker environment on OSX.  It returns nil if we aren't on OSX or
+// none of the known sockets exist.
+func detectDockerEnvironment() *dockerEnvironment {
+	if runtime.GOOS != "darwin" {
+		return nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	for _, env := range macEnvironments {
+		sock := env.Socket
+		if !filepath.IsAbs(sock) {
+			sock = filepath.Join(home, sock)
+		}
+		if _, err := os.Stat(sock); err == nil {
+			found := env
+			found.Socket = sock
+			return &found
+		}
+	}
+	return nil
+}
+
+// The platformMismatch function returns true if the images we build
+// will not run natively on this machine (i.e., we are on Apple silicon
+// building amd64 images, so the Docker VM will have to emulate them).
+func platformMismatch(arch string) bool {
+	return runtime.GOOS == "darwin" && runtime.GOARCH != arch
+}
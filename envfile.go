@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This is the name of the file of environment variable values that is
+// used (if it exists in the package directory) when no --env-file is
+// given
+const defaultEnvFile = ".env"
+
+// The readEnvFile function reads a file of environment variable values
+// (in the format used by docker compose and friends).  Each line is
+// NAME=value (optionally preceded by 'export'), where the value may be
+// quoted.  Blank lines and lines starting with '#' are ignored.
+func readEnvFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read environment file: %v", err)
+	}
+	defer f.Close()
+
+	ret := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !buildArgName.MatchString(key) {
+			return nil, fmt.Errorf("Invalid line %d in environment file %s (must be NAME=value)", n, name)
+		}
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		ret[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading environment file %s: %v", name, err)
+	}
+	return ret, nil
+}
+
+// The loadEnvFiles function reads the environment variable values in the
+// files given with --env-file (in order, so later files take precedence)
+// or, if none are given, in the .env file in the package directory (if
+// there is one).
+func loadEnvFiles(Options Options, apdir string) (map[string]string, error) {
+	files := Options.EnvFile
+	if len(files) == 0 {
+		file := filepath.Join(apdir, defaultEnvFile)
+		if _, err := os.Stat(file); err != nil {
+			return nil, nil
+		}
+		files = []string{file}
+	}
+	ret := map[string]string{}
+	for _, file := range files {
+		verbosef("Environment file: %s", file)
+		values, err := readEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range values {
+			ret[key] = value
+		}
+	}
+	return ret, nil
+}
+
+// The parseEnvOverrides function parses the environment variable values
+// given with -e (each of which is NAME=value).
+func parseEnvOverrides(list []string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, e := range list {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || !buildArgName.MatchString(parts[0]) {
+			return nil, fmt.Errorf("Invalid environment variable %q (must be NAME=value)", e)
+		}
+		ret[parts[0]] = parts[1]
+	}
+	return ret, nil
+}
+
+// The getenv method returns the value of an environment variable listed
+// in the configuration.  Values given with -e take precedence over the
+// (host) environment, which takes precedence over the values in
+// environment files.
+func (c Config) getenv(name string) string {
+	if value, given := c.envOverrides[name]; given {
+		return value
+	}
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return c.envValues[name]
+}
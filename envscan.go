@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"sort"
+	"strings"
+)
+
+// The scanEnv function looks through the source of the package in apdir
+// (the files that are built for the platform) for the environment
+// variables it reads (i.e., literal names passed to os.Getenv and
+// os.LookupEnv).  It returns where each of them is first read, by name.
+func scanEnv(Options Options, platform Platform, apdir string) (map[string]string, error) {
+	ret := map[string]string{}
+	err := scanSource(Options, platform, apdir, func(f *ast.File, names map[string]string, where func(ast.Node) string) {
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) != 1 {
+				return true
+			}
+			pname, fname := selectorName(call.Fun, names)
+			if pname != "os" || (fname != "Getenv" && fname != "LookupEnv") {
+				return true
+			}
+			if name, ok := stringLit(call.Args[0]); ok {
+				if _, exists := ret[name]; !exists {
+					ret[name] = where(call)
+				}
+			}
+			return true
+		})
+	})
+	return ret, err
+}
+
+// The detectEnv function compares the environment variables the package
+// reads with the ones baked into the image and reports those that are
+// missing from the configuration (and those in the configuration that
+// the package doesn't read, although a library it uses may).  With
+// --strict-env, any mismatch is an error.
+func detectEnv(Options Options, platform Platform, apdir string, config Config) error {
+	read, err := scanEnv(Options, platform, apdir)
+	if err != nil {
+		// Any problems with the source are reported by the build
+		debugf("Unable to scan the source for environment variables: %v", err)
+		return nil
+	}
+	listed := map[string]bool{}
+	for _, e := range config.Env {
+		listed[e] = true
+	}
+
+	mismatched := []string{}
+	for _, name := range sortedKeys(read) {
+		if !listed[name] {
+			infof("The package reads environment variable %s (%s), which isn't in the configuration", name, read[name])
+			mismatched = append(mismatched, name)
+		}
+	}
+	for _, name := range config.Env {
+		if _, exists := read[name]; !exists {
+			infof("Environment variable %s is in the configuration, but the package doesn't read it", name)
+			mismatched = append(mismatched, name)
+		}
+	}
+
+	if Options.StrictEnv && len(mismatched) > 0 {
+		sort.Strings(mismatched)
+		return fmt.Errorf("The environment variables in the configuration don't match the source: %s",
+			strings.Join(mismatched, ", "))
+	}
+	return nil
+}
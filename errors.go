@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// These are the exit statuses of hidalgo.  They are part of its
+// interface (scripts and CI systems depend on them) so they must not
+// change.
+const (
+	// The image (or images) were built successfully
+	ExitOK = 0
+	// Invalid command line options or package directories
+	ExitUsage = 1
+	// Invalid configuration (hidalgo.cfg, etc.) or target platform
+	ExitConfig = 2
+	// The Go build (or verification) or the Dockerfile generation failed
+	ExitBuild = 3
+	// The Docker (or build agent) build failed
+	ExitDocker = 4
+)
+
+// A UsageError is a problem with the command line options or the
+// package directories given on the command line.
+type UsageError struct {
+	Err error
+}
+
+func (e *UsageError) Error() string { return e.Err.Error() }
+func (e *UsageError) Unwrap() error { return e.Err }
+
+// A ConfigError is a problem with the configuration of a package.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// A BuildError is a failure to build (or verify) the Go executables or
+// to generate the Dockerfile.
+type BuildError struct {
+	Err error
+}
+
+func (e *BuildError) Error() string { return e.Err.Error() }
+func (e *BuildError) Unwrap() error { return e.Err }
+
+// A DockerError is a failure to build the image (either locally or on a
+// build agent).
+type DockerError struct {
+	Err error
+}
+
+func (e *DockerError) Error() string { return e.Err.Error() }
+func (e *DockerError) Unwrap() error { return e.Err }
+
+// The errorKind function returns the kind of error (as reported in JSON
+// error objects) and the corresponding exit status.  Errors that aren't
+// one of our types are treated as build errors.
+func errorKind(err error) (string, int) {
+	switch err.(type) {
+	case *UsageError:
+		return "usage", ExitUsage
+	case *ConfigError:
+		return "config", ExitConfig
+	case *DockerError:
+		return "docker", ExitDocker
+	default:
+		return "build", ExitBuild
+	}
+}
+
+// JSONError is the structured form of an error that is written (to
+// os.Stdout) when --json-errors is given.
+type JSONError struct {
+	// One of usage, config, build or docker
+	Kind string `json:"kind"`
+	// The exit status of hidalgo
+	Status int `json:"status"`
+	// The package directory being built (if any)
+	Package string `json:"package,omitempty"`
+	// A description of the error
+	Message string `json:"message"`
+}
+
+// The report function reports an error that occurred while building the
+// package in pdir (which may be empty if the error isn't specific to a
+// package) and returns the exit status for it.
+func report(Options Options, pdir string, err error) int {
+	kind, status := errorKind(err)
+	errorf("Error: %v", err)
+
+	// Each error is written as a single line so that the output from
+	// several packages can be read as a stream of JSON objects.  (With
+	// --output json, the error is part of the record of the build.)
+	if Options.JSONErrors && !jsonOutput(Options) {
+		json.NewEncoder(os.Stdout).Encode(JSONError{
+			Kind:    kind,
+			Status:  status,
+			Package: pdir,
+			Message: err.Error(),
+		})
+	}
+	return status
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This is the directory (in the build directory) that the files given
+// with the file directive are copied to
+const filesDir = "files"
+
+// This is where the files given with the file directive are added in the
+// image (unless the configuration gives another place with filedest)
+const defaultFileDest = "/app"
+
+// The fileDest function returns where the files given with the file
+// directive are added in the image.
+func fileDest(config Config) string {
+	if config.FileDest != "" {
+		return config.FileDest
+	}
+	return defaultFileDest
+}
+
+// The hidden function determines whether a file (or directory) name is
+// hidden (e.g., .git or .env).
+func hidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
+
+// The anyHidden function determines whether any of the names is hidden.
+func anyHidden(names []string) bool {
+	for _, name := range names {
+		if hidden(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// The matchSegments function matches the segments of a (slash separated)
+// path against the segments of a pattern.  Each segment is matched with
+// path.Match, except "**", which matches any number of segments.  Like a
+// shell, wildcards don't match hidden names.
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		if matchSegments(pattern[1:], name) {
+			return true
+		}
+		return len(name) > 0 && !hidden(name[0]) && matchSegments(pattern, name[1:])
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if hidden(name[0]) && !strings.HasPrefix(pattern[0], ".") {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchSegments(pattern[1:], name[1:])
+}
+
+// The matchFiles function returns the (slash separated) paths, relative
+// to the package directory apdir, of the files given by a pattern in the
+// file directive.  The pattern is a file, a directory (which gives all
+// the files in it) or a glob pattern (where "**" matches any number of
+// directories).
+func matchFiles(apdir string, pattern string) ([]string, error) {
+	clean := path.Clean(filepath.ToSlash(pattern))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return nil, fmt.Errorf("File %s must be within the package directory", pattern)
+	}
+	segments := strings.Split(clean, "/")
+	if clean == "." {
+		segments = []string{"**"}
+	}
+	for _, s := range segments {
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("Invalid file pattern %s: %v", pattern, err)
+		}
+	}
+
+	ret := []string{}
+	err := filepath.Walk(apdir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(apdir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// The file matches if it (or a directory it is in) matches, but
+		// hidden files in a directory are only added if they are given
+		// explicitly
+		names := strings.Split(rel, "/")
+		for i := len(names); i > 0; i-- {
+			if matchSegments(segments, names[:i]) {
+				if !anyHidden(names[i:]) {
+					ret = append(ret, rel)
+				}
+				break
+			}
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// The collectFiles function returns the (slash separated) paths,
+// relative to the package directory apdir, of all the files given by the
+// patterns (in order, without duplicates).  A pattern that doesn't match
+// any files is an error.
+func collectFiles(apdir string, patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	ret := []string{}
+	for _, pattern := range patterns {
+		files, err := matchFiles(apdir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("File %s does not match any files", pattern)
+		}
+		for _, f := range files {
+			if !seen[f] {
+				seen[f] = true
+				ret = append(ret, f)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// The plainPatterns function returns the patterns of the files that are
+// simply added under filedest (i.e., that don't have a destination, mode
+// or owner of their own).
+func plainPatterns(files []File) []string {
+	ret := []string{}
+	for _, f := range files {
+		if f.plain() {
+			ret = append(ret, f.Src)
+		}
+	}
+	return ret
+}
+
+// A stagedFiles is a set of files (relative to the package directory)
+// that is copied to a directory in the build directory, relative to the
+// directory base, or a file that is downloaded to it (along with the
+// file directive it came from, for anything but the files added under
+// filedest).
+type stagedFiles struct {
+	dir   string
+	base  string
+	files []string
+	file  File
+}
+
+// The planFiles function determines which files are copied to which
+// directories in the build directory (before the time consuming build,
+// so a mistake in a pattern is found quickly).  The files that are added
+// under filedest are copied to the files directory and those with a
+// destination, mode or owner to a directory of their own (see
+// fileCopies).
+func planFiles(apdir string, files []File) ([]stagedFiles, error) {
+	ret := []stagedFiles{}
+	plain, err := collectFiles(apdir, plainPatterns(files))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > 0 {
+		ret = append(ret, stagedFiles{dir: filesDir, base: ".", files: plain})
+	}
+	for i, f := range specialFiles(files) {
+		if f.remote() {
+			ret = append(ret, stagedFiles{dir: specialDir(i), file: f})
+			continue
+		}
+		matched, err := collectFiles(apdir, []string{f.Src})
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, stagedFiles{dir: specialDir(i), base: f.base(), files: matched, file: f})
+	}
+	return ret, nil
+}
+
+// The dest method returns where (relative to the build directory) the
+// file f (relative to the package directory) is staged.
+func (s stagedFiles) dest(f string) string {
+	rel := f
+	if s.base != "." {
+		rel = strings.TrimPrefix(f, s.base+"/")
+	}
+	return path.Join(s.dir, rel)
+}
+
+// The fileModes function returns the modes (given in the configuration)
+// of the planned files, by where they are staged (relative to the build
+// directory).  The modes are set in the build context (see addFile),
+// where every builder keeps them, rather than in the Dockerfile, where
+// only BuildKit understands them.
+func fileModes(staged []stagedFiles) (map[string]os.FileMode, error) {
+	ret := map[string]os.FileMode{}
+	for _, s := range staged {
+		if s.file.Mode == "" {
+			continue
+		}
+		if s.file.remote() {
+			name, err := remoteName(s.file.Src)
+			if err != nil {
+				return nil, err
+			}
+			ret[path.Join(s.dir, name)] = s.file.perm()
+			continue
+		}
+		for _, f := range s.files {
+			ret[s.dest(f)] = s.file.perm()
+		}
+	}
+	return ret, nil
+}
+
+// The stageFiles function copies the planned files to the build
+// directory, preserving their paths (relative to their base), and
+// downloads the remote ones.  Files that are given a mode get it in the
+// build directory as well.  It returns the paths (relative to the build
+// directory) of everything it created.
+func stageFiles(apdir string, dir string, staged []stagedFiles) ([]string, error) {
+	created := []string{}
+	for _, s := range staged {
+		created = append(created, s.dir)
+		if s.file.remote() {
+			name, err := remoteName(s.file.Src)
+			if err != nil {
+				return nil, err
+			}
+			err = os.MkdirAll(filepath.Join(dir, s.dir), 0755)
+			if err != nil {
+				return nil, err
+			}
+			err = downloadFile(s.file.Src, filepath.Join(dir, s.dir, name), s.file.Sha256)
+			if err != nil {
+				return nil, err
+			}
+			err = setPerm(filepath.Join(dir, s.dir, name), s.file)
+			if err != nil {
+				return nil, err
+			}
+			created = append(created, path.Join(s.dir, name))
+			continue
+		}
+		dirs := map[string]bool{}
+		for _, f := range s.files {
+			dst := s.dest(f)
+			for d := path.Dir(dst); d != s.dir && !dirs[d]; d = path.Dir(d) {
+				dirs[d] = true
+				created = append(created, d)
+			}
+			err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(path.Dir(dst))), 0755)
+			if err != nil {
+				return nil, err
+			}
+			err = copyFile(filepath.Join(apdir, filepath.FromSlash(f)), filepath.Join(dir, filepath.FromSlash(dst)))
+			if err != nil {
+				return nil, err
+			}
+			err = setPerm(filepath.Join(dir, filepath.FromSlash(dst)), s.file)
+			if err != nil {
+				return nil, err
+			}
+			created = append(created, dst)
+		}
+	}
+	return created, nil
+}
+
+// The setPerm function gives a file that was staged (in the build
+// directory) the mode given for it in the configuration (if any).
+func setPerm(name string, f File) error {
+	if f.Mode == "" {
+		return nil
+	}
+	return os.Chmod(name, f.perm())
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// The modes of files are set in the build directory (so they are in the
+// build context, whichever builder is used)
+func TestStageFilesSetsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits")
+	}
+	apdir, err := ioutil.TempDir("", "hidalgo-pkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(apdir)
+	dir, err := ioutil.TempDir("", "hidalgo-build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"config/app.cfg", "static/index.html"} {
+		p := filepath.Join(apdir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := []File{
+		{Src: "config/app.cfg", Dest: "/etc/app/app.cfg", Mode: "0600", Owner: "app"},
+		{Src: "static"},
+	}
+	staged, err := planFiles(apdir, files)
+	if err != nil {
+		t.Fatalf("Planning files failed: %v", err)
+	}
+	_, err = stageFiles(apdir, dir, staged)
+	if err != nil {
+		t.Fatalf("Staging files failed: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		mode os.FileMode
+	}{
+		{"files-1/app.cfg", 0600},
+		{"files/static/index.html", 0644},
+	}
+	for _, c := range cases {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(c.name)))
+		if err != nil {
+			t.Errorf("%s wasn't staged: %v", c.name, err)
+			continue
+		}
+		if info.Mode().Perm() != c.mode {
+			t.Errorf("%s has mode %o, expected %o", c.name, info.Mode().Perm(), c.mode)
+		}
+	}
+}
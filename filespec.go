@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A File is given with the file directive.  It is a file, directory or
+// glob pattern (relative to the package directory), or the URL of a file
+// to download, and, optionally, where to add it in the image and with
+// what permissions and owner.
+type File struct {
+	// The file, directory, glob pattern or URL
+	Src string `yaml:"src" json:"src"`
+	// Where it is added in the image (a directory if it ends with '/')
+	Dest string `yaml:"dest,omitempty" json:"dest,omitempty"`
+	// The permissions (in octal, e.g., 0600)
+	Mode string `yaml:"mode,omitempty" json:"mode,omitempty"`
+	// The owner (user[:group], by name or ID)
+	Owner string `yaml:"owner,omitempty" json:"owner,omitempty"`
+	// The SHA-256 checksum (of a file that is downloaded)
+	Sha256 string `yaml:"sha256,omitempty" json:"sha256,omitempty"`
+}
+
+// These match the permissions and owners we pass to COPY
+var (
+	fileMode  = regexp.MustCompile(`^0?[0-7]{3}$`)
+	fileOwner = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`)
+)
+
+// fileFields is used to unmarshal a file given with its fields (rather
+// than just a pattern)
+type fileFields File
+
+// The UnmarshalYAML method allows files to be given as either a pattern
+// or with their fields.
+func (f *File) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	s := ""
+	if err := unmarshal(&s); err == nil {
+		*f = File{Src: s}
+		return nil
+	}
+	fields := fileFields{}
+	err := unmarshal(&fields)
+	if err != nil {
+		return err
+	}
+	*f = File(fields)
+	return nil
+}
+
+// The UnmarshalJSON method allows files to be given as either a pattern
+// or with their fields.
+func (f *File) UnmarshalJSON(data []byte) error {
+	s := ""
+	if err := json.Unmarshal(data, &s); err == nil {
+		*f = File{Src: s}
+		return nil
+	}
+	fields := fileFields{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	*f = File(fields)
+	return nil
+}
+
+// The validate method checks the destination, permissions and owner
+// (which are written to the Dockerfile).
+func (f File) validate() error {
+	if f.Src == "" {
+		return fmt.Errorf("Empty file pattern")
+	}
+	if f.Dest != "" && (!path.IsAbs(f.Dest) || strings.ContainsAny(f.Dest, "\r\n")) {
+		return fmt.Errorf("Destination of file %s must be an absolute path: %s", f.Src, f.Dest)
+	}
+	if f.Mode != "" && !fileMode.MatchString(f.Mode) {
+		return fmt.Errorf("Invalid mode for file %s: %s (must be octal, e.g., 0600)", f.Src, f.Mode)
+	}
+	if f.Owner != "" && !fileOwner.MatchString(f.Owner) {
+		return fmt.Errorf("Invalid owner for file %s: %s (must be user[:group])", f.Src, f.Owner)
+	}
+	if f.Sha256 != "" && !f.remote() {
+		return fmt.Errorf("File %s isn't downloaded, so it can't have a sha256 checksum", f.Src)
+	}
+	if f.Sha256 != "" && !fileSum.MatchString(f.Sha256) {
+		return fmt.Errorf("Invalid sha256 checksum for file %s: %s", f.Src, f.Sha256)
+	}
+	if f.remote() {
+		if _, err := remoteName(f.Src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The plain method determines whether the file is simply added under
+// filedest (rather than having a destination, mode or owner of its own,
+// or being downloaded).
+func (f File) plain() bool {
+	return f.Dest == "" && f.Mode == "" && f.Owner == "" && !f.remote()
+}
+
+// The perm method returns the permissions given for the file (which
+// validate has checked are octal), or 0 if none were given.
+func (f File) perm() os.FileMode {
+	m, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(m)
+}
+
+// The static method returns the leading part of the (cleaned) pattern
+// that doesn't contain any wildcards and whether that is the whole
+// pattern.
+func (f File) static() (string, bool) {
+	segments := strings.Split(path.Clean(filepath.ToSlash(f.Src)), "/")
+	for i, s := range segments {
+		if strings.ContainsAny(s, `*?[\`) {
+			return path.Join(segments[:i]...), false
+		}
+	}
+	return path.Join(segments...), true
+}
+
+// The base method returns the directory (relative to the package
+// directory) that the files are added relative to.  For a file (or
+// directory), this is the directory it is in and, for a pattern, the
+// part of it before the first wildcard.
+func (f File) base() string {
+	prefix, whole := f.static()
+	if whole {
+		return path.Dir(prefix)
+	}
+	if prefix == "" {
+		return "."
+	}
+	return prefix
+}
+
+// The specialFiles function returns the files that have a destination,
+// mode or owner of their own, or are downloaded (and so are added by
+// their own COPY instruction).
+func specialFiles(files []File) []File {
+	ret := []File{}
+	for _, f := range files {
+		if !f.plain() {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// The specialDir function returns the directory (in the build directory)
+// that the i'th file with a destination, mode or owner is copied to.
+func specialDir(i int) string {
+	return fmt.Sprintf("%s-%d", filesDir, i+1)
+}
+
+// A FileCopy is a COPY instruction (in the Dockerfile) for a file with a
+// destination, mode or owner of its own.
+type FileCopy struct {
+	// The source (in the build directory) and destination (in the image)
+	Paths []string
+	// The permissions (or "").  The built in template leaves them out,
+	// since they are set in the build context (see fileModes), but a
+	// template for BuildKit can give them with --chmod as well.
+	Mode string
+	// The owner (or "")
+	Owner string
+}
+
+// The fileCopies function returns the COPY instructions for the files in
+// the configuration that have a destination, mode or owner of their own.
+// A file (or directory) is copied to its destination, and the files
+// matching a pattern are copied to a directory (with their paths
+// relative to the part of the pattern before the first wildcard).
+// Without a destination, they are added under filedest (just like the
+// other files).  A file that is downloaded is handled like a file in the
+// package directory (with the name in its URL).
+func fileCopies(config Config) []FileCopy {
+	ret := []FileCopy{}
+	for i, f := range specialFiles(config.Files) {
+		prefix, whole := f.static()
+		if f.remote() {
+			prefix, _ = remoteName(f.Src)
+			whole = true
+		}
+		src := specialDir(i)
+		dest := f.Dest
+		if whole {
+			src = path.Join(src, path.Base(prefix))
+			if dest == "" {
+				dest = path.Join(fileDest(config), prefix)
+			}
+		} else {
+			src += "/"
+			if dest == "" {
+				dest = path.Join(fileDest(config), prefix)
+			}
+			if !strings.HasSuffix(dest, "/") {
+				dest += "/"
+			}
+		}
+		ret = append(ret, FileCopy{Paths: []string{src, dest}, Mode: f.Mode, Owner: f.Owner})
+	}
+	return ret
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Fingerprint identifies all the inputs to a build.  If two machines
+// compute the same fingerprint, they should produce identical results.
+type Fingerprint struct {
+	// Hash of the files in the package directory
+	Source string
+	// Hash of the (parsed) configuration
+	Config string
+	// Hash of the command line options that affect the result
+	Flags string
+	// Hash of the values of the environment variables baked into the image
+	Env string
+	// The Go toolchain (i.e., the output of 'go version') and the flags
+	// it is always run with (from GOFLAGS or 'go env -w')
+	Toolchain string
+	GoFlags   string
+	// The base image
+	Base string
+	// Hash of the Dockerfile template
+	Template string
+}
+
+// The hashValue function returns the SHA-256 hash of the JSON
+// representation of a value.
+func hashValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		// This should not happen (we only hash plain data)
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// The hashTree function computes a hash of all the files in a directory
+// (and its subdirectories).  Both the relative path and the contents of
+// each file contribute to the hash.  Hidden files and directories (e.g.,
+// .git) are skipped, as are the files skip returns true for (e.g., the
+// report of the previous build, which shouldn't change the fingerprint
+// of the next one).
+func hashTree(dir string, skip func(p string) bool) (string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && !skip(p) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Make sure the order is the same on every machine
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, p := range files {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00", filepath.ToSlash(rel))
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// The goVersion function returns the version of the Go toolchain
+func goVersion() string {
+	out, err := exec.Command("go", "version").Output()
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// The newFingerprint function computes the fingerprint of a build.
+func newFingerprint(apdir string, config Config, Options Options, env map[string]string, from string) (Fingerprint, error) {
+	source, err := hashTree(apdir, func(p string) bool { return isReport(Options, apdir, p) })
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	text, err := templateText(Options)
+	if err != nil {
+		return Fingerprint{}, err
+	}
+
+	// Options that only affect how hidalgo runs (and not what it
+	// builds) are not part of the fingerprint
+	Options.Verbose = nil
+	Options.Quiet = false
+	Options.Keep = false
+	Options.Watch = false
+	Options.Jobs = 0
+	Options.Build = ""
+	Options.Output = ""
+	Options.Report = ""
+	Options.Timings = false
+	Options.CPUProfile = ""
+	Options.RegistryUser = ""
+	Options.PushRetries = 0
+	Options.BuildRetries = 0
+	Options.RetryBackoff = 0
+
+	return Fingerprint{
+		Source:    source,
+		Config:    hashValue(config),
+		Flags:     hashValue(Options),
+		Env:       hashValue(env),
+		Toolchain: goVersion(),
+		GoFlags:   goEnv("GOFLAGS"),
+		Base:      from,
+		Template:  hashValue(text),
+	}, nil
+}
+
+// The String method returns a (short) combined hash of all the inputs.
+func (f Fingerprint) String() string {
+	return hashValue(f)[:16]
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os/exec"
+)
+
+// The generate function runs 'go generate' on the package (and all the
+// packages below it) if asked to, so code and assets that are generated
+// (e.g., with stringer or protoc) are up to date before we verify and
+// compile the package.  Like the verification steps, it is run natively.
+func generate(Options Options, config Config, name string, apdir string) error {
+	if !Options.Generate && !config.Generate {
+		return nil
+	}
+	return check("go generate", exec.Command("go", "generate", name+"/..."), apdir)
+}
+
+// The generates function determines whether building the package in
+// pdir runs 'go generate'.  If it does, the generated files change with
+// every build, so watch mode has to take that into account.
+func generates(Options Options, pdir string) bool {
+	if Options.Generate {
+		return true
+	}
+	apdir, _, err := packageName(pdir)
+	if err != nil {
+		return false
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return false
+	}
+	return config.Generate
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// The Go environment (as reported by 'go env -json'), which is only
+// queried once
+var (
+	goEnvOnce   sync.Once
+	goEnvValues map[string]string
+)
+
+// The goEnv function returns the value of a Go environment variable as
+// the go command sees it, which includes its defaults (e.g., GOPATH is
+// $HOME/go if it isn't set) and anything set with 'go env -w'.  If the go
+// command can't tell us, the value in the environment (if any) is used.
+func goEnv(name string) string {
+	goEnvOnce.Do(func() {
+		out, err := exec.Command("go", "env", "-json").Output()
+		if err == nil {
+			err = json.Unmarshal(out, &goEnvValues)
+		}
+		if err != nil {
+			verbosef("Unable to query the Go environment with 'go env -json': %v", err)
+		}
+	})
+	if value, exists := goEnvValues[name]; exists {
+		return value
+	}
+	return os.Getenv(name)
+}
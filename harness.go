@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// This is the name of the test binary in the build directory (and the
+// image, in bindir) when building a harness
+const harnessBinary = "harness_linux64"
+
+// These are the arguments a harness is run with if the configuration
+// doesn't give any (i.e., run all the benchmarks, but none of the tests)
+var defaultHarnessArgs = []string{"-test.run", "^$", "-test.bench", ".", "-test.benchmem"}
+
+// The harness function adjusts the binaries and the configuration when
+// building a harness image (with --harness).  Instead of the package (and
+// any additional packages), the image contains only the test binary for
+// the package (built with 'go test -c').  The binary is always the
+// ENTRYPOINT, so remote runners can override its arguments (e.g., to
+// select different benchmarks) with 'docker run'.
+func harness(Options Options, name string, bins []Binary, config Config) ([]Binary, Config) {
+	if !Options.Harness {
+		return bins, config
+	}
+	bin := Binary{Package: name, Name: harnessBinary, Path: path.Join(binDir(config), harnessBinary)}
+	config.Default = ""
+	config.Entrypoint = true
+	config.Args = config.Harness
+	if len(config.Args) == 0 {
+		config.Args = defaultHarnessArgs
+	}
+	verbosef("Building test harness for %s", name)
+	return []Binary{bin}, config
+}
+
+// The checkHarness function makes sure the test binary was built ('go
+// test -c' doesn't write one if the package has no tests).
+func checkHarness(Options Options, dir string, bin Binary) error {
+	if !Options.Harness {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, bin.Name)); err != nil {
+		return fmt.Errorf("No test binary was built for %s (does it have any tests?)", bin.Package)
+	}
+	return nil
+}
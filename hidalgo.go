@@ -4,43 +4,74 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"sort"
 	"strings"
-	"text/template"
+	"time"
 
 	"github.com/jessevdk/go-flags"
-	"github.com/xogeny/denada-go"
 )
 
-// This is the (Denada) grammar for the configuration file.
-// N.B. - Currently, the file directive is ignored.
-const configGrammar = `
-env _ "env*";
-
-file _ "file*";
-
-port [0-9]+ "port*";
-`
+// This is the image Windows images are built from unless told otherwise
+const windowsBase = "mcr.microsoft.com/windows/nanoserver:ltsc2022"
 
 // This is the template for the Dockerfile that will be generated
 const dockerTemplate = `
+# Build arguments (given with --build-arg), which can be used in the
+# base image
+{{range $key, $value := .buildargs }}
+ARG {{key $key}}{{if $value}}={{quote $value}}{{end}}
+{{end}}
+
 # Start from a Debian image with the latest version of Go installed
 # and a workspace (GOPATH) configured at /go.
 FROM {{.from}}
 
-# Copy local executable to image
-ADD server_linux64 /usr/local/bin/server_linux64
+# Make the build arguments available after FROM as well
+{{range $key, $value := .buildargs }}
+ARG {{key $key}}
+{{end}}
+
+# Labels describing the image
+{{range $key, $value := .labels }}
+LABEL {{key $key}}={{quote $value}}
+{{end}}
+
+{{if .certs}}
+# CA certificates (so the executables can make TLS connections)
+ADD {{.certs}} /etc/ssl/certs/ca-certificates.crt
+ENV SSL_CERT_FILE=/etc/ssl/certs/ca-certificates.crt
+{{end}}
+{{if .tzdata}}
+# Time zone database (so the executables can load time zones)
+ADD {{.tzdata}} /usr/local/go/lib/time/zoneinfo.zip
+ENV ZONEINFO=/usr/local/go/lib/time/zoneinfo.zip
+{{end}}
+
+{{if .files}}
+# Copy files from the package directory to image
+ADD {{.files}} {{.filedest}}
+WORKDIR {{.filedest}}
+{{end}}
+{{range .copies}}
+COPY {{if .Owner}}--chown={{.Owner}} {{end}}{{json .Paths}}
+{{end}}
+
+# Copy local executables to image (last, since they change the most
+# often, so the layers above are reused)
+{{range .executables}}
+ADD {{.Name}} {{.Path}}
+{{end}}
 
 # Environment variable values available at *build* time
 # (if you don't see variables you expect, either define them
 # when running hidalgo OR specify them when running the image)
 {{range $key, $value := .env }}
-ENV {{$key}} {{$value}}
+ENV {{key $key}}={{quote $value}}
 {{end}}
 
 # Expose any ports required
@@ -48,34 +79,129 @@ ENV {{$key}} {{$value}}
 EXPOSE {{$value}}
 {{end}}
 
+# Declare any mount points for persistent data
+{{range $value := .volumes}}
+VOLUME {{json $value}}
+{{end}}
+
 # Run the executable
-CMD ["/usr/local/bin/server_linux64"]
-`
+{{if .entrypoint}}ENTRYPOINT {{json .entrypoint}}
+{{end}}{{if .cmd}}CMD {{json .cmd}}
+{{end}}`
 
 // Options is a structure used to describe the various command line
 // options.
+//
+// The (optional) directories of the Go packages to build are given
+// after the options.  They are not declared as positional arguments so
+// that they don't get confused with command names (e.g., 'agent').
 type Options struct {
-	Positional struct {
-		Directory string `description:"Directory of Go package to build"`
-	} `positional-args:"true"`
-
-	Docker  string `short:"d" long:"docker" description:"Docker command" default:"sdocker"`
-	Tag     string `short:"t" long:"tag" description:"Name to tag image with"`
-	From    string `short:"f" long:"from" description:"Docker image to build FROM"`
-	Build   string `short:"b" long:"builddir" description:"Directory for Docker build"`
-	Keep    bool   `short:"k" long:"keep" description:"Keep Docker build directory"`
-	Verbose bool   `short:"v" long:"verbose" description:"Verbose output"`
-	Dry     bool   `short:"n" long:"dryrun" description:"Suppress docker build"`
+	Docker   string `short:"d" long:"docker" description:"Docker command" default:"docker"`
+	Backend  string `long:"backend" description:"Tool to build the image with (docker, podman, buildah, nerdctl, sdocker or daemonless)" default:"docker"`
+	Tag      string `short:"t" long:"tag" description:"Name to tag image with"`
+	From     string `short:"f" long:"from" description:"Docker image to build FROM"`
+	Build    string `short:"b" long:"builddir" description:"Directory for Docker build"`
+	Keep     bool   `short:"k" long:"keep" description:"Keep Docker build directory"`
+	Verbose  []bool `short:"v" long:"verbose" description:"Verbose output (-vv for commands and the Dockerfile, -vvv for the output of every command)"`
+	Quiet    bool   `short:"q" long:"quiet" description:"Only report errors"`
+	Dry      bool   `short:"n" long:"dryrun" description:"Suppress docker build"`
+	Watch    bool   `short:"w" long:"watch" description:"Rebuild whenever the package source changes"`
+	Jobs     int    `short:"j" long:"jobs" description:"Number of packages to build concurrently"`
+	LDFlags  string `long:"ldflags" description:"Flags passed to the Go linker"`
+	Test     bool   `long:"test" description:"Run the package tests before building"`
+	Generate bool   `long:"generate" description:"Run go generate on the package before building"`
+	Platform string `long:"platform" description:"Platform to build for (os/arch[/variant])" default:"linux/amd64"`
+	GoMIPS   string `long:"gomips" description:"Floating point mode for MIPS platforms (hardfloat or softfloat)"`
+	DOut     string `short:"o" long:"dockerfile-out" description:"Also write the Dockerfile here ('-' for stdout, the default for dry runs)"`
+	Template string `long:"template" description:"Dockerfile template to use instead of the built in one"`
+
+	Binary string `long:"binary" description:"Name of the executable in the image (instead of the base name of the package)"`
+	BinDir string `long:"bindir" description:"Directory the executables are installed in (in the image)" default-mask:"/usr/local/bin"`
+
+	Platforms string `long:"platforms" description:"Platforms to build a multi-platform image for (comma separated, e.g., linux/amd64,linux/arm64)"`
+
+	Static       string `long:"static" description:"Build statically linked executables (with cgo disabled)" default:"true" optional:"yes" optional-value:"true" choice:"true" choice:"false"`
+	Compress     bool   `long:"compress" description:"Compress the executables with upx (if it is installed)"`
+	Strip        bool   `long:"strip" description:"Strip the symbol table and debug information from the executables (and report their sizes)"`
+	Reproducible bool   `long:"reproducible" description:"Build byte-for-byte identical images from the same source (using SOURCE_DATE_EPOCH)"`
+
+	LabelFile []string `long:"label-file" description:"JSON or YAML file of labels to add to the image (may be repeated)"`
+	BuildArg  []string `long:"build-arg" description:"Value of a build argument (NAME=value or NAME to use the environment, may be repeated)"`
+	EnvFile   []string `long:"env-file" description:"File of environment variable values (instead of .env in the package directory, may be repeated)"`
+	Env       []string `short:"e" long:"env" description:"Environment variable to set in the image (NAME=value, overriding any other value, may be repeated)"`
+	Port      []string `long:"port" description:"Port to expose (number[/protocol], in addition to the ones in the configuration, may be repeated)"`
+	AutoPorts bool     `long:"auto-ports" description:"Expose the ports the package appears to listen on (instead of just suggesting them)"`
+	StrictEnv bool     `long:"strict-env" description:"Fail if the environment variables in the configuration don't match the ones the package reads"`
+
+	Profile   []string `long:"profile" description:"Configuration profile to use (may be repeated)"`
+	WithPProf bool     `long:"with-pprof" description:"Expose (and label) the pprof port (6060) for development images"`
+
+	DebugVariant bool `long:"debug-variant" description:"Also build a debug image (tagged <tag>-debug) with busybox added"`
+	Harness      bool `long:"harness" description:"Build an image that runs the package's benchmarks (compiled with go test -c) instead"`
+
+	SaveTo    string `long:"save-to" description:"Also save the image to this file (in docker-archive format)"`
+	OCILayout string `long:"oci-layout" description:"Also add the image to the OCI image layout in this directory"`
+	SSHCopyTo string `long:"ssh-copy-to" description:"Also load the image on this host ([user@]host) over ssh"`
+	SSHLoad   string `long:"ssh-load" description:"Command that loads the image on the remote host" default:"podman load"`
+	SaveOnly  bool   `long:"save-only" description:"Remove the image from the daemon once it is saved (instead of leaving it there)"`
+
+	JSONErrors bool   `long:"json-errors" description:"Also report errors (and warnings) as JSON objects (on stdout)"`
+	WarnErrors bool   `long:"warnings-as-errors" description:"Fail the build if there are any warnings"`
+	IIDFile    string `long:"iidfile" description:"Write the ID of the image to this file"`
+	Output     string `long:"output" description:"What to write to stdout (text: the IDs of the images, json: a record of each build)" default:"text" choice:"text" choice:"json"`
+	Timings    bool   `long:"timings" description:"Report how long each phase of the build took"`
+	CPUProfile string `long:"cpu-profile" description:"Write a CPU profile of hidalgo itself to this file (for diagnosing slow builds)"`
+
+	PushRetries  int           `long:"push-retries" description:"Number of times to retry a failed push" default:"3"`
+	BuildRetries int           `long:"build-retries" description:"Number of times to retry a failed Docker build" default:"0"`
+	RetryBackoff time.Duration `long:"retry-backoff" description:"How long to wait before retrying (doubling after each attempt)" default:"2s"`
+	RegistryUser string        `long:"registry-user" description:"User to push as (with the password in $HIDALGO_REGISTRY_PASSWORD) instead of the credentials from docker login"`
+
+	Sign    bool   `long:"sign" description:"Sign the images (with cosign) once they are pushed"`
+	SignKey string `long:"sign-key" description:"Key to sign the images with (a file or KMS URI, as cosign accepts)" default:"cosign.key"`
+	Cosign  string `long:"cosign" description:"cosign command" default:"cosign"`
+
+	Summary     string `long:"summary" description:"Write a (markdown) summary of the image to this file ('-' for stdout)"`
+	SummaryBase string `long:"summary-base" description:"Image to compare the size of the image with in the summary"`
+	SummaryScan string `long:"summary-scan" description:"Vulnerability scan results (Trivy or Grype JSON) to include in the summary"`
+	GitHubPR    int    `long:"github-pr" description:"Post the summary as a comment on this GitHub pull request"`
+	Report      string `long:"report" description:"Write a report of the inputs and outputs of the build to this file (relative to the package directory)" optional:"yes" optional-value:"hidalgo-report.json"`
+
+	Host      string `short:"H" long:"host" description:"Docker daemon to build with (unix://, tcp:// or ssh://[user@]host[:port])"`
+	TLSCACert string `long:"tlscacert" description:"CA certificate used to verify the Docker daemon"`
+	TLSCert   string `long:"tlscert" description:"Client TLS certificate for the Docker daemon"`
+	TLSKey    string `long:"tlskey" description:"Client TLS key for the Docker daemon"`
+
+	Agent     []string `long:"agent" description:"URL of a build agent to build the image with (may be repeated)"`
+	AgentCert string   `long:"agent-cert" description:"Client TLS certificate for the build agent"`
+	AgentKey  string   `long:"agent-key" description:"Client TLS key for the build agent"`
+	AgentCA   string   `long:"agent-ca" description:"CA certificate used to verify the build agent"`
+
+	// Whether this is the image for a job (see buildJobs)
+	job bool
+	// Whether to push the images once they are built (see PushCommand)
+	push bool
+	// The tag of the multi-platform image this one is part of (see
+	// buildPlatforms)
+	platformOf string
+	// The credentials for pushing to registries given in the
+	// configuration, by registry (see pushAuth)
+	registries map[string]Registry
+	// The time (in seconds since the epoch) a reproducible build is
+	// stamped with (see reproducible)
+	epoch int64
+	// The record of the build (with --output json, see newRecord)
+	record *BuildRecord
 }
 
-// Config is a structure that contains information parsed from the configuration
-// file.  This is information that would be otherwise inconvenient to include
-// in the command line because it is either repetitive (always required) or extensive
-// (involves a lot of information).
-type Config struct {
-	Files []string
-	Env   []string
-	Ports []int
+// A Binary is a Go package that gets compiled and added to the image
+type Binary struct {
+	// The Go package name
+	Package string
+	// The name of the executable (in the build directory)
+	Name string
+	// Where the executable is installed (in the image)
+	Path string
 }
 
 // The cmdString function generates a textual representation of a
@@ -84,45 +210,12 @@ func cmdString(cmd *exec.Cmd) string {
 	return fmt.Sprintf("%s %s", cmd.Path, strings.Join(cmd.Args[1:], " "))
 }
 
-// The parseConfig function walks the elements in the config file and uses
-// them to populate an instance of the Config structure.
-func parseConfig(config denada.ElementList) (Config, error) {
-	// Initial configuration is empty
-	ret := Config{}
-
-	// Look for any elements that match the "env" rule and add their
-	// name to the Config.Env array
-	for _, e := range config.OfRule("env", false) {
-		ret.Env = append(ret.Env, e.Name)
-	}
-
-	// Look for any elements that match the "port" rule, turn their
-	// name into a number (checking for proper values) and then add
-	// them to the Config.Ports array
-	for _, e := range config.OfRule("port", false) {
-		num, err := strconv.ParseInt(e.Name, 0, 0)
-		if err != nil || num < 1 || num > 65535 {
-			return ret, fmt.Errorf("Invalid port number: %s", e.Name)
-		}
-		ret.Ports = append(ret.Ports, int(num))
-	}
-
-	// Look for any elements that match the "file" rule and add them
-	// to the Config.Files array.
-	for _, e := range config.OfRule("file", false) {
-		ret.Files = append(ret.Files, e.Name)
-	}
-
-	// Return all the data that was collected
-	return ret, nil
-}
-
 // The packageName function takes the name of a directory (potentially
 // relative) and returns the name of the Go package it points to.  At
 // some point, I'd like to use the go/parser package to come up with
 // something a bit more formal and robust.  This function simply expands
-// the directory to an absolute path, looks for GOPATH as a substring
-// and then trims the GOPATH prefix.
+// the directory to an absolute path, looks for each GOPATH workspace as
+// a prefix and then trims it.
 func packageName(dir string) (string, string, error) {
 	// Get absolute name of directory
 	adir, err := filepath.Abs(dir)
@@ -136,116 +229,427 @@ func packageName(dir string) (string, string, error) {
 		return "", "", err
 	}
 
-	// Get the current value of GOPATH
-	gp := os.Getenv("GOPATH")
+	// Get the current value of GOPATH (or its default)
+	gp := goEnv("GOPATH")
 	if gp == "" {
 		return "", "", fmt.Errorf("No GOPATH specified")
 	}
 
-	// Add src to GOPATH
-	sdir := path.Join(gp, "src")
+	// GOPATH may be a list of workspaces, so look for the target
+	// directory in the src directory of each of them (in order)
+	sdirs := []string{}
+	for _, ws := range filepath.SplitList(gp) {
+		if ws == "" {
+			continue
+		}
 
-	// Check if the target directory existsin in GOPATH/src
-	if filepath.HasPrefix(act, sdir) {
-		// If so, get the relative path within GOPATH/src...
+		// Add src to the workspace (and follow any symbolic links in
+		// it as well, so it can be compared with the target directory)
+		sdir := filepath.Join(ws, "src")
+		if asdir, err := filepath.EvalSymlinks(sdir); err == nil {
+			sdir = asdir
+		}
+		sdirs = append(sdirs, sdir)
+
+		// Check if the target directory exists in src by getting the
+		// relative path within src...
 		pname, err := filepath.Rel(sdir, act)
-		if err != nil {
-			return "", "", err
+		if err != nil || pname == ".." || strings.HasPrefix(pname, ".."+string(filepath.Separator)) {
+			continue
 		}
-		// ...and return it as the package name (along with the full path)
-		return act, pname, nil
-	} else {
-		return "", "", fmt.Errorf("Directory %s not inside %s", act, sdir)
+
+		// ...and return it as the package name (along with the full
+		// path).  Package names always use forward slashes (even on
+		// Windows).
+		return act, filepath.ToSlash(pname), nil
+	}
+	switch len(sdirs) {
+	case 0:
+		return "", "", fmt.Errorf("No GOPATH specified")
+	case 1:
+		return "", "", fmt.Errorf("Directory %s not inside %s", act, sdirs[0])
+	default:
+		return "", "", fmt.Errorf("Directory %s not inside any of %s", act, strings.Join(sdirs, ", "))
+	}
+}
+
+// This is where the executables are installed in the image (unless the
+// configuration says otherwise)
+const defaultBinDir = "/usr/local/bin"
+
+// The binDir function returns the directory the executables are
+// installed in (in the image).
+func binDir(config Config) string {
+	if config.BinDir != "" {
+		return config.BinDir
+	}
+	return defaultBinDir
+}
+
+// The binaries function determines the complete list of binaries to
+// build.  The first is always the main package (i.e., the one in the
+// directory hidalgo was run on).  Additional packages are either import
+// paths or paths relative to the main package directory.  Each one is
+// installed (in bindir) with the base name of its package, unless the
+// configuration names the main package's executable.
+func binaries(apdir string, name string, config Config) ([]Binary, error) {
+	exe := path.Base(name)
+	if config.Binary != "" {
+		exe = config.Binary
+	}
+	ret := []Binary{Binary{Package: name, Name: "server_linux64", Path: path.Join(binDir(config), exe)}}
+	for _, p := range config.Packages {
+		pname := p
+		// Relative paths are resolved against the main package directory
+		if strings.HasPrefix(p, ".") {
+			_, rname, err := packageName(filepath.Join(apdir, p))
+			if err != nil {
+				return nil, err
+			}
+			pname = rname
+		}
+		bin := Binary{Package: pname, Name: path.Base(pname) + "_linux64",
+			Path: path.Join(binDir(config), path.Base(pname))}
+		for _, b := range ret {
+			if b.Name == bin.Name {
+				return nil, fmt.Errorf("Packages %s and %s would have the same binary name %s",
+					b.Package, bin.Package, bin.Name)
+			}
+			if b.Path == bin.Path {
+				return nil, fmt.Errorf("Packages %s and %s would both be installed as %s",
+					b.Package, bin.Package, bin.Path)
+			}
+		}
+		ret = append(ret, bin)
 	}
+	return ret, nil
+}
+
+// The defaultBinary function determines which binary is run by the image.
+// By default this is the main package, but the configuration can name one
+// of the additional packages (by base name) instead.
+func defaultBinary(bins []Binary, config Config) (Binary, error) {
+	if config.Default == "" {
+		return bins[0], nil
+	}
+	for _, b := range bins[1:] {
+		if path.Base(b.Package) == config.Default {
+			return b, nil
+		}
+	}
+	return Binary{}, fmt.Errorf("Default binary %s is not one of the listed packages", config.Default)
+}
+
+// The copyFile function copies the contents of one file to another.  A
+// destination of "-" means os.Stdout.
+func copyFile(src string, dst string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if dst == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(dst, data, 0644)
+}
+
+// The sortedKeys function returns the keys of a map (in order).
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The baseImage function determines the Docker image that we will build
+// our image from.  An image given on the command line is always used.
+// Otherwise, the configuration can give a base image for the platform
+// (os/arch/variant), or for all variants of the architecture (os/arch)
+// or for any platform ("*"), in that order of preference.
+func baseImage(Options Options, config Config, platform Platform) string {
+	if Options.From != "" {
+		return Options.From
+	}
+	for _, p := range []string{platform.String(), platform.OS + "/" + platform.Arch, "*"} {
+		if from, exists := config.From[p]; exists {
+			return from
+		}
+	}
+	// Windows images can't be built from scratch, so they start from
+	// Nano Server
+	if platform.OS == "windows" {
+		return windowsBase
+	}
+	// If nothing is specified, we start from the "scratch" Docker image
+	return "scratch"
+}
+
+// The checkRequired function makes sure the environment variables that
+// are required by the configuration are set (before the time consuming
+// build), since an image without them would only fail when it is run.
+func checkRequired(config Config) error {
+	missing := []string{}
+	for _, r := range config.Required {
+		if config.getenv(r) == "" {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Required environment variable(s) not set: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// The buildEnv function determines the values of the environment
+// variables (listed in the configuration) that are baked into the image.
+func buildEnv(config Config) map[string]string {
+	// Start with empty environment variable definitions
+	env := map[string]string{}
+	// And then add any relevant environment variables that are in the current
+	// environment (or an environment file).
+	for _, e := range config.Env {
+		added := addIf(e, env, config)
+		if added {
+			verbosef("  Environment variable %s added to Dockerfile", e)
+		} else {
+			warnf("Environment variable %s is not set, so it is not added to the image", e)
+		}
+	}
+	return env
+}
+
+// The goBuildArgs function returns the arguments to 'go' that compile
+// the binaries for the image (a test binary when building a harness).
+func goBuildArgs(Options Options, ldflags string) []string {
+	gargs := []string{"build"}
+	if Options.Harness {
+		gargs = []string{"test", "-c"}
+	}
+	// Paths on the build machine don't end up in reproducible builds
+	if Options.Reproducible {
+		gargs = append(gargs, "-trimpath")
+	}
+	// Static executables use the pure Go resolver and user lookup
+	if static(Options) {
+		gargs = append(gargs, "-tags", "netgo,osusergo")
+	}
+	if ldflags != "" {
+		gargs = append(gargs, "-ldflags", ldflags)
+	}
+	return gargs
+}
+
+// The static function returns true unless the options allow the
+// executables to be dynamically linked (with --static=false).
+func static(Options Options) bool {
+	return Options.Static != "false"
 }
 
 // The addIf function looks to see if the named environment variable is
-// actually present in the current environment (i.e., os.Getenv returns
-// something other than "").  If so, it adds it to the list of environement
-// variables that are given a value in the generated Dockerfile
-func addIf(name string, env map[string]string) bool {
-	if os.Getenv(name) != "" {
-		env[name] = os.Getenv(name)
+// actually present in the current environment or an environment file
+// (i.e., config.getenv returns something other than "").  If so, it adds
+// it to the list of environement variables that are given a value in the
+// generated Dockerfile
+func addIf(name string, env map[string]string, config Config) bool {
+	if value := config.getenv(name); value != "" {
+		env[name] = value
 		return true
 	}
 	return false
 }
 
-// This is (obviously), the entry point for the tool
-func main() {
-	// Get command line options
-	var Options Options
-	parser := flags.NewParser(&Options, flags.Default)
-
-	if _, err := parser.Parse(); err != nil {
-		os.Exit(1)
+// The run function performs a complete build of the package in pdir with
+// the given options and returns the exit status of the tool.
+func run(Options Options, pdir string) int {
+	start := time.Now()
+	if Options.record == nil {
+		Options.record = newRecord(Options, pdir)
+	}
+	err := buildImage(Options, pdir)
+	status := ExitOK
+	if err != nil {
+		status = report(Options, pdir, err)
 	}
+	Options.record.finish(status, err, start)
+	reportTimings(Options, Options.record)
+	return status
+}
 
-	// Now determine package to be built
-	// We assume they mean the current directory...
-	pdir := "."
-	if Options.Positional.Directory != "" {
-		// ...unless they specified something explicitly
-		pdir = Options.Positional.Directory
+// The buildImage function does all the work of building the image for
+// the package in pdir.  Any error it returns is one of our error types
+// (so that the appropriate exit status can be determined).
+func buildImage(Options Options, pdir string) error {
+	// The profile may give the tag (so it has to be known up front), and
+	// it may be a template
+	Options, err := profileTag(Options, pdir)
+	if err != nil {
+		return err
+	}
+	Options, err = expandTag(Options, pdir)
+	if err != nil {
+		return err
 	}
 
-	if os.Getenv("DOCKER_HOST") == "" {
-		fmt.Printf("You must set the DOCKER_HOST environment variable")
-		os.Exit(1)
+	// An image for several platforms is built one platform at a time
+	if Options.Platforms != "" {
+		return buildPlatforms(Options, pdir)
 	}
 
 	// Get the absolute directory path and package name
 	apdir, name, err := packageName(pdir)
 	if err != nil {
-		log.Printf("Error determining package name: %v", err)
-		os.Exit(1)
+		return &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+
+	verbosef("Package name: %s", name)
+
+	// Determine the platform we are building for
+	platform, err := parsePlatform(Options.Platform)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	verbosef("Target platform: %s", platform)
+	if platform.experimental() {
+		warnf("Support for %s is experimental", platform)
 	}
 
-	if Options.Verbose {
-		log.Printf("Package name: %s", name)
+	// Make sure we know how to build the image
+	if _, exists := backends[Options.Backend]; !exists {
+		return &UsageError{fmt.Errorf("Unknown backend %s (must be one of %s)",
+			Options.Backend, strings.Join(backendNames(), ", "))}
 	}
 
-	// Parse the *grammar* for the configuration file
-	grammar, err := denada.ParseString(configGrammar)
+	// The debug variant is built from the image, so it must be tagged
+	// (and busybox only runs on Linux)
+	if Options.DebugVariant && Options.Tag == "" {
+		return &UsageError{fmt.Errorf("A tag is required to build a debug variant")}
+	}
+	if Options.DebugVariant && platform.OS != "linux" {
+		return &UsageError{fmt.Errorf("Debug variants can only be built for Linux")}
+	}
+
+	// Make sure we can save (or push) the image (if asked to)
+	err = checkSave(Options)
 	if err != nil {
-		// This should not happen
-		log.Printf("Internal error in grammar specification: %v", err)
-		os.Exit(1)
+		return &UsageError{err}
+	}
+	err = checkPush(Options)
+	if err != nil {
+		return &UsageError{err}
+	}
+	err = checkSign(Options)
+	if err != nil {
+		return &UsageError{err}
+	}
+	err = checkSummary(Options)
+	if err != nil {
+		return &UsageError{err}
 	}
 
-	// This is the name of the configuration file
-	cfile := path.Join(apdir, "hidalgo.cfg")
+	// Make sure the environment variables and ports we were given are
+	// valid (which would otherwise look like a problem with the
+	// configuration)
+	_, err = parseEnvOverrides(Options.Env)
+	if err != nil {
+		return &UsageError{err}
+	}
+	_, err = parsePorts(Options.Port)
+	if err != nil {
+		return &UsageError{err}
+	}
+
+	// Load the configuration for the package (if any)
+	start := time.Now()
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	Options.record.phase("config", start)
 
-	// Assume no configuration options
-	conf := denada.ElementList{}
+	// Make sure we can build the image without a daemon (if asked to)
+	err = checkDaemonless(Options, config)
+	if err != nil {
+		return &UsageError{err}
+	}
 
-	// ...unless the configuration file exists
-	if _, err := os.Stat(cfile); err == nil {
-		// In that case, we parse it to determine the value for 'conf'
-		conf, err = denada.ParseFile(cfile)
-		if err != nil {
-			log.Printf("Error reading configuration file %s: %v", cfile, err)
-			os.Exit(1)
-		}
-		if Options.Verbose {
-			log.Printf("Configuration file: %s", cfile)
+	// Make sure we have the credentials to push the image with (if any
+	// were given)
+	Options.registries = config.Registries
+	if Options.push {
+		if _, _, err := pushAuth(Options, Options.Tag); err != nil {
+			return &UsageError{fmt.Errorf("Unable to push %s: %v", Options.Tag, err)}
 		}
 	}
 
-	// Check the parsed configuration against the grammar to make
-	// sure we know exactly what is in it.
-	err = denada.Check(conf, grammar, false)
+	// Expose pprof (if asked to) and make sure production images don't
+	config, err = checkPProf(Options, apdir, config)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the build arguments are valid (and used)
+	err = checkBuildArgs(Options, config)
+	if err != nil {
+		return &UsageError{err}
+	}
+
+	// Make sure the environment variables the image needs are set
+	err = checkRequired(config)
+	if err != nil {
+		return &ConfigError{err}
+	}
+
+	// Determine the time the build is stamped with (if it must be
+	// reproducible)
+	Options, err = reproducible(Options, apdir)
 	if err != nil {
-		log.Printf("Error in configuration: %v", err)
-		os.Exit(2)
+		return &BuildError{err}
 	}
 
-	// Now go through the (grammatically valid) configuration AST
-	// and extract the information we need.
-	config, err := parseConfig(conf)
+	// Determine what goes into the image (the image to build FROM, the
+	// environment variables to bake into it, the executables, etc.)
+	plan, err := planImage(Options, platform, apdir, name, config)
 	if err != nil {
-		log.Printf("Error in configuration: %v", err)
+		return err
 	}
+	config, from, env, bins := plan.Config, plan.From, plan.Env, plan.Bins
+	if !pinned(from) {
+		warnf("The base image %s is not pinned (give a tag other than latest, or a digest)", from)
+	}
+
+	// Look for environment variables the package reads that aren't in
+	// the image
+	err = detectEnv(Options, platform, apdir, config)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	Options.record.describe(name, config, env)
+
+	// Load the Dockerfile template (before the time consuming build, so
+	// that any mistakes in it are found quickly)
+	t, err := loadTemplate(Options)
+	if err != nil {
+		return &BuildError{err}
+	}
+
+	// Now that we know all the inputs, print a fingerprint of them so it
+	// is easy to tell whether two builds should produce the same result
+	fp, err := newFingerprint(apdir, config, Options, env, from)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Unable to compute build fingerprint: %v", err)}
+	}
+	infof("Build fingerprint for %s: %s", name, fp)
+	verbosef("  Source:    %s", fp.Source)
+	verbosef("  Config:    %s", fp.Config)
+	verbosef("  Flags:     %s", fp.Flags)
+	verbosef("  Env:       %s", fp.Env)
+	verbosef("  Toolchain: %s", fp.Toolchain)
+	verbosef("  GOFLAGS:   %s", fp.GoFlags)
+	verbosef("  Base:      %s", fp.Base)
+	verbosef("  Template:  %s", fp.Template)
 
 	// Assume that we will use the explicitly provided build directory...
 	dir := Options.Build
@@ -255,199 +659,739 @@ func main() {
 		// In that case, we create a temporary directory...
 		dir, err = ioutil.TempDir("", "hidalgo")
 		if err != nil {
-			log.Printf("Error: Cannot create temporary directory")
-			os.Exit(2)
+			return &BuildError{fmt.Errorf("Cannot create temporary directory: %v", err)}
+		}
+		// ...which is removed when we are all done (unless they asked
+		// to keep it).
+		if !Options.Keep {
+			defer os.RemoveAll(dir)
 		}
-		// ...which is removed when we are all done.
-		defer os.RemoveAll(dir)
 	} else {
 		// Make sure the directory they specified exists and if it
 		// doesn't, make it.
 		err = os.MkdirAll(dir, os.ModePerm)
 		if err != nil {
-			log.Printf("Error: Unable to create directory %s: %v", dir, err)
-			os.Exit(2)
+			return &BuildError{fmt.Errorf("Unable to create directory %s: %v", dir, err)}
 		}
 	}
 
-	if Options.Verbose {
-		log.Printf("Build directory: %s", dir)
+	verbosef("Build directory: %s", dir)
+
+	// Run any pre-build hooks (e.g., to build assets)
+	start = time.Now()
+	err = runHooks(Options, config, preBuildHook, apdir, name, platform, dir, "")
+	if err != nil {
+		return &BuildError{fmt.Errorf("Hook failed, not building image: %v", err)}
 	}
+	Options.record.phase("hooks", start)
 
-	// Now change to the build directory
-	err = os.Chdir(dir)
+	// Determine the files to add to the image (after the hooks, which
+	// may create some of them, but before the time consuming build, so
+	// that a mistake in a pattern is found quickly)
+	staged, err := planFiles(apdir, config.Files)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	modes, err := fileModes(staged)
 	if err != nil {
-		log.Printf("Error: Cannot change to build directory %s", dir)
-		os.Exit(2)
+		return &ConfigError{err}
 	}
 
-	if Options.Verbose {
-		log.Printf("Building directory: %s", dir)
+	// Specify the values of GOOS and GOARCH (and any variant specific
+	// settings, like GOARM) for the target platform.  These are only set
+	// in the environment of the build commands (and not in our own
+	// environment).
+	penv, err := platform.goenv(Options.GoMIPS)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	goenv := append(os.Environ(), penv...)
+	verbosef("Go environment: GOPATH=%s GOCACHE=%s GOFLAGS=%s", goEnv("GOPATH"), goEnv("GOCACHE"), goEnv("GOFLAGS"))
+
+	// Executables that are dynamically linked (e.g., because cgo is
+	// enabled when building for the same platform) don't run FROM
+	// scratch (which has no C library), so cgo is disabled unless they
+	// say otherwise
+	if static(Options) {
+		goenv = append(goenv, "CGO_ENABLED=0")
+	} else if from == "scratch" {
+		warnf("Dynamically linked executables (built with --static=false) will not run in an image built FROM scratch")
 	}
 
-	// Specify the values of GOOS and GOARCH to be 64 bit linux
-	os.Setenv("GOOS", "linux")
-	os.Setenv("GOARCH", "amd64")
+	// If requested, generate code first (so it can be verified and
+	// compiled along with the rest of the package)...
+	start = time.Now()
+	err = generate(Options, config, name, apdir)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Code generation failed, not building image: %v", err)}
+	}
+	Options.record.phase("generate", start)
 
-	// Build the static Go executable
-	build := exec.Command("go", "build", "-o", "server_linux64", name)
+	// Make sure there is something to run in the image (before we spend
+	// any time verifying or compiling the package)
+	err = checkMain(Options, config, platform, apdir, bins)
+	if err != nil {
+		return &UsageError{err}
+	}
 
-	output, err := build.CombinedOutput()
+	// ...and then verify the package (vet, lint and test)
+	start = time.Now()
+	err = verify(Options, config, name, apdir)
 	if err != nil {
-		log.Printf("Error running cmd '%s':\n%s\n%v", cmdString(build), output, err)
-		os.Exit(3)
+		return &BuildError{fmt.Errorf("Verification failed, not building image: %v", err)}
+	}
+	Options.record.phase("verify", start)
+
+	// Determine the flags for the Go linker.  If a version is specified
+	// in the configuration, the build is stamped with it (along with the
+	// commit and the build date).  The image is labeled with where it
+	// came from (and the template has access to the stamp) either way.
+	ldflags := linkerFlags(Options)
+	if config.Version != "" {
+		ldflags = plan.Stamp.ldflags(ldflags)
 	}
+	gargs := goBuildArgs(Options, ldflags)
+
+	// Build the static Go executables
+	start = time.Now()
+	for i, bin := range bins {
+		// The main executable may be built by a command of their own
+		if i == 0 && customBuild(Options, config) {
+			verbosef("Building %s with the build command", bin.Package)
+			err = runBuild(config, bin, apdir, dir, goenv, ldflags)
+			if err != nil {
+				return &BuildError{err}
+			}
+			continue
+		}
 
-	if Options.Verbose {
-		log.Printf("Build of %s successful", name)
+		verbosef("Compiling %s", bin.Package)
+		build := exec.Command("go", append(gargs, "-o", bin.Name, bin.Package)...)
+		build.Dir = dir
+		build.Env = goenv
+
+		output, err := combinedOutput(build)
+		if err != nil {
+			return &BuildError{fmt.Errorf("Error running cmd '%s':\n%s\n%v", cmdString(build), output, err)}
+		}
+
+		verbosef("Build of %s successful", bin.Package)
+	}
+	err = checkHarness(Options, dir, bins[0])
+	if err != nil {
+		return &BuildError{err}
 	}
+	reportBinarySizes(Options, dir, bins)
 
-	// Assume we will start from the "scratch" Docker image...
-	from := "scratch"
-	if Options.From != "" {
-		// ...unless one is explicitly specified
-		from = Options.From
+	// Compress the executables (if asked to)
+	compressBinaries(Options, dir, bins)
+	Options.record.phase("compile", start)
+	start = time.Now()
+
+	// Add the CA bundle of the build machine (if the configuration asks
+	// for it)
+	if config.Certs {
+		bundle, err := certBundle()
+		if err != nil {
+			return &ConfigError{err}
+		}
+		verbosef("Adding CA bundle %s", bundle)
+		err = copyFile(bundle, filepath.Join(dir, certsFile))
+		if err != nil {
+			return &BuildError{fmt.Errorf("Unable to copy CA bundle %s: %v", bundle, err)}
+		}
 	}
 
-	// Build the Dockerfile template
-	t1 := template.New("Dockerfile")
-	t, err := t1.Parse(dockerTemplate)
+	// Add the time zone database (if the configuration asks for it)
+	if config.Tzdata {
+		tzdata, err := zoneinfo()
+		if err != nil {
+			return &ConfigError{err}
+		}
+		verbosef("Adding time zone database %s", tzdata)
+		err = copyFile(tzdata, filepath.Join(dir, zoneinfoFile))
+		if err != nil {
+			return &BuildError{fmt.Errorf("Unable to copy time zone database %s: %v", tzdata, err)}
+		}
+	}
+
+	// Add the files given with the file directive (if any)
+	copied, err := stageFiles(apdir, dir, staged)
 	if err != nil {
-		log.Printf("Error parsing Dockerfile template: %v", err)
-		os.Exit(4)
+		return &BuildError{fmt.Errorf("Unable to add files: %v", err)}
 	}
 
 	// Open a new file to write the Dockerfile contents into
-	dfile, err := os.Create("Dockerfile")
+	dfile, err := os.Create(filepath.Join(dir, "Dockerfile"))
 	if err != nil {
-		log.Printf("Unable to create Dockerfile in %s: %v", dir, err)
-		os.Exit(4)
+		return &BuildError{fmt.Errorf("Unable to create Dockerfile in %s: %v", dir, err)}
 	}
+	defer dfile.Close()
 
 	// Build up the context information for evaluating the template
-	context := map[string]interface{}{}
-	// Start with empty environment variable definitions
-	env := map[string]string{}
-	// And then add any relevant environment variables that are in the current
-	// environment.
-	for _, e := range config.Env {
-		added := addIf(e, env)
-		if Options.Verbose {
-			if added {
-				log.Printf("  Environment variable %s added to Dockerfile", e)
-			} else {
-				log.Printf("  Environment variable %s not added to Dockerfile", e)
-			}
+	context := plan.context(name)
+
+	// Execute the template and write it to the Dockerfile
+	err = t.Execute(dfile, context)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Error rendering template: %v", err)}
+	}
+
+	// Make sure the Dockerfile is completely written (and not held
+	// open, which prevents it from being removed on Windows)
+	err = dfile.Close()
+	if err != nil {
+		return &BuildError{fmt.Errorf("Error writing Dockerfile: %v", err)}
+	}
+
+	// Make sure nothing but the Dockerfile and the executables gets sent
+	// to Docker (in case the build directory has anything else in it)
+	names := []string{}
+	for _, bin := range bins {
+		names = append(names, bin.Name)
+	}
+	if config.Certs {
+		names = append(names, certsFile)
+	}
+	if config.Tzdata {
+		names = append(names, zoneinfoFile)
+	}
+	for _, s := range staged {
+		names = append(names, s.dir)
+	}
+	err = writeDockerignore(dir, apdir, names)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Error writing .dockerignore: %v", err)}
+	}
+	err = normalizeTimes(Options, dir, append(names, copied...))
+	if err != nil {
+		return &BuildError{fmt.Errorf("Unable to set modification times: %v", err)}
+	}
+	if size, err := contextSize(dir); err == nil && size > maxContextSize {
+		warnf("The build context is %s (more than %s)", megabytes(size), megabytes(maxContextSize))
+	}
+
+	// Write a copy of the Dockerfile wherever the user asked for it.  For
+	// a dry run, the Dockerfile is the only result so (unless told
+	// otherwise, or the results are written as JSON) it goes to
+	// os.Stdout.
+	dout := Options.DOut
+	if dout == "" && Options.Dry && !jsonOutput(Options) {
+		dout = "-"
+	}
+	if dout != "" {
+		err = copyFile(filepath.Join(dir, "Dockerfile"), dout)
+		if err != nil {
+			return &BuildError{fmt.Errorf("Error writing Dockerfile to %s: %v", dout, err)}
 		}
 	}
-	// Add those environment variables to the template context
-	context["env"] = env
 
-	// Now add any ports that need to be exposed.
-	context["ports"] = config.Ports
-	if Options.Verbose {
-		log.Printf("Exported ports: %v", config.Ports)
+	// If the user asked for debugging output, dump the Dockerfile as
+	// well (unless it was already written to os.Stdout)
+	if logAt(LevelDebug) && dout != "-" {
+		debugf("===== Dockerfile =====")
+		t.Execute(os.Stderr, context)
+		debugf("===== Dockerfile =====")
+	}
+
+	Options.record.phase("context", start)
+
+	// Now build the image (and the debug variant of it, if requested)
+	contexts := []buildContext{{Dir: dir, Tag: Options.Tag, Modes: modes}}
+	if Options.DebugVariant {
+		dctx, err := debugContext(dir, Options.Tag)
+		if err != nil {
+			return &BuildError{err}
+		}
+		contexts = append(contexts, dctx)
+	}
+	var images []builtImage
+	if backends[Options.Backend].daemonless {
+		images, err = assembleImage(Options, platform, dir, config, context)
+	} else {
+		images, err = buildImages(Options, platform, contexts)
+	}
+	if err != nil {
+		return err
+	}
+	for _, image := range images {
+		Options.record.image(image, platform.String())
+	}
+	if Options.Dry {
+		return nil
+	}
+
+	// Report the IDs of the images (for scripts)
+	err = reportImages(Options, images)
+	if err != nil {
+		return &DockerError{err}
 	}
+	reportImageSize(Options, images[0])
 
-	// Now specify the Docker image that we will build our image from
-	context["from"] = from
-	if Options.Verbose {
-		log.Printf("Base Docker image to build FROM: %s", from)
+	// Sign the images that were pushed (if asked to)
+	err = signImages(Options, images)
+	if err != nil {
+		return &DockerError{err}
 	}
 
-	// Execute the template and write it to the Dockerfile
-	err = t.Execute(dfile, context)
+	// Record where the image came from (if asked to)
+	err = writeReport(Options, apdir, name, platform, plan.Stamp, fp, images)
+	if err != nil {
+		return &BuildError{err}
+	}
+
+	// Summarize the image for the reviewers of a pull request (if asked
+	// to)
+	if summarizing(Options) {
+		err = summarize(Options, name, images[0], fp)
+		if err != nil {
+			return &BuildError{err}
+		}
+	}
+
+	// Run any post-build hooks (e.g., to notify someone)
+	start = time.Now()
+	err = runHooks(Options, config, postBuildHook, apdir, name, platform, dir, images[0].ID)
+	if err != nil {
+		return &BuildError{err}
+	}
+	Options.record.phase("hooks", start)
+
+	// Remove the image from the daemon if it was only to be saved
+	err = removeSaved(Options)
 	if err != nil {
-		log.Printf("Error rendering template: %v", err)
-		os.Exit(5)
+		return &DockerError{err}
 	}
 
-	// If the user specified verbose output, dump the Dockerfile
-	// to os.Stdout as well
-	if Options.Verbose {
-		log.Printf("===== Dockerfile =====")
-		t.Execute(os.Stdout, context)
-		log.Printf("===== Dockerfile =====")
+	// Finally, build the images for any jobs that go with this one
+	return buildJobs(Options, apdir, config)
+}
+
+// A buildContext is a directory to build an image from and the tag to
+// give the image.
+type buildContext struct {
+	Dir string
+	Tag string
+	// The modes given (in the configuration) for files in the directory,
+	// by their slash separated paths relative to it
+	Modes map[string]os.FileMode
+}
+
+// A builtImage records what we know about an image that was built
+type builtImage struct {
+	Tag string
+	// The ID of the image (if known)
+	ID string
+	// The digest of the image in its registry (if it was pushed and the
+	// digest is known)
+	Digest string
+}
+
+// The retryBuild function builds the image with the given tag (using
+// the given build function) and, if that fails with an error that might
+// go away, tries again (up to the number of times given in the
+// options).  Only the build is retried (pushes are retried on their
+// own, see retryPush).
+func retryBuild(Options Options, tag string, build func() (string, error)) (string, error) {
+	what := "build"
+	if tag != "" {
+		what = "build of " + tag
+	}
+	id := ""
+	err := retry(Options, what, Options.BuildRetries, func() error {
+		var err error
+		id, err = build()
+		return err
+	})
+	return id, err
+}
+
+// The buildImages function builds an image from each of the build
+// contexts (in order) using whichever means (build agent, backend,
+// Docker Engine API or Docker command) the options call for.  It returns
+// what is known about each of the images.
+func buildImages(Options Options, platform Platform, contexts []buildContext) ([]builtImage, error) {
+	// The platform is only specified if it isn't the default (so that
+	// older Docker daemons and clients continue to work), unless the
+	// image is part of a multi-platform image (which needs newer ones
+	// anyway)
+	pname := ""
+	if platform.String() != defaultPlatform || Options.platformOf != "" {
+		pname = platform.String()
+	}
+
+	// What we learn about each image as it is built (and pushed)
+	images := []builtImage{}
+	for _, c := range contexts {
+		images = append(images, builtImage{Tag: c.Tag})
+	}
+
+	// If a build agent was specified, it does the Docker build for us
+	if len(Options.Agent) > 0 {
+		if Options.Dry {
+			return images, nil
+		}
+		for i, c := range contexts {
+			opts := Options
+			opts.Tag = c.Tag
+			start := time.Now()
+			id, err := retryBuild(Options, c.Tag, func() (string, error) {
+				return agentBuild(opts, c, platform)
+			})
+			if err != nil {
+				return nil, &DockerError{err}
+			}
+			Options.record.phase("build", start)
+			verbosef("Image built by agent")
+			images[i].ID = id
+		}
+		return images, nil
+	}
+
+	// Backends that don't have the build context streamed to them build
+	// the image locally, straight from the build directory
+	if !backends[Options.Backend].stream {
+		if Options.Dry {
+			return images, nil
+		}
+		verbosef("Building with %s", Options.Backend)
+		for i, c := range contexts {
+			opts := Options
+			opts.Tag = c.Tag
+			start := time.Now()
+			id, err := retryBuild(Options, c.Tag, func() (string, error) {
+				return backendBuild(opts, c.Dir, pname)
+			})
+			if err != nil {
+				return nil, &DockerError{err}
+			}
+			Options.record.phase("build", start)
+			verbosef("Image built!")
+			images[i].ID = id
+		}
+		if Options.push {
+			for i, c := range contexts {
+				digest, err := retryPush(Options, c.Tag, func(tag string) (string, error) {
+					return commandPush(Options, Options.Backend, nil, tag)
+				})
+				if err != nil {
+					return nil, &DockerError{err}
+				}
+				infof("Image pushed: %s", c.Tag)
+				images[i].Digest = digest
+			}
+		}
+		if saving(Options) {
+			be := backends[Options.Backend]
+			err := saveImage(Options, commandSave(Options.Backend, append(be.save, Options.Tag), nil))
+			if err != nil {
+				return nil, &DockerError{err}
+			}
+		}
+		return images, nil
 	}
 
 	// Get the docker client name from the command line options
-	// (sdocker is the default)
-	dcmd := Options.Docker
+	// (docker is the default)
+	dcmd := dockerCommand(Options)
 	if dcmd == "" {
 		// If somehow not specified, throw an error
-		log.Printf("Missing Docker command")
-		os.Exit(5)
+		return nil, &UsageError{fmt.Errorf("Missing Docker command")}
 	}
 
-	if Options.Verbose {
-		log.Printf("Docker command used: %s", dcmd)
+	verbosef("Docker command used: %s", dcmd)
+	if dcmd == "sdocker" {
+		sdockerHint(Options)
+	}
+
+	// An explicitly specified Docker host overrides DOCKER_HOST.  If
+	// neither is given, see if we can find a local Docker environment
+	// (e.g., Docker Desktop or Colima on OSX)
+	dockerEnv := os.Environ()
+	dhost := os.Getenv("DOCKER_HOST")
+	if Options.Host != "" {
+		dhost = Options.Host
+		dockerEnv = append(dockerEnv, "DOCKER_HOST="+dhost)
+	} else if dhost == "" {
+		if denv := detectDockerEnvironment(); denv != nil {
+			dhost = "unix://" + denv.Socket
+			dockerEnv = append(dockerEnv, "DOCKER_HOST="+dhost)
+			verbosef("Found %s, using DOCKER_HOST=%s", denv.Name, dhost)
+
+			// Warn if the images we build won't run natively in it
+			if platformMismatch(platform.Arch) {
+				warnf("%s is running on %s, %s images will run under emulation",
+					denv.Name, runtime.GOARCH, platform)
+				warnf("  To run them, %s and use 'docker run --platform %s'", denv.Hint, platform)
+			}
+		}
 	}
 
 	// Check to see if this was just a dry run
-	if !Options.Dry {
-		// If not, time to build the docker image.
+	if Options.Dry {
+		return images, nil
+	}
 
-		// First, we determine the command line arguments to the
-		// docker build command
-		// TODO: Use go/parser to determine package name and auto-generate
-		// a tag (e.g., hidalgo/<pkgname>
-		args := []string{"build", "-"}
-		if Options.Tag != "" {
-			args = []string{"build", "-t", Options.Tag, "-"}
-		}
-		sbuild := exec.Command(dcmd, args...)
+	// The sdocker client works with remote Docker hosts and so it
+	// requires DOCKER_HOST.  Other clients (e.g., Docker Desktop) have
+	// their own defaults.
+	if dcmd == "sdocker" && dhost == "" {
+		return nil, &DockerError{fmt.Errorf("You must set the DOCKER_HOST environment variable to use sdocker")}
+	}
 
-		if Options.Verbose {
-			log.Printf("  Complete build command: '%s'", cmdString(sbuild))
+	// Rather than running the standard docker command, we talk to the
+	// Docker Engine API directly.  The same is true if a Docker host was
+	// given explicitly (since then no client is needed).  Other commands
+	// (e.g., sdocker) are always run, as is the docker command if
+	// DOCKER_HOST is something only it knows how to reach.
+	if dcmd == "docker" || Options.Host != "" {
+		engine, err := newEngineClient(dhost, Options)
+		if err == nil {
+			verbosef("Using the Docker Engine API at %s", engine.host)
+			for i, c := range contexts {
+				start := time.Now()
+				id, err := retryBuild(Options, c.Tag, func() (string, error) {
+					return engineBuild(engine, c, pname, buildArgs(Options), Options.record)
+				})
+				if err != nil {
+					return nil, &DockerError{err}
+				}
+				Options.record.phase("build", start)
+				verbosef("Image built: %s", id)
+				images[i].ID = id
+			}
+			if Options.push {
+				for i, c := range contexts {
+					digest, err := retryPush(Options, c.Tag, func(tag string) (string, error) {
+						auth, err := registryAuth(Options, tag)
+						if err != nil {
+							return "", err
+						}
+						digest, err := engine.push(tag, auth)
+						if err != nil {
+							return "", fmt.Errorf("Error pushing %s: %v", tag, err)
+						}
+						return digest, nil
+					})
+					if err != nil {
+						return nil, &DockerError{err}
+					}
+					infof("Image pushed: %s@%s", c.Tag, digest)
+					images[i].Digest = digest
+				}
+			}
+			if saving(Options) {
+				err := saveImage(Options, func(w io.Writer) error {
+					return engine.save(Options.Tag, w)
+				})
+				if err != nil {
+					return nil, &DockerError{err}
+				}
+			}
+			return images, nil
 		}
+		if Options.Host != "" {
+			return nil, &DockerError{err}
+		}
+		verbosef("Running the %s command: %v", dcmd, err)
+	}
 
-		// We also need to tar up our build directory to pass it to
-		// Docker.  This handles the case where the build is actually
-		// being performed on a remote machine.
-		tar := exec.Command("tar", "zcf", "-", ".")
+	// Otherwise, time to build the docker image(s) with the command
+	for i, c := range contexts {
+		start := time.Now()
+		id, err := retryBuild(Options, c.Tag, func() (string, error) {
+			return dockerBuild(dcmd, dockerEnv, c, pname, buildArgs(Options), Options.record)
+		})
+		if err != nil {
+			return nil, &DockerError{err}
+		}
+		Options.record.phase("build", start)
 
-		if Options.Verbose {
-			log.Printf("  Complete tar command: '%s'", cmdString(tar))
+		// It must have worked!
+		verbosef("Image built!")
+		images[i].ID = id
+	}
+	if Options.push {
+		for i, c := range contexts {
+			digest, err := retryPush(Options, c.Tag, func(tag string) (string, error) {
+				return commandPush(Options, dcmd, dockerEnv, tag)
+			})
+			if err != nil {
+				return nil, &DockerError{err}
+			}
+			infof("Image pushed: %s", c.Tag)
+			images[i].Digest = digest
+		}
+	}
+	if saving(Options) {
+		err := saveImage(Options, commandSave(dcmd, []string{"save", Options.Tag}, dockerEnv))
+		if err != nil {
+			return nil, &DockerError{err}
 		}
+	}
+	return images, nil
+}
 
-		// Create a pipe from tar to build
-		reader, writer := io.Pipe()
+// The dockerBuild function builds an image by running the docker command
+// (with the given environment and build arguments) and streaming the
+// build directory to it.  It returns the ID of the image that was built.
+func dockerBuild(dcmd string, dockerEnv []string, c buildContext, platform string, bargs map[string]string,
+	record *BuildRecord) (string, error) {
+	// First, we determine the command line arguments to the
+	// docker build command
+	// TODO: Use go/parser to determine package name and auto-generate
+	// a tag (e.g., hidalgo/<pkgname>
+	args := []string{"build"}
+	if c.Tag != "" {
+		args = append(args, "-t", c.Tag)
+	}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	for _, key := range sortedKeys(bargs) {
+		args = append(args, "--build-arg", key+"="+bargs[key])
+	}
+	iidfile, err := newIIDFile()
+	if err != nil {
+		return "", err
+	}
+	args = append(args, "--iidfile", iidfile, "-")
+	sbuild := exec.Command(dcmd, args...)
+	sbuild.Env = dockerEnv
 
-		// push first command output to writer
-		tar.Stdout = writer
+	debugf("  Complete build command: '%s'", cmdString(sbuild))
 
-		// read from first command output
-		sbuild.Stdin = reader
-		sbuild.Stdout = os.Stdout
+	// We also need to archive our build directory to pass it to
+	// Docker.  This handles the case where the build is actually
+	// being performed on a remote machine.
+	reader, err := contextArchive(c, record)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	// The output (which, with BuildKit, goes to stderr) is summarized
+	out := newBuildProgress()
+	sbuild.Stdin = reader
+	sbuild.Stdout = out
+	sbuild.Stderr = out
+
+	// Perform the build.  Any error archiving the build directory is
+	// reported as an error by the build as well.
+	err = sbuild.Run()
+	out.finish(err)
+	id := readIIDFile(iidfile)
+	if err != nil {
+		return "", fmt.Errorf("Error performing build: %v", err)
+	}
+	return id, nil
+}
 
-		// Start archiving the directory
-		tar.Start()
+// The build function builds the images for the packages in the given
+// directories (the current directory, if none are given) and returns the
+// exit status of the tool.  This is what hidalgo does if no command is
+// given (or with the build command).
+func build(Options Options, args []string) int {
+	// Profile hidalgo itself (if asked to)
+	stop, err := startCPUProfile(Options)
+	if err != nil {
+		return report(Options, "", &UsageError{err})
+	}
+	defer stop()
 
-		// Start the build
-		sbuild.Start()
+	// Now determine the packages to be built
+	dirs, err := packageDirs(args)
+	if err != nil {
+		return report(Options, "", &UsageError{err})
+	}
 
-		// Wait until the archiving is done
-		terr := tar.Wait()
+	// In watch mode, we keep rebuilding until interrupted
+	if Options.Watch {
+		if len(dirs) != 1 {
+			return report(Options, "", &UsageError{fmt.Errorf("Watch mode only supports a single directory")})
+		}
+		return watch(Options, dirs[0])
+	}
 
-		// Then close the writer
-		writer.Close()
+	// If there is only one package, just build it.  This is done in a
+	// separate function so that any deferred cleanup (e.g., removing
+	// the temporary build directory) happens before we exit.
+	if len(dirs) == 1 {
+		return reportWarnings(Options, run(Options, dirs[0]))
+	}
 
-		// Then wait until the build is done
-		serr := sbuild.Wait()
+	// Otherwise, build them all (concurrently)
+	return reportWarnings(Options, runAll(Options, dirs))
+}
 
-		// Check for errors
-		if terr != nil {
-			log.Printf("Error generating archive: %v", terr)
-			os.Exit(3)
-		}
-		if serr != nil {
-			log.Printf("Error performing build: %v", err)
-			os.Exit(3)
+// This is (obviously), the entry point for the tool
+func main() {
+	// Get command line options
+	var Options Options
+	// (errors are printed below, so that those from commands can be
+	// reported like any other)
+	parser := flags.NewParser(&Options, flags.Default&^flags.PrintErrors)
+	parser.Usage = "[OPTIONS] [Directories...]"
+
+	// The commands that build images report their own errors, so they
+	// record the exit status here (rather than returning an error)
+	status := ExitOK
+
+	// Commands other than building an image
+	parser.SubcommandsOptional = true
+	parser.AddCommand("build", "Build images (the default)",
+		"Build the images for the packages in the given directories (just like when no command is given)",
+		&BuildCommand{options: &Options, status: &status})
+	parser.AddCommand("push", "Build images and push them",
+		"Build the images for the packages in the given directories and push them to their registries",
+		&PushCommand{options: &Options, status: &status})
+	parser.AddCommand("run", "Build an image and run it",
+		"Build the image for a package and run it locally", &RunCommand{options: &Options, status: &status})
+	parser.AddCommand("clean", "Remove build directories",
+		"Remove the build directory given with -b or, if there isn't one, any build directories kept with -k",
+		&CleanCommand{options: &Options})
+	parser.AddCommand("inspect", "Show what would be built",
+		"Report (as JSON) what would be built for a package without building anything",
+		&InspectCommand{options: &Options})
+	parser.AddCommand("agent", "Run a build agent",
+		"Receive build contexts from hidalgo (over mutual TLS) and build the images locally", &AgentCommand{})
+	parser.AddCommand("template", "Work with Dockerfile templates",
+		"Check the Dockerfile template (given with --template) without building anything",
+		&TemplateCommand{Check: TemplateCheckCommand{options: &Options}})
+	parser.AddCommand("check", "Check the configuration of packages",
+		"Check the configuration of packages (without compiling anything or contacting Docker)",
+		&CheckCommand{options: &Options})
+	parser.AddCommand("lock", "Lock base images, Go and modules",
+		"Resolve the base images of packages to digests and record them (with the version of Go and the module hashes) in hidalgo.lock",
+		&LockCommand{options: &Options})
+	parser.AddCommand("init", "Write a starter configuration file",
+		"Write a hidalgo.cfg based on the environment variables the package reads and the ports it listens on",
+		&InitCommand{options: &Options})
+
+	args, err := parser.Parse()
+	if err != nil {
+		// Problems with the command line (and requests for help) are
+		// printed just as the parser would have.  Anything else came from
+		// a command, so it is reported (as JSON as well, if asked to)
+		// like the errors from a build.
+		if ferr, ok := err.(*flags.Error); ok {
+			if ferr.Type == flags.ErrHelp {
+				fmt.Fprintln(os.Stdout, ferr.Message)
+			} else {
+				fmt.Fprintln(os.Stderr, ferr.Message)
+			}
+			os.Exit(ExitUsage)
 		}
+		setLogLevel(Options)
+		os.Exit(report(Options, "", err))
+	}
+	setLogLevel(Options)
 
-		// It must have worked!
-		if Options.Verbose {
-			log.Printf("Image built!")
-		}
+	// If a command was given, it has already been executed
+	if parser.Active != nil {
+		os.Exit(status)
 	}
+
+	// Otherwise, build the images
+	os.Exit(build(Options, args))
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// These are the points in the build that hooks can be run at
+const (
+	// Once the build directory is created (before anything is compiled
+	// or the files are added)
+	preBuildHook = "pre-build"
+	// Once the image is built (and pushed, signed and reported on)
+	postBuildHook = "post-build"
+)
+
+// The validHook function determines whether hooks can be run at the
+// point in the build with the given name.
+func validHook(name string) bool {
+	return name == preBuildHook || name == postBuildHook
+}
+
+// The mergeHooks function combines the hooks in two configurations (with
+// those in the second run after those in the first).
+func mergeHooks(base map[string][]string, m map[string][]string) map[string][]string {
+	if len(base) == 0 {
+		return m
+	}
+	ret := map[string][]string{}
+	for name, cmds := range base {
+		ret[name] = append([]string{}, cmds...)
+	}
+	for name, cmds := range m {
+		ret[name] = append(ret[name], cmds...)
+	}
+	return ret
+}
+
+// The shellCommand function returns a command that runs the given
+// command line with the shell, i.e., 'sh -c' (or 'cmd /C' on Windows,
+// which doesn't have sh).
+func shellCommand(line string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", line)
+	}
+	return exec.Command("sh", "-c", line)
+}
+
+// The runHooks function runs the hooks the configuration gives for the
+// point in the build with the given name (in order).  Each command is
+// run by the shell in the package directory, with the build directory,
+// the tag, the package and the platform (and, once it is built, the ID
+// of the image) in its environment.  If any of them fails, the build
+// fails.
+func runHooks(Options Options, config Config, which string, apdir string, name string,
+	platform Platform, dir string, id string) error {
+	env := append(os.Environ(),
+		"HIDALGO_BUILD_DIR="+dir,
+		"HIDALGO_TAG="+Options.Tag,
+		"HIDALGO_PACKAGE="+name,
+		"HIDALGO_PLATFORM="+platform.String(),
+		"HIDALGO_IMAGE_ID="+id)
+	for _, hook := range config.Hooks[which] {
+		cmd := shellCommand(hook)
+		cmd.Env = env
+		err := check(fmt.Sprintf("%s hook", which), cmd, apdir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
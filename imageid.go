@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// The newIIDFile function returns the name of a (new, empty) temporary
+// file that a build command can write the ID of the image it builds to
+// (with --iidfile).
+func newIIDFile() (string, error) {
+	f, err := ioutil.TempFile("", "hidalgo-iid")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create image ID file: %v", err)
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// The readIIDFile function reads (and removes) a file written with
+// --iidfile (or --digestfile).  If there is nothing in it, the ID is
+// unknown.
+func readIIDFile(name string) string {
+	defer os.Remove(name)
+	contents, err := ioutil.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+// This matches the line in the output of 'docker push' that gives the
+// digest of the image that was pushed
+var pushDigest = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+
+// A digestWriter passes the output of a push along and records the
+// digest of the image that was pushed (if the output includes it).
+type digestWriter struct {
+	w      io.Writer
+	digest string
+}
+
+// The Write method passes the output along, looking for the digest.
+func (d *digestWriter) Write(p []byte) (int, error) {
+	if m := pushDigest.FindSubmatch(p); m != nil {
+		d.digest = string(m[1])
+	}
+	return d.w.Write(p)
+}
+
+// The reportImages function reports the IDs of the images that were
+// built.  They are written to stdout (one per line, for scripts, unless
+// the results are written as JSON) and the ID of the image itself (i.e.,
+// not its debug variant) is written to the file given with --iidfile
+// (if any).
+func reportImages(Options Options, images []builtImage) error {
+	for _, image := range images {
+		if image.ID == "" {
+			continue
+		}
+		if image.Digest != "" {
+			infof("Image %s: %s (pushed as %s)", image.Tag, image.ID, image.Digest)
+		} else if image.Tag != "" {
+			infof("Image %s: %s", image.Tag, image.ID)
+		}
+		if !jsonOutput(Options) {
+			fmt.Println(image.ID)
+		}
+	}
+
+	if Options.IIDFile == "" {
+		return nil
+	}
+	if images[0].ID == "" {
+		return fmt.Errorf("The ID of the image is unknown, so it can't be written to %s", Options.IIDFile)
+	}
+	err := ioutil.WriteFile(Options.IIDFile, []byte(images[0].ID), 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing image ID to %s: %v", Options.IIDFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"path/filepath"
+)
+
+// The include method reads the configuration files included by the
+// configuration in cfile (in order) and bases the configuration on them.
+// Each included file is the base for the ones after it (and the
+// configuration itself).
+func (c Config) include(cfile string, including []string) (Config, error) {
+	if len(c.Includes) == 0 {
+		return c, nil
+	}
+	base := Config{}
+	for _, inc := range c.Includes {
+		name := includePath(cfile, inc)
+		verbosef("  Including configuration file %s", name)
+		config, err := readConfigFile(name, including)
+		if err != nil {
+			return c, err
+		}
+		base = config.over(base)
+	}
+	c.Includes = nil
+	return c.over(base), nil
+}
+
+// The includePath function returns the file that the configuration in
+// cfile refers to with inc (which is relative to the directory cfile is
+// in, unless it is absolute).
+func includePath(cfile string, inc string) string {
+	if filepath.IsAbs(inc) {
+		return inc
+	}
+	return filepath.Join(filepath.Dir(cfile), filepath.FromSlash(inc))
+}
+
+// The includedFiles function returns the configuration files that the
+// configuration in cfile includes (directly or indirectly).  Files that
+// can't be read are included in the list, but not what they include.
+func includedFiles(cfile string, including []string) []string {
+	for _, f := range including {
+		if f == cfile {
+			return nil
+		}
+	}
+	config, err := parseConfigFile(cfile)
+	if err != nil {
+		return nil
+	}
+	ret := []string{}
+	for _, inc := range config.Includes {
+		name := includePath(cfile, inc)
+		ret = append(ret, name)
+		ret = append(ret, includedFiles(name, append(including, cfile))...)
+	}
+	return ret
+}
+
+// The over method returns the configuration with anything it doesn't
+// give taken from the base configuration.  Lists (e.g., of environment
+// variables and ports) are combined, maps (e.g., of base images and
+// jobs) are combined with the values in the configuration taking
+// precedence, and single values (e.g., the version) are taken from the
+// base unless the configuration gives them.  The arguments are a single
+// value as well (since they are only meaningful together).
+func (c Config) over(base Config) Config {
+	ret := c
+	ret.Files = append(append([]File{}, base.Files...), c.Files...)
+	ret.Env = appendMissing(append([]string{}, base.Env...), c.Env)
+	ret.Required = appendMissing(append([]string{}, base.Required...), c.Required)
+	ret.Ports = mergePorts(append([]Port{}, c.Ports...), base.Ports)
+	ret.Volumes = appendMissing(append([]string{}, base.Volumes...), c.Volumes)
+	ret.Packages = appendMissing(append([]string{}, base.Packages...), c.Packages)
+	ret.When = append(append([]Conditional{}, base.When...), c.When...)
+
+	if c.Args == nil {
+		ret.Args = base.Args
+	}
+	if c.Harness == nil {
+		ret.Harness = base.Harness
+	}
+	if c.Default == "" {
+		ret.Default = base.Default
+	}
+	if c.Version == "" {
+		ret.Version = base.Version
+	}
+	if c.Binary == "" {
+		ret.Binary = base.Binary
+	}
+	if c.BinDir == "" {
+		ret.BinDir = base.BinDir
+	}
+	if c.FileDest == "" {
+		ret.FileDest = base.FileDest
+	}
+	if c.Lint == "" {
+		ret.Lint = base.Lint
+	}
+	if c.Build == "" {
+		ret.Build = base.Build
+		ret.BuildOutput = base.BuildOutput
+	}
+	if c.Tag == "" {
+		ret.Tag = base.Tag
+	}
+	// There's no telling whether false was given or not
+	ret.Entrypoint = c.Entrypoint || base.Entrypoint
+	ret.Test = c.Test || base.Test
+	ret.Generate = c.Generate || base.Generate
+	ret.Vet = c.Vet || base.Vet
+	ret.Certs = c.Certs || base.Certs
+	ret.Tzdata = c.Tzdata || base.Tzdata
+
+	ret.From = mergeMap(base.From, c.From)
+	ret.Jobs = mergeMap(base.Jobs, c.Jobs)
+	ret.BuildArgs = mergeMap(base.BuildArgs, c.BuildArgs)
+	ret.Vars = mergeMap(base.Vars, c.Vars)
+	ret.Hooks = mergeHooks(base.Hooks, c.Hooks)
+	if len(base.Registries) > 0 {
+		ret.Registries = map[string]Registry{}
+		for host, r := range base.Registries {
+			ret.Registries[host] = r
+		}
+		for host, r := range c.Registries {
+			ret.Registries[host] = r
+		}
+	}
+	if len(base.Profiles) > 0 {
+		ret.Profiles = map[string]Profile{}
+		for name, p := range base.Profiles {
+			ret.Profiles[name] = p
+		}
+		for name, p := range c.Profiles {
+			ret.Profiles[name] = p
+		}
+	}
+	return ret
+}
+
+// The mergeMap function combines two maps (with the values in the second
+// taking precedence).
+func mergeMap(base map[string]string, m map[string]string) map[string]string {
+	if len(base) == 0 {
+		return m
+	}
+	ret := map[string]string{}
+	for k, v := range base {
+		ret[k] = v
+	}
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// InitCommand describes 'hidalgo init', which writes a starter
+// hidalgo.cfg for a package based on the environment variables it reads
+// and the ports it listens on.
+type InitCommand struct {
+	Force bool `long:"force" description:"Overwrite an existing configuration file"`
+
+	// The (global) options hidalgo was run with
+	options *Options
+}
+
+// These are the functions whose (first) argument is the name of an
+// environment variable, by package
+var envFuncs = map[string][]string{
+	"os":      {"Getenv", "LookupEnv"},
+	"syscall": {"Getenv"},
+}
+
+// These are the functions whose argument (given by its index) is an
+// address to listen on, by package.  The protocol is tcp unless the
+// network is given as the first argument.
+var listenFuncs = map[string]map[string]int{
+	"net/http": {"ListenAndServe": 0, "ListenAndServeTLS": 0},
+	"net":      {"Listen": 1, "ListenPacket": 1},
+}
+
+// The detected structure records what was found in the package
+type detected struct {
+	// The environment variables read by the package
+	env map[string]bool
+	// The ports the package listens on
+	ports map[string]Port
+}
+
+// The Execute method writes the configuration file for the package in
+// the given directory (or the current directory).  For dry runs, it is
+// written to stdout instead.
+func (c *InitCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	if len(args) > 1 {
+		return &UsageError{fmt.Errorf("Only one package can be initialized at a time")}
+	}
+	dir := "."
+	if len(args) == 1 {
+		dir = args[0]
+	}
+
+	// Don't replace (or hide) an existing configuration file unless asked
+	// to
+	if !Options.Dry && !c.Force {
+		for _, name := range configFiles {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return &UsageError{fmt.Errorf("Configuration file %s already exists (use --force to replace it)",
+					filepath.Join(dir, name))}
+			}
+		}
+	}
+
+	found, err := detect(dir)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Unable to inspect package in %s: %v", dir, err)}
+	}
+	contents := found.config()
+
+	if Options.Dry {
+		fmt.Print(contents)
+		return nil
+	}
+	cfile := filepath.Join(dir, "hidalgo.cfg")
+	err = ioutil.WriteFile(cfile, []byte(contents), 0644)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Error writing %s: %v", cfile, err)}
+	}
+	infof("Wrote %s (%d environment variables, %d ports)", cfile, len(found.env), len(found.ports))
+	return nil
+}
+
+// The detect function parses the (non-test) Go files in dir and looks
+// for the environment variables they read and the ports they listen on.
+// Only names and addresses given as string literals can be detected.
+func detect(dir string) (detected, error) {
+	ret := detected{env: map[string]bool{}, ports: map[string]Port{}}
+
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return ret, err
+	}
+	if len(pkgs) == 0 {
+		return ret, fmt.Errorf("No Go files found")
+	}
+
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			imports := importNames(file)
+			ast.Inspect(file, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.CallExpr:
+					ret.call(fset, imports, n)
+				case *ast.CompositeLit:
+					ret.server(imports, n)
+				}
+				return true
+			})
+		}
+	}
+	return ret, nil
+}
+
+// The importNames function returns the path of each package imported by
+// the file, by the name it is referred to with.
+func importNames(file *ast.File) map[string]string {
+	ret := map[string]string{}
+	for _, imp := range file.Imports {
+		p, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+		name := p[strings.LastIndex(p, "/")+1:]
+		if imp.Name != nil {
+			name = imp.Name.Name
+		}
+		ret[name] = p
+	}
+	return ret
+}
+
+// The qualified function returns the package path and name of a
+// (package qualified) function or type, e.g., os.Getenv.
+func qualified(imports map[string]string, expr ast.Expr) (string, string) {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return "", ""
+	}
+	id, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", ""
+	}
+	return imports[id.Name], sel.Sel.Name
+}
+
+// The stringLiteral function returns the value of a string literal (and
+// false if the expression isn't one).
+func stringLiteral(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// The call method records any environment variable read (or address
+// listened on) by a function call.
+func (d detected) call(fset *token.FileSet, imports map[string]string, call *ast.CallExpr) {
+	pkg, fn := qualified(imports, call.Fun)
+	if pkg == "" {
+		return
+	}
+
+	for _, f := range envFuncs[pkg] {
+		if f == fn && len(call.Args) > 0 {
+			if name, ok := stringLiteral(call.Args[0]); ok {
+				d.env[name] = true
+			} else {
+				verbosef("  Environment variable name at %s is not a literal", fset.Position(call.Pos()))
+			}
+		}
+	}
+
+	if i, exists := listenFuncs[pkg][fn]; exists && len(call.Args) > i {
+		proto := "tcp"
+		if i > 0 {
+			proto, _ = stringLiteral(call.Args[0])
+		}
+		if addr, ok := stringLiteral(call.Args[i]); ok {
+			d.listen(proto, addr)
+		} else {
+			verbosef("  Address at %s is not a literal", fset.Position(call.Pos()))
+		}
+	}
+}
+
+// The server method records the address of an http.Server literal.
+func (d detected) server(imports map[string]string, lit *ast.CompositeLit) {
+	if pkg, name := qualified(imports, lit.Type); pkg != "net/http" || name != "Server" {
+		return
+	}
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Addr" {
+			if addr, ok := stringLiteral(kv.Value); ok {
+				d.listen("tcp", addr)
+			}
+		}
+	}
+}
+
+// The listen method records the port in an address (e.g., :8080) that
+// is listened on with the given network (e.g., tcp4 or udp).
+func (d detected) listen(network string, addr string) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	num, err := strconv.Atoi(port)
+	if err != nil || num == 0 {
+		return
+	}
+	p := Port{Number: num}
+	if strings.HasPrefix(network, "udp") {
+		p.Protocol = "udp"
+	}
+	d.ports[p.String()] = p
+}
+
+// The config method generates the contents of the configuration file.
+func (d detected) config() string {
+	lines := []string{"// Generated by 'hidalgo init' (review and edit as needed)"}
+
+	names := []string{}
+	for name := range d.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		lines = append(lines, "")
+	}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("env %s;", name))
+	}
+
+	ports := []Port{}
+	for _, p := range d.ports {
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Number != ports[j].Number {
+			return ports[i].Number < ports[j].Number
+		}
+		return ports[i].Protocol < ports[j].Protocol
+	})
+	if len(ports) > 0 {
+		lines = append(lines, "")
+	}
+	for _, p := range ports {
+		if p.Protocol == "" {
+			lines = append(lines, fmt.Sprintf("port %d;", p.Number))
+		} else {
+			lines = append(lines, fmt.Sprintf("port '%s';", p))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
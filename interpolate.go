@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The expandEnv function expands the references to environment variables
+// (${NAME}, or ${NAME:-default} to give a default for when it isn't set)
+// in a value from the configuration file.  A reference to a variable that
+// isn't set (and has no default) is an error.  References to the given
+// build arguments are left for Docker to substitute, and $$ is a literal
+// '$'.
+func expandEnv(value string, args map[string]string) (string, error) {
+	buf := bytes.Buffer{}
+	for i := 0; i < len(value); i++ {
+		rest := value[i:]
+		switch {
+		case strings.HasPrefix(rest, "$$"):
+			buf.WriteByte('$')
+			i++
+		case strings.HasPrefix(rest, "${"):
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return "", fmt.Errorf("Unterminated reference in %q", value)
+			}
+			name, def, hasDef := rest[2:end], "", false
+			if j := strings.Index(name, ":-"); j >= 0 {
+				name, def, hasDef = name[:j], name[j+2:], true
+			}
+			if !buildArgName.MatchString(name) {
+				return "", fmt.Errorf("Invalid reference %s in %q", rest[:end+1], value)
+			}
+			if _, isArg := args[name]; isArg {
+				buf.WriteString(rest[:end+1])
+			} else if env := os.Getenv(name); env != "" {
+				buf.WriteString(env)
+			} else if hasDef {
+				buf.WriteString(def)
+			} else {
+				return "", fmt.Errorf("Environment variable %s (referred to in %q) is not set (use ${%s:-default} to give a default)",
+					name, value, name)
+			}
+			i += end
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String(), nil
+}
+
+// These are the environment variables that hooks and the build command
+// are run with (see runHooks and runBuild), which references to in them
+// are left for the shell to substitute
+var commandVars = map[string]string{
+	"HIDALGO_BUILD_DIR": "",
+	"HIDALGO_TAG":       "",
+	"HIDALGO_PACKAGE":   "",
+	"HIDALGO_PLATFORM":  "",
+	"HIDALGO_IMAGE_ID":  "",
+	"HIDALGO_OUTPUT":    "",
+	"HIDALGO_LDFLAGS":   "",
+	"GOOS":              "",
+	"GOARCH":            "",
+	"GOARM":             "",
+	"GOAMD64":           "",
+	"GORISCV64":         "",
+	"CGO_ENABLED":       "",
+}
+
+// The expand method expands the references to environment variables in
+// the values in the configuration (see expandEnv).  Names (e.g., of
+// environment variables, jobs or profiles) are left alone, as are the
+// credentials of registries (which are only expanded when they are used,
+// see registryAuth).  The configuration it returns has its own copies of
+// any lists and maps that were expanded (so c is left as it was).
+func (c Config) expand() (Config, error) {
+	var err error
+	expandWith := func(s string, args map[string]string) string {
+		if err != nil {
+			return s
+		}
+		var ret string
+		ret, err = expandEnv(s, args)
+		return ret
+	}
+	str := func(s string) string {
+		return expandWith(s, c.BuildArgs)
+	}
+	command := func(s string) string {
+		return expandWith(s, commandVars)
+	}
+	list := func(l []string) []string {
+		if l == nil {
+			return nil
+		}
+		ret := make([]string, len(l))
+		for i := range l {
+			ret[i] = str(l[i])
+		}
+		return ret
+	}
+	values := func(m map[string]string) map[string]string {
+		if m == nil {
+			return nil
+		}
+		ret := map[string]string{}
+		for k, v := range m {
+			ret[k] = str(v)
+		}
+		return ret
+	}
+	files := func(l []File) []File {
+		if l == nil {
+			return nil
+		}
+		ret := make([]File, len(l))
+		for i, f := range l {
+			f.Src = str(f.Src)
+			f.Dest = str(f.Dest)
+			f.Owner = str(f.Owner)
+			ret[i] = f
+		}
+		return ret
+	}
+	ports := func(l []Port) []Port {
+		if l == nil {
+			return nil
+		}
+		ret := make([]Port, len(l))
+		for i, p := range l {
+			p.Name = str(p.Name)
+			ret[i] = p
+		}
+		return ret
+	}
+
+	c.Files = files(c.Files)
+	c.FileDest = str(c.FileDest)
+	c.Binary = str(c.Binary)
+	c.BinDir = str(c.BinDir)
+	c.Ports = ports(c.Ports)
+	c.Volumes = list(c.Volumes)
+	c.Args = list(c.Args)
+	c.Harness = list(c.Harness)
+	c.Packages = list(c.Packages)
+	c.Version = str(c.Version)
+	c.Lint = str(c.Lint)
+	c.Build = command(c.Build)
+	c.BuildOutput = str(c.BuildOutput)
+	c.From = values(c.From)
+	c.BuildArgs = values(c.BuildArgs)
+	c.Vars = values(c.Vars)
+	c.Jobs = values(c.Jobs)
+
+	if c.Hooks != nil {
+		hooks := map[string][]string{}
+		for name, cmds := range c.Hooks {
+			hooks[name] = make([]string, len(cmds))
+			for i, cmd := range cmds {
+				hooks[name][i] = command(cmd)
+			}
+		}
+		c.Hooks = hooks
+	}
+	if c.When != nil {
+		when := make([]Conditional, len(c.When))
+		for i, w := range c.When {
+			w.Files = files(w.Files)
+			w.Ports = ports(w.Ports)
+			w.Volumes = list(w.Volumes)
+			w.Packages = list(w.Packages)
+			when[i] = w
+		}
+		c.When = when
+	}
+	if c.Profiles != nil {
+		profiles := map[string]Profile{}
+		for name, p := range c.Profiles {
+			p.Ports = ports(p.Ports)
+			p.From = values(p.From)
+			p.Tag = str(p.Tag)
+			profiles[name] = p
+		}
+		c.Profiles = profiles
+	}
+	return c, err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExpandLeavesConfigAlone(t *testing.T) {
+	os.Setenv("HIDALGO_TEST_DIR", "/data")
+	defer os.Unsetenv("HIDALGO_TEST_DIR")
+
+	c := Config{
+		Files:    []File{{Src: "${HIDALGO_TEST_DIR}/a"}},
+		Volumes:  []string{"${HIDALGO_TEST_DIR}"},
+		Vars:     map[string]string{"dir": "${HIDALGO_TEST_DIR}"},
+		When:     []Conditional{{If: "env=X", Volumes: []string{"${HIDALGO_TEST_DIR}/x"}}},
+		Profiles: map[string]Profile{"prod": {Tag: "app:${HIDALGO_TEST_DIR:-x}"}},
+		Hooks:    map[string][]string{preBuildHook: {"cp ${HIDALGO_TEST_DIR}/a ${HIDALGO_BUILD_DIR}"}},
+		Build:    "go build -o ${HIDALGO_OUTPUT} ${HIDALGO_TEST_DIR}",
+	}
+	before := Config{
+		Files:    []File{{Src: "${HIDALGO_TEST_DIR}/a"}},
+		Volumes:  []string{"${HIDALGO_TEST_DIR}"},
+		Vars:     map[string]string{"dir": "${HIDALGO_TEST_DIR}"},
+		When:     []Conditional{{If: "env=X", Volumes: []string{"${HIDALGO_TEST_DIR}/x"}}},
+		Profiles: map[string]Profile{"prod": {Tag: "app:${HIDALGO_TEST_DIR:-x}"}},
+		Hooks:    map[string][]string{preBuildHook: {"cp ${HIDALGO_TEST_DIR}/a ${HIDALGO_BUILD_DIR}"}},
+		Build:    "go build -o ${HIDALGO_OUTPUT} ${HIDALGO_TEST_DIR}",
+	}
+
+	e, err := c.expand()
+	if err != nil {
+		t.Fatalf("Expanding failed: %v", err)
+	}
+	if !reflect.DeepEqual(c, before) {
+		t.Errorf("Expanding changed the configuration it was called on:\n%+v", c)
+	}
+
+	checks := []struct {
+		what string
+		got  string
+		want string
+	}{
+		{"file", e.Files[0].Src, "/data/a"},
+		{"volume", e.Volumes[0], "/data"},
+		{"var", e.Vars["dir"], "/data"},
+		{"when", e.When[0].Volumes[0], "/data/x"},
+		{"profile", e.Profiles["prod"].Tag, "app:/data"},
+		{"hook", e.Hooks[preBuildHook][0], "cp /data/a ${HIDALGO_BUILD_DIR}"},
+		{"build", e.Build, "go build -o ${HIDALGO_OUTPUT} /data"},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("Expanded %s is %q, expected %q", c.what, c.got, c.want)
+		}
+	}
+}
+
+func TestExpandCommandsRequireVariables(t *testing.T) {
+	os.Unsetenv("HIDALGO_TEST_UNSET")
+	c := Config{Hooks: map[string][]string{postBuildHook: {"echo ${HIDALGO_TEST_UNSET}"}}}
+	if _, err := c.expand(); err == nil {
+		t.Errorf("Expected an error for a hook referring to an unset variable")
+	}
+}
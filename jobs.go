@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Job names become part of an image name, so they are restricted to what
+// Docker allows in one
+var jobName = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+
+// The jobTag function returns the tag for the image of the named job
+// that goes with the image with the given tag (e.g., the migrate job for
+// registry/app:1.2 is registry/app-migrate:1.2).  If the image isn't
+// tagged, neither are its jobs.
+func jobTag(tag string, job string) string {
+	if tag == "" {
+		return ""
+	}
+	// A ':' after the last '/' separates the tag from the name (any
+	// other ':' is part of a registry host name)
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		return tag[:i] + "-" + job + tag[i:]
+	}
+	return tag + "-" + job
+}
+
+// The buildJobs function builds the images for the jobs (e.g., database
+// migrations) that go with the image for the package in apdir.  Each job
+// is a separate package (given relative to apdir) and is built with the
+// same options as the image itself (apart from the tag).
+func buildJobs(Options Options, apdir string, config Config) error {
+	// Jobs (and harnesses) don't have jobs of their own
+	if Options.job || Options.Harness || len(config.Jobs) == 0 {
+		return nil
+	}
+
+	// Build them in a predictable order
+	names := []string{}
+	for name := range config.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		jdir := filepath.FromSlash(config.Jobs[name])
+		if !filepath.IsAbs(jdir) {
+			jdir = filepath.Join(apdir, jdir)
+		}
+
+		opts := Options
+		opts.job = true
+		opts.Tag = jobTag(Options.Tag, name)
+		// Each job needs its own build directory...
+		if opts.Build != "" {
+			opts.Build = filepath.Join(opts.Build, "job-"+name)
+		}
+		// ...and only the image itself is written to these files (and
+		// summarized)
+		opts.DOut = ""
+		opts.SaveTo = ""
+		opts.OCILayout = ""
+		opts.SaveOnly = opts.SaveOnly && saving(opts)
+		opts.Summary = ""
+		opts.GitHubPR = 0
+		opts.Report = ""
+
+		infof("Building job %s (%s)", name, jdir)
+		// The error is returned as is (so the exit status reflects what
+		// went wrong)
+		err := buildImage(opts, jdir)
+		if err != nil {
+			errorf("Unable to build job %s", name)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The readLabelFiles function reads the labels in the given files (which
+// are typically generated by CI, e.g., with the ticket the build is for
+// or the URL of the pipeline).  Each file is a JSON or YAML object of
+// keys and values.  If a label is in several files, the last one wins.
+func readLabelFiles(names []string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read label file: %v", err)
+		}
+		// YAML is a superset of JSON, so this reads both
+		labels := map[string]string{}
+		err = yaml.Unmarshal(data, &labels)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading label file %s: %v", name, err)
+		}
+		// Make sure they can be written to the Dockerfile (before the
+		// time consuming build)
+		for key, value := range labels {
+			if _, err := dockerKey(key); err != nil {
+				return nil, fmt.Errorf("Error in label file %s: %v", name, err)
+			}
+			if _, err := dockerQuote(value); err != nil {
+				return nil, fmt.Errorf("Error in label file %s: label %s: %v", name, key, err)
+			}
+			ret[key] = value
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// This is the file (in the package directory) that 'hidalgo lock'
+// records the inputs of the build in
+const lockFile = "hidalgo.lock"
+
+// A Lock records the inputs of a build that can change without the
+// package (or its configuration) changing, so that later builds use
+// exactly the same ones.
+type Lock struct {
+	// The base images (as given with --from or in the configuration) and
+	// the digests they resolved to
+	Base map[string]string `json:"base"`
+	// The version of Go (e.g., go1.22.1)
+	Go string `json:"go"`
+	// The hashes (from go.sum) of the modules the package depends on, by
+	// path@version
+	Modules map[string]string `json:"modules,omitempty"`
+}
+
+// The readLock function reads the lock file in the package directory (if
+// there is one).
+func readLock(apdir string) (*Lock, error) {
+	file := filepath.Join(apdir, lockFile)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", file, err)
+	}
+	return lock, nil
+}
+
+// The packageGoEnv function returns the value of a Go environment
+// variable as the go command sees it in the package directory (which
+// may differ from ours, e.g., because of the toolchain its go.mod asks
+// for).
+func packageGoEnv(apdir string, name string) (string, error) {
+	cmd := exec.Command("go", "env", name)
+	cmd.Dir = apdir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Unable to determine %s: %v", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// The goModules function returns the hashes of the modules the package
+// in apdir depends on (from the go.sum of its module).  A package that
+// isn't in a module (or has no dependencies) has none.
+func goModules(apdir string) (map[string]string, error) {
+	ret := map[string]string{}
+	gomod, err := packageGoEnv(apdir, "GOMOD")
+	if err != nil {
+		return nil, err
+	}
+	if gomod == "" || gomod == os.DevNull {
+		return ret, nil
+	}
+	f, err := os.Open(filepath.Join(filepath.Dir(gomod), "go.sum"))
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Each line is 'path version hash', and there is a line for the
+	// go.mod of each module as well (which we don't need)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		ret[fields[0]+"@"+fields[1]] = fields[2]
+	}
+	return ret, scanner.Err()
+}
+
+// The resolveDigest function asks the registry of the given image for
+// the digest it currently refers to.  For an image with several
+// platforms, this is the digest of the whole list (so it works for any
+// of them).
+func resolveDigest(image string) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", fmt.Errorf("Invalid base image %s: %v", image, err)
+	}
+	desc, err := remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve base image %s: %v", image, err)
+	}
+	return desc.Digest.String(), nil
+}
+
+// The lockedImages function returns the base images a build of the
+// package could use (for any of the platforms in its configuration, and
+// the ones given in the options).  Images that are already pinned to a
+// digest (and scratch) don't need to be locked.
+func lockedImages(Options Options, config Config) ([]string, error) {
+	platforms := []Platform{}
+	if Options.Platforms != "" {
+		list, err := parsePlatforms(Options.Platforms)
+		if err != nil {
+			return nil, err
+		}
+		platforms = list
+	} else {
+		platform, err := parsePlatform(Options.Platform)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, platform)
+	}
+
+	images := map[string]bool{}
+	for _, p := range platforms {
+		images[baseImage(Options, config, p)] = true
+	}
+	for _, from := range config.From {
+		images[from] = true
+	}
+	ret := []string{}
+	for image := range images {
+		if image != "scratch" && !strings.Contains(image, "@") {
+			ret = append(ret, image)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// The applyLock function checks that the build of the package in apdir
+// uses the same version of Go and the same modules as recorded in its
+// lock file (if it has one) and returns the base image (from) pinned to
+// the digest recorded for it.
+func applyLock(apdir string, from string) (string, error) {
+	lock, err := readLock(apdir)
+	if err != nil || lock == nil {
+		return from, err
+	}
+
+	version, err := packageGoEnv(apdir, "GOVERSION")
+	if err != nil {
+		return from, err
+	}
+	if version != lock.Go {
+		return from, fmt.Errorf("%s was locked with %s, not %s (run 'hidalgo lock' to update it)", lockFile, lock.Go, version)
+	}
+
+	modules, err := goModules(apdir)
+	if err != nil {
+		return from, err
+	}
+	changed := []string{}
+	for module, hash := range modules {
+		if lock.Modules[module] != hash {
+			changed = append(changed, module)
+		}
+	}
+	for module := range lock.Modules {
+		if _, exists := modules[module]; !exists {
+			changed = append(changed, module)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		return from, fmt.Errorf("The modules don't match %s: %s (run 'hidalgo lock' to update it)",
+			lockFile, strings.Join(changed, ", "))
+	}
+
+	if from == "scratch" || strings.Contains(from, "@") {
+		return from, nil
+	}
+	digest, exists := lock.Base[from]
+	if !exists {
+		return from, fmt.Errorf("Base image %s isn't in %s (run 'hidalgo lock' to add it)", from, lockFile)
+	}
+	verbosef("Using %s@%s (from %s)", from, digest, lockFile)
+	return from + "@" + digest, nil
+}
+
+// LockCommand describes 'hidalgo lock', which resolves the base images
+// of packages to digests and records them (along with the version of Go
+// and the modules they depend on) in a lock file that later builds use.
+type LockCommand struct {
+	// The (global) options hidalgo was run with
+	options *Options
+}
+
+// The Execute method writes the lock files for the packages in the given
+// directories (or the current directory).  For dry runs, they are written
+// to stdout instead.
+func (c *LockCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	dirs, err := packageDirs(args)
+	if err != nil {
+		return &UsageError{err}
+	}
+	for _, dir := range dirs {
+		err := lockPackage(Options, dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The lockPackage function writes the lock file for the package in
+// pdir.
+func lockPackage(Options Options, pdir string) error {
+	apdir, _, err := packageName(pdir)
+	if err != nil {
+		return &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+
+	// Resolve the base images...
+	lock := Lock{Base: map[string]string{}}
+	images, err := lockedImages(Options, config)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	for _, image := range images {
+		digest, err := resolveDigest(image)
+		if err != nil {
+			return &DockerError{err}
+		}
+		verbosef("%s: %s", image, digest)
+		lock.Base[image] = digest
+	}
+
+	// ...and record the version of Go and the modules
+	lock.Go, err = packageGoEnv(apdir, "GOVERSION")
+	if err != nil {
+		return &BuildError{err}
+	}
+	lock.Modules, err = goModules(apdir)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Unable to read the module hashes: %v", err)}
+	}
+
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return &BuildError{err}
+	}
+	data = append(data, '\n')
+	if Options.Dry {
+		fmt.Print(string(data))
+		return nil
+	}
+	file := filepath.Join(apdir, lockFile)
+	err = ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Error writing %s: %v", file, err)}
+	}
+	infof("Wrote %s (%d base images, %d modules)", file, len(lock.Base), len(lock.Modules))
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Level is the amount of diagnostic output to produce
+type Level int
+
+const (
+	// Only errors (--quiet)
+	LevelQuiet Level = iota
+	// Errors, warnings and progress messages (the default)
+	LevelNormal
+	// Details of what is being built (-v)
+	LevelVerbose
+	// Complete commands and generated files (-vv)
+	LevelDebug
+	// All the output of the commands that are run (-vvv)
+	LevelTrace
+)
+
+// All diagnostics go to os.Stderr so that os.Stdout only carries output
+// that is meant to be consumed by other programs (e.g., the Dockerfile).
+var logger = log.New(os.Stderr, "", log.LstdFlags)
+
+// This is the current level of diagnostic output
+var logLevel = LevelNormal
+
+// The setLogLevel function determines the level of diagnostic output
+// from the command line options.
+func setLogLevel(Options Options) {
+	switch {
+	case Options.Quiet:
+		logLevel = LevelQuiet
+	case len(Options.Verbose) >= 3:
+		logLevel = LevelTrace
+	case len(Options.Verbose) == 2:
+		logLevel = LevelDebug
+	case len(Options.Verbose) == 1:
+		logLevel = LevelVerbose
+	default:
+		logLevel = LevelNormal
+	}
+}
+
+// The logAt function returns true if output at the given level should
+// be produced.
+func logAt(level Level) bool {
+	return logLevel >= level
+}
+
+// The errorf function reports an error (these are always reported)
+func errorf(format string, args ...interface{}) {
+	logger.Printf(format, args...)
+}
+
+// These are the warnings reported so far (so they can be summarized
+// when the build is done).  Packages are built concurrently, so access
+// to them is synchronized.
+var (
+	warnings     []string
+	warningsLock sync.Mutex
+)
+
+// The warnf function reports a problem that doesn't stop the build.  It
+// is recorded (even if it isn't reported) unless it is just the details
+// of the previous warning (which are indented).
+func warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !strings.HasPrefix(msg, " ") {
+		warningsLock.Lock()
+		warnings = append(warnings, msg)
+		warningsLock.Unlock()
+	}
+	if logAt(LevelNormal) {
+		logger.Print("Warning: " + msg)
+	}
+}
+
+// The takeWarnings function returns the warnings reported so far (and
+// forgets them).
+func takeWarnings() []string {
+	warningsLock.Lock()
+	defer warningsLock.Unlock()
+	ret := warnings
+	warnings = nil
+	return ret
+}
+
+// The infof function reports the progress of the build
+func infof(format string, args ...interface{}) {
+	if logAt(LevelNormal) {
+		logger.Printf(format, args...)
+	}
+}
+
+// The verbosef function reports the details of what is being built
+func verbosef(format string, args ...interface{}) {
+	if logAt(LevelVerbose) {
+		logger.Printf(format, args...)
+	}
+}
+
+// The debugf function reports complete commands and generated files
+func debugf(format string, args ...interface{}) {
+	if logAt(LevelDebug) {
+		logger.Printf(format, args...)
+	}
+}
+
+// The combinedOutput function runs a command and returns its (combined)
+// output, just like cmd.CombinedOutput.  At -vvv, the output is also
+// streamed to os.Stderr as the command runs (rather than only being
+// reported if the command fails).
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	if !logAt(LevelTrace) {
+		return cmd.CombinedOutput()
+	}
+	output := &bytes.Buffer{}
+	w := io.MultiWriter(output, os.Stderr)
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	return output.Bytes(), err
+}
+
+// The progress function returns where the output of long running
+// commands (e.g., the Docker build) should go.
+func progress() io.Writer {
+	if logAt(LevelNormal) {
+		return os.Stderr
+	}
+	return ioutil.Discard
+}
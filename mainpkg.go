@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	gobuild "go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+)
+
+// The checkMain function makes sure that each of the packages we are
+// about to compile is a main package with a main function, so a mistake
+// (e.g., giving the directory of a library) is reported up front rather
+// than as a confusing failure of 'go build'.  Only the files that are
+// built for the platform are considered.  There is nothing to check for
+// a harness (the test binary of any package runs) or for an executable
+// built with a build command of their own.
+func checkMain(Options Options, config Config, platform Platform, apdir string, bins []Binary) error {
+	if Options.Harness {
+		return nil
+	}
+	ctx := goContext(Options, platform)
+	for i, bin := range bins {
+		if i == 0 && customBuild(Options, config) {
+			continue
+		}
+		pkg, err := ctx.Import(bin.Package, apdir, 0)
+		if err != nil {
+			if _, ok := err.(*gobuild.NoGoError); ok {
+				return fmt.Errorf("Package %s has no Go source files (for %s)", bin.Package, platform)
+			}
+			return fmt.Errorf("Unable to read package %s: %v", bin.Package, err)
+		}
+		if pkg.Name != "main" {
+			return fmt.Errorf("%s is not a main package (it is package %s), so there is nothing to run in the image",
+				bin.Package, pkg.Name)
+		}
+
+		found, err := hasMain(pkg.Dir, pkg.GoFiles)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("Package %s has no main function (for %s)", bin.Package, platform)
+		}
+	}
+	return nil
+}
+
+// The goContext function returns the context for reading the source of
+// packages (i.e., determining which files are built) for the platform.
+func goContext(Options Options, platform Platform) gobuild.Context {
+	ctx := gobuild.Default
+	ctx.GOOS = platform.OS
+	ctx.GOARCH = platform.Arch
+	ctx.CgoEnabled = !static(Options)
+	ctx.GOPATH = goEnv("GOPATH")
+	return ctx
+}
+
+// The hasMain function parses the given Go source files (in dir) and
+// determines whether any of them declares a main function.
+func hasMain(dir string, files []string) (bool, error) {
+	fset := token.NewFileSet()
+	for _, file := range files {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, file), nil, 0)
+		if err != nil {
+			return false, err
+		}
+		for _, decl := range f.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
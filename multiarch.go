@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The platformTag function returns the tag for the image for one of the
+// platforms of a multi-platform image (e.g., app:1.2 becomes
+// app:1.2-linux-arm64 and app becomes app:linux-arm64).
+func platformTag(tag string, platform Platform) string {
+	suffix := strings.Replace(platform.String(), "/", "-", -1)
+	// A ':' after the last '/' separates the tag from the name (any
+	// other ':' is part of a registry host name)
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		return tag + "-" + suffix
+	}
+	return tag + ":" + suffix
+}
+
+// The parsePlatforms function parses a comma separated list of platforms
+// (as given with --platforms).
+func parsePlatforms(list string) ([]Platform, error) {
+	ret := []Platform{}
+	seen := map[string]bool{}
+	for _, s := range strings.Split(list, ",") {
+		platform, err := parsePlatform(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		if seen[platform.String()] {
+			return nil, fmt.Errorf("Platform %s is listed more than once", platform)
+		}
+		seen[platform.String()] = true
+		ret = append(ret, platform)
+	}
+	return ret, nil
+}
+
+// The checkPlatforms function makes sure that, if images are to be built
+// for several platforms, we are able to combine them into a single
+// (multi-platform) image.
+func checkPlatforms(Options Options) error {
+	if Options.Tag == "" {
+		return fmt.Errorf("A tag is required to build for several platforms")
+	}
+	// Manifest lists only exist in registries
+	if !Options.push && !Options.Dry {
+		return fmt.Errorf("Images for several platforms must be pushed (use 'hidalgo push')")
+	}
+	if saving(Options) {
+		return fmt.Errorf("Images for several platforms cannot be saved")
+	}
+	switch Options.Backend {
+	case "docker", "sdocker", "podman", "buildah":
+		return nil
+	default:
+		return fmt.Errorf("Images for several platforms cannot be built with %s", Options.Backend)
+	}
+}
+
+// The buildPlatforms function builds the image for the package in pdir
+// for each of the platforms given with --platforms and then pushes a
+// manifest list (with the tag given in the options) that refers to all
+// of them, so the same tag can be used on any of the platforms.
+func buildPlatforms(Options Options, pdir string) error {
+	platforms, err := parsePlatforms(Options.Platforms)
+	if err != nil {
+		return &UsageError{err}
+	}
+	err = checkPlatforms(Options)
+	if err != nil {
+		return &UsageError{err}
+	}
+
+	// The manifest list is pushed with the same credentials as the
+	// images (if any were given)
+	apdir, _, err := packageName(pdir)
+	if err != nil {
+		return &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	Options.registries = config.Registries
+
+	// Build (and push) the image for each platform
+	tags := []string{}
+	for _, platform := range platforms {
+		opts := Options
+		opts.Platforms = ""
+		opts.platformOf = Options.Tag
+		opts.Platform = platform.String()
+		opts.Tag = platformTag(Options.Tag, platform)
+		// Each platform needs its own build directory...
+		if opts.Build != "" {
+			opts.Build = filepath.Join(opts.Build, strings.Replace(platform.String(), "/", "-", -1))
+		}
+		// ...and only the (multi-platform) image itself is summarized
+		opts.IIDFile = ""
+		opts.Summary = ""
+		opts.GitHubPR = 0
+
+		infof("Building for %s (%s)", platform, opts.Tag)
+		// The error is returned as is (so the exit status reflects what
+		// went wrong)
+		err := buildImage(opts, pdir)
+		if err != nil {
+			errorf("Unable to build for %s", platform)
+			return err
+		}
+		tags = append(tags, opts.Tag)
+	}
+	if Options.Dry {
+		return nil
+	}
+
+	// Then combine them
+	start := time.Now()
+	digest, err := pushManifest(Options, Options.Tag, tags)
+	if err != nil {
+		return &DockerError{err}
+	}
+	Options.record.phase("push", start)
+	Options.record.image(builtImage{Tag: Options.Tag, Digest: digest}, Options.Platforms)
+	infof("Manifest list pushed: %s (for %s)", Options.Tag, strings.Join(tags, ", "))
+	if digest != "" && !jsonOutput(Options) {
+		// Just like the IDs of the images, for scripts
+		fmt.Println(digest)
+	}
+	return nil
+}
+
+// This matches the digest of a manifest list reported by 'docker
+// manifest push'
+var manifestDigest = regexp.MustCompile(`sha256:[0-9a-f]{64}`)
+
+// The pushManifest function creates a manifest list (with the given tag)
+// that refers to the images with the given tags (which have already
+// been pushed) and pushes it.  It returns the digest of the manifest
+// list (if it is known).
+func pushManifest(Options Options, tag string, tags []string) (string, error) {
+	tool := Options.Backend
+	if tool != "podman" && tool != "buildah" {
+		tool = dockerCommand(Options)
+	}
+	// Use the credentials given for the registry (if any)
+	env, done, err := pushEnv(Options, tool, nil, tag)
+	defer done()
+	if err != nil {
+		return "", err
+	}
+	switch Options.Backend {
+	case "podman", "buildah":
+		return backendManifest(tool, env, tag, tags)
+	default:
+		return dockerManifest(tool, env, tag, tags)
+	}
+}
+
+// The dockerManifest function creates and pushes a manifest list with
+// 'docker manifest' (which talks to the registry, not the daemon).
+func dockerManifest(dcmd string, env []string, tag string, tags []string) (string, error) {
+	// Replace any manifest list left over from an earlier build
+	create := exec.Command(dcmd, append([]string{"manifest", "create", "--amend", tag}, tags...)...)
+	create.Env = env
+	err := runManifest(create)
+	if err != nil {
+		return "", err
+	}
+
+	push := exec.Command(dcmd, "manifest", "push", "--purge", tag)
+	push.Env = env
+	push.Stderr = os.Stderr
+	debugf("  Complete manifest command: '%s'", cmdString(push))
+	out, err := push.Output()
+	if err != nil {
+		return "", fmt.Errorf("Error pushing manifest list %s: %v", tag, err)
+	}
+	return manifestDigest.FindString(string(out)), nil
+}
+
+// The backendManifest function creates and pushes a manifest list with
+// podman or buildah.
+func backendManifest(tool string, env []string, tag string, tags []string) (string, error) {
+	command := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(tool, args...)
+		cmd.Env = env
+		return cmd
+	}
+
+	// Replace any manifest list left over from an earlier build (which
+	// fails harmlessly if there isn't one)
+	command("manifest", "rm", tag).Run()
+
+	err := runManifest(command("manifest", "create", tag))
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tags {
+		err := runManifest(command("manifest", "add", tag, "docker://"+t))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	digestfile, err := newIIDFile()
+	if err != nil {
+		return "", err
+	}
+	err = runManifest(command("manifest", "push", "--all", "--digestfile", digestfile, tag, "docker://"+tag))
+	digest := readIIDFile(digestfile)
+	if err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// The runManifest function runs one of the commands that creates (or
+// pushes) a manifest list.
+func runManifest(cmd *exec.Cmd) error {
+	cmd.Stdout = progress()
+	cmd.Stderr = os.Stderr
+	debugf("  Complete manifest command: '%s'", cmdString(cmd))
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Error running cmd '%s': %v", cmdString(cmd), err)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// These are the media types of the parts of an image in an OCI image
+// layout.  The layers are left as they are in the docker-archive (which
+// is uncompressed, unless the image was built without a daemon).
+const (
+	ociIndexType    = "application/vnd.oci.image.index.v1+json"
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar"
+	ociGzipType     = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// This is the annotation that skopeo and crane look up images in an OCI
+// image layout by (e.g., oci:myapp:1.2)
+const ociRefName = "org.opencontainers.image.ref.name"
+
+// An ociDescriptor refers to a blob in an OCI image layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// An ociPlatform is the platform an image in an index is for
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// An ociManifest lists the configuration and layers of an image
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// An ociIndex lists the images in an OCI image layout (in index.json)
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// An archiveManifest describes an image in a docker-archive (in its
+// manifest.json)
+type archiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// The ociRef function returns the name an image (given by its tag) is
+// known by in an OCI image layout, i.e., the part of the tag after the
+// colon (latest if there isn't one).
+func ociRef(tag string) string {
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		return tag[i+1:]
+	}
+	return "latest"
+}
+
+// The writeBlob function writes the contents of r to the blobs of the OCI
+// image layout in dir (named by their digest, as the layout requires) and
+// returns its digest and size (and whether it wasn't there already).
+func writeBlob(dir string, r io.Reader) (string, int64, bool, error) {
+	blobs := filepath.Join(dir, "blobs", "sha256")
+	err := os.MkdirAll(blobs, 0755)
+	if err != nil {
+		return "", 0, false, err
+	}
+	f, err := ioutil.TempFile(blobs, ".blob")
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return "", 0, false, err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", 0, false, err
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if _, err := os.Stat(blobPath(dir, digest)); err == nil {
+		return digest, size, false, nil
+	}
+	return digest, size, true, os.Rename(f.Name(), blobPath(dir, digest))
+}
+
+// The writeJSONBlob function writes the value (as JSON) to the blobs of the
+// OCI image layout in dir and returns a descriptor (with the given media
+// type) for it.
+func writeJSONBlob(dir string, mediaType string, v interface{}) (ociDescriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	digest, size, _, err := writeBlob(dir, strings.NewReader(string(data)))
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: size}, err
+}
+
+// The gzipped function determines whether a blob (in the OCI image
+// layout in dir) is compressed (with gzip).
+func gzipped(dir string, digest string) bool {
+	f, err := os.Open(blobPath(dir, digest))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// The blobPath function returns the file a blob (given by its digest) is
+// stored in (in the OCI image layout in dir).
+func blobPath(dir string, digest string) string {
+	return filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// The ociLayout function reads an image (given by its tag) in the
+// docker-archive format from r and adds it to the OCI image layout in
+// dir (which is created if it doesn't exist).  Any image with the same
+// name that is already in the layout is replaced.  Both the older
+// docker-archive format (with a directory per layer) and the one written
+// by Docker 25 (which is an OCI image layout already) are understood,
+// since every file in the archive is simply stored as a blob and the
+// manifest.json of the archive says which of them make up the image (the
+// rest are removed again).
+func ociLayout(r io.Reader, dir string, tag string) error {
+	// Store the files in the archive (keeping track of what is where, and
+	// which of them weren't in the layout already).  Layers that are in
+	// the archive more than once are links to the first copy.
+	blobs := map[string]ociDescriptor{}
+	added := map[string]bool{}
+	links := map[string]string{}
+	var manifests []archiveManifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid image archive: %v", err)
+		}
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if hdr.Typeflag == tar.TypeSymlink {
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+			continue
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if name == "manifest.json" {
+			err = json.NewDecoder(tr).Decode(&manifests)
+			if err != nil {
+				return fmt.Errorf("Invalid manifest.json in image archive: %v", err)
+			}
+			continue
+		}
+		digest, size, isNew, err := writeBlob(dir, tr)
+		if err != nil {
+			return fmt.Errorf("Unable to write %s to %s: %v", name, dir, err)
+		}
+		blobs[name] = ociDescriptor{Digest: digest, Size: size}
+		if isNew {
+			added[digest] = true
+		}
+	}
+	if len(manifests) != 1 {
+		return fmt.Errorf("Expected one image in the archive, found %d", len(manifests))
+	}
+	for name, target := range links {
+		if b, exists := blobs[target]; exists {
+			blobs[name] = b
+		}
+	}
+
+	// Put together the manifest of the image from the blobs it is made of
+	m := manifests[0]
+	config, exists := blobs[m.Config]
+	if !exists {
+		return fmt.Errorf("Configuration %s is missing from the image archive", m.Config)
+	}
+	config.MediaType = ociConfigType
+	manifest := ociManifest{SchemaVersion: 2, MediaType: ociManifestType, Config: config}
+	used := map[string]bool{config.Digest: true}
+	for _, l := range m.Layers {
+		layer, exists := blobs[l]
+		if !exists {
+			return fmt.Errorf("Layer %s is missing from the image archive", l)
+		}
+		layer.MediaType = ociLayerType
+		if gzipped(dir, layer.Digest) {
+			layer.MediaType = ociGzipType
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+		used[layer.Digest] = true
+	}
+
+	// Remove anything else in the archive (e.g., its repositories file)
+	for digest := range added {
+		if !used[digest] {
+			os.Remove(blobPath(dir, digest))
+		}
+	}
+	desc, err := writeJSONBlob(dir, ociManifestType, manifest)
+	if err != nil {
+		return fmt.Errorf("Unable to write manifest to %s: %v", dir, err)
+	}
+
+	// The index says what platform the image is for (which is in its
+	// configuration)
+	platform := ociPlatform{}
+	data, err := ioutil.ReadFile(blobPath(dir, config.Digest))
+	if err == nil {
+		err = json.Unmarshal(data, &platform)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid image configuration: %v", err)
+	}
+	desc.Platform = &platform
+	desc.Annotations = map[string]string{ociRefName: ociRef(tag)}
+
+	// Finally, add the image to the index (replacing any image with the
+	// same name)
+	ifile := filepath.Join(dir, "index.json")
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexType}
+	data, err = ioutil.ReadFile(ifile)
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			return fmt.Errorf("Invalid OCI image layout %s: %v", dir, err)
+		}
+	}
+	kept := []ociDescriptor{}
+	for _, d := range index.Manifests {
+		if d.Annotations[ociRefName] != ociRef(tag) {
+			kept = append(kept, d)
+		}
+	}
+	index.Manifests = append(kept, desc)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+	if err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ifile, data, 0644)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// The jsonOutput function returns true if the results of the build are
+// written to stdout as a JSON document (with --output json) rather than
+// as text (i.e., the IDs of the images).
+func jsonOutput(Options Options) bool {
+	return Options.Output == "json"
+}
+
+// ImageRecord describes an image that was built (for --output json)
+type ImageRecord struct {
+	// The tag of the image (if it has one)
+	Tag string `json:"tag,omitempty"`
+	// The ID of the image (if it is known)
+	ID string `json:"id,omitempty"`
+	// The digest of the image in its registry (if it was pushed)
+	Digest string `json:"digest,omitempty"`
+	// The platform the image is for (or, for a manifest list, the
+	// platforms it refers to)
+	Platform string `json:"platform"`
+}
+
+// Phase is how long one part of the build took
+type Phase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// BuildRecord is the structured record of the build of a package that
+// is written (to os.Stdout) with --output json.  Only the names of the
+// environment variables are recorded (since their values may be
+// secrets).
+type BuildRecord struct {
+	// The package directory (as given on the command line)
+	Directory string `json:"directory"`
+	// The Go package that was built
+	Package string `json:"package,omitempty"`
+	// The exit status of the build (and the error, if it failed)
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// The images that were built (including debug variants, jobs and
+	// the images for each platform)
+	Images []ImageRecord `json:"images"`
+	// The ports the image exposes
+	Ports []string `json:"ports"`
+	// The environment variables baked into the image
+	Env []string `json:"env"`
+	// How long each part of the build took (in the order they started)
+	// and how long the whole build took
+	Phases  []Phase `json:"phases"`
+	Seconds float64 `json:"seconds"`
+
+	// Packages are built concurrently, but each record is only updated
+	// by the build of its package (and jobs and platforms are built one
+	// at a time), so this is just to be safe
+	lock sync.Mutex
+}
+
+// The describe method records what the image for the package is made
+// of.  The images for jobs are recorded as well, but the package
+// (and its ports and environment) is the one that was asked for.
+func (r *BuildRecord) describe(name string, config Config, env map[string]string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Package != "" {
+		return
+	}
+	r.Package = name
+	for _, p := range config.Ports {
+		r.Ports = append(r.Ports, p.String())
+	}
+	r.Env = sortedKeys(env)
+}
+
+// The image method records an image that was built.
+func (r *BuildRecord) image(image builtImage, platform string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Images = append(r.Images, ImageRecord{Tag: image.Tag, ID: image.ID, Digest: image.Digest, Platform: platform})
+}
+
+// The phase method records how long a part of the build (that started
+// at start) took.  Parts that happen several times (e.g., a push for
+// each image) are added up.
+func (r *BuildRecord) phase(name string, start time.Time) {
+	if r == nil {
+		return
+	}
+	d := time.Since(start).Seconds()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range r.Phases {
+		if r.Phases[i].Name == name {
+			r.Phases[i].Seconds += d
+			return
+		}
+	}
+	r.Phases = append(r.Phases, Phase{Name: name, Seconds: d})
+}
+
+// The finish method records the outcome of the build (that started at
+// start).
+func (r *BuildRecord) finish(status int, err error, start time.Time) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Seconds = time.Since(start).Seconds()
+}
+
+// These are the records of the builds (in the order the packages were
+// given).  Packages are built concurrently, so access to them is
+// synchronized.
+var (
+	records     []*BuildRecord
+	recordsLock sync.Mutex
+)
+
+// The newRecord function starts the record of the build of the package
+// in pdir (if the results are written as JSON or the timings are
+// reported, otherwise there is nothing to record).  The records are
+// written in the order they are started, so when packages are built
+// concurrently, they are all started before any of the builds.
+func newRecord(Options Options, pdir string) *BuildRecord {
+	if !jsonOutput(Options) && !Options.Timings {
+		return nil
+	}
+	r := &BuildRecord{Directory: pdir, Images: []ImageRecord{}, Ports: []string{}, Env: []string{}, Phases: []Phase{}}
+	recordsLock.Lock()
+	records = append(records, r)
+	recordsLock.Unlock()
+	return r
+}
+
+// JSONOutput is the document written (to os.Stdout) with --output json
+// once all the packages are built.
+type JSONOutput struct {
+	// The exit status of hidalgo
+	Status int `json:"status"`
+	// The build of each package (in the order they were given)
+	Builds []*BuildRecord `json:"builds"`
+	// The warnings reported during the builds
+	Warnings []string `json:"warnings"`
+}
+
+// The writeOutput function writes the records of the builds (and the
+// warnings) to os.Stdout as a JSON document (with --output json).
+func writeOutput(Options Options, status int, warnings []string) {
+	recordsLock.Lock()
+	builds := records
+	records = nil
+	recordsLock.Unlock()
+	if !jsonOutput(Options) {
+		return
+	}
+
+	if builds == nil {
+		builds = []*BuildRecord{}
+	}
+	if warnings == nil {
+		warnings = []string{}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(JSONOutput{Status: status, Builds: builds, Warnings: warnings})
+}
+
+// The reportTimings function reports how long each phase of the build
+// took (with --timings).  The context is archived while it is sent to
+// Docker, so the tar phase overlaps the build phase.
+func reportTimings(Options Options, r *BuildRecord) {
+	if !Options.Timings || r == nil {
+		return
+	}
+	infof("Timings for %s:", r.Directory)
+	for _, p := range r.Phases {
+		infof("  %-8s %7.2fs (%3.0f%%)", p.Name, p.Seconds, 100*p.Seconds/r.Seconds)
+	}
+	infof("  %-8s %7.2fs", "total", r.Seconds)
+}
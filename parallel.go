@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The packageDirs function expands the directories given on the command
+// line (which may be glob patterns) into the list of package directories
+// to build.  If none are given, the current directory is used.
+func packageDirs(args []string) ([]string, error) {
+	// We assume they mean the current directory...
+	if len(args) == 0 {
+		return []string{"."}, nil
+	}
+
+	// ...unless they specified something explicitly
+	ret := []string{}
+	for _, arg := range args {
+		// Anything that isn't a pattern is used as is
+		if !strings.ContainsAny(arg, "*?[") {
+			ret = append(ret, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %s: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No directories match %s", arg)
+		}
+		ret = append(ret, matches...)
+	}
+	return ret, nil
+}
+
+// The runAll function builds several packages concurrently (using a pool
+// of workers) and reports the results for each of them.  The exit status
+// is that of the first package (in the order given) that failed.
+func runAll(Options Options, dirs []string) int {
+	// A single tag can't be applied to several different images (but a
+	// template can be evaluated for each of them)
+	if Options.Tag != "" && !tagTemplate(Options.Tag) {
+		return report(Options, "", &UsageError{fmt.Errorf("A tag cannot be used when building multiple packages (unless it is a template)")})
+	}
+
+	// ...and the Dockerfiles can't all be written to the same file
+	if Options.DOut != "" && Options.DOut != "-" {
+		return report(Options, "", &UsageError{fmt.Errorf("A Dockerfile output file cannot be used when building multiple packages")})
+	}
+
+	// ...and neither can their summaries (or reports, unless they are
+	// in the package directories)
+	if Options.Summary != "" && Options.Summary != "-" {
+		return report(Options, "", &UsageError{fmt.Errorf("A summary file cannot be used when building multiple packages")})
+	}
+	if filepath.IsAbs(Options.Report) {
+		return report(Options, "", &UsageError{fmt.Errorf("A report file outside the package directory cannot be used when building multiple packages")})
+	}
+
+	// Determine how many builds to run at once
+	jobs := Options.Jobs
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	// The status of the build for each directory (and the record of
+	// it, which is started up front so they are in the same order)
+	status := make([]int, len(dirs))
+	recs := make([]*BuildRecord, len(dirs))
+	for i := range dirs {
+		recs[i] = newRecord(Options, dirs[i])
+	}
+
+	// Feed the index of each directory to the workers
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				opts := Options
+				opts.record = recs[i]
+				// Each package needs its own build directory
+				if opts.Build != "" {
+					opts.Build = filepath.Join(opts.Build,
+						fmt.Sprintf("%d-%s", i, filepath.Base(dirs[i])))
+				}
+				infof("Building %s", dirs[i])
+				status[i] = run(opts, dirs[i])
+			}
+		}()
+	}
+	for i := range dirs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	// Now summarize the results
+	ret := 0
+	infof("===== Results =====")
+	for i, dir := range dirs {
+		if status[i] == 0 {
+			infof("  %s: ok", dir)
+		} else {
+			errorf("  %s: failed (status %d)", dir, status[i])
+			if ret == 0 {
+				ret = status[i]
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+)
+
+// An imagePlan is what goes into the image for a package (as far as it
+// can be determined without compiling anything).  The build, 'hidalgo
+// template check' and 'hidalgo inspect' all work from the same plan, so
+// they agree on what the image contains.
+type imagePlan struct {
+	// The configuration (including any ports that were detected and the
+	// arguments of a harness)
+	Config Config
+	// The image to build FROM (pinned to a digest if the package was
+	// locked)
+	From string
+	// The environment variables baked into the image
+	Env map[string]string
+	// The executables in the image (named for the platform) and the one
+	// it runs
+	Bins    []Binary
+	Default Binary
+	// What the build is stamped (and the image labeled) with
+	Stamp  Stamp
+	Labels map[string]string
+}
+
+// The planImage function determines what goes into the image for the
+// package name (in apdir) for the given platform.
+func planImage(Options Options, platform Platform, apdir string, name string, config Config) (imagePlan, error) {
+	plan := imagePlan{}
+
+	// Determine the image to build FROM.  If the package was locked, the
+	// base image is the one that was locked (and the toolchain and
+	// modules must be as well).
+	from, err := applyLock(apdir, baseImage(Options, config, platform))
+	if err != nil {
+		return plan, &ConfigError{err}
+	}
+	plan.From = from
+
+	// Determine the environment variables to bake into the image and look
+	// for ports the package listens on that aren't exposed
+	plan.Env = buildEnv(config)
+	config = detectPorts(Options, platform, apdir, config)
+
+	// Determine all the binaries that need to be built (for a harness,
+	// that is just the test binary) and which one the image should run
+	bins, err := binaries(apdir, name, config)
+	if err != nil {
+		return plan, &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	bins, config = harness(Options, name, bins, config)
+	plan.Bins = platform.executables(bins)
+	plan.Default, err = defaultBinary(plan.Bins, config)
+	if err != nil {
+		return plan, &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	plan.Config = config
+
+	// The image is labeled with where it came from, the names of the
+	// ports and any labels given in files (which are added last, so they
+	// can override the others)
+	plan.Stamp = newStamp(apdir, config.Version, buildTime(Options))
+	plan.Labels = plan.Stamp.labels()
+	for key, value := range config.portLabels() {
+		plan.Labels[key] = value
+	}
+	extra, err := readLabelFiles(Options.LabelFile)
+	if err != nil {
+		return plan, &UsageError{err}
+	}
+	for key, value := range extra {
+		plan.Labels[key] = value
+	}
+	return plan, nil
+}
+
+// The context method builds up the context for evaluating the Dockerfile
+// template for the package name from the plan.
+func (p imagePlan) context(name string) map[string]interface{} {
+	return templateContext(name, p.Stamp, p.From, p.Env, p.Labels, p.Bins, p.Default, p.Config)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The platform we build for unless told otherwise
+const defaultPlatform = "linux/amd64"
+
+// Platform describes the target of a build in the same terms as the OCI
+// image specification (i.e., os/arch/variant).
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// These are the architectures that images can be built for on each
+// operating system (i.e., the targets the Go toolchain supports that
+// there are containers for).  Those that are experimental (for Go or
+// for container runtimes) are marked as such.
+var platformArchs = map[string]map[string]bool{
+	"linux": {
+		"386":      false,
+		"amd64":    false,
+		"arm":      false,
+		"arm64":    false,
+		"loong64":  true,
+		"mips":     false,
+		"mipsle":   false,
+		"mips64":   false,
+		"mips64le": false,
+		"ppc64":    false,
+		"ppc64le":  false,
+		"riscv64":  true,
+		"s390x":    false,
+	},
+	"windows": {
+		"amd64": false,
+		"arm64": true,
+	},
+}
+
+// These are the supported variants for each architecture and the Go
+// environment variable (and value) each of them corresponds to.
+var platformVariants = map[string]map[string]string{
+	"arm": {
+		"v5": "GOARM=5",
+		"v6": "GOARM=6",
+		"v7": "GOARM=7",
+	},
+	"arm64": {
+		"v8": "",
+	},
+	"amd64": {
+		"v1": "GOAMD64=v1",
+		"v2": "GOAMD64=v2",
+		"v3": "GOAMD64=v3",
+		"v4": "GOAMD64=v4",
+	},
+	"riscv64": {
+		"rva20u64": "GORISCV64=rva20u64",
+		"rva22u64": "GORISCV64=rva22u64",
+	},
+}
+
+// The platformNames function returns the names (os/arch) of all the
+// platforms images can be built for (for error messages).
+func platformNames() []string {
+	ret := []string{}
+	for os, archs := range platformArchs {
+		for arch := range archs {
+			ret = append(ret, os+"/"+arch)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// These are the valid values for GOMIPS (and GOMIPS64)
+var mipsFloats = map[string]bool{"hardfloat": true, "softfloat": true}
+
+// The parsePlatform function parses a platform string of the form
+// os/arch[/variant] (e.g., linux/arm/v7).
+func parsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("Invalid platform %s (should be os/arch[/variant])", s)
+	}
+
+	ret := Platform{OS: parts[0], Arch: parts[1]}
+	if _, ok := platformArchs[ret.OS][ret.Arch]; !ok {
+		return Platform{}, fmt.Errorf("Unsupported platform %s/%s (must be one of %s)",
+			ret.OS, ret.Arch, strings.Join(platformNames(), ", "))
+	}
+	if len(parts) == 3 {
+		ret.Variant = parts[2]
+		if _, ok := platformVariants[ret.Arch][ret.Variant]; !ok {
+			return Platform{}, fmt.Errorf("Unsupported variant %s for architecture %s", ret.Variant, ret.Arch)
+		}
+	}
+	return ret, nil
+}
+
+// The String method returns the platform in os/arch[/variant] form
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Arch
+	}
+	return p.OS + "/" + p.Arch + "/" + p.Variant
+}
+
+// The experimental method returns true if support for the platform (in
+// Go or in container runtimes) is still experimental.
+func (p Platform) experimental() bool {
+	return platformArchs[p.OS][p.Arch]
+}
+
+// The executables method returns the binaries with the names they have
+// on this platform (i.e., with .exe added on Windows, in the build
+// directory and the image).
+func (p Platform) executables(bins []Binary) []Binary {
+	if p.OS != "windows" {
+		return bins
+	}
+	ret := []Binary{}
+	for _, bin := range bins {
+		bin.Name += ".exe"
+		bin.Path += ".exe"
+		ret = append(ret, bin)
+	}
+	return ret
+}
+
+// The goenv method returns the environment variables that tell the Go
+// toolchain to build for this platform.  The floating point mode for
+// MIPS architectures (which has no OCI variant) is given separately.
+func (p Platform) goenv(gomips string) ([]string, error) {
+	ret := []string{"GOOS=" + p.OS, "GOARCH=" + p.Arch}
+
+	if v := platformVariants[p.Arch][p.Variant]; v != "" {
+		ret = append(ret, v)
+	}
+
+	if gomips != "" {
+		if !mipsFloats[gomips] {
+			return nil, fmt.Errorf("Invalid MIPS floating point mode %s (should be hardfloat or softfloat)", gomips)
+		}
+		switch p.Arch {
+		case "mips", "mipsle":
+			ret = append(ret, "GOMIPS="+gomips)
+		case "mips64", "mips64le":
+			ret = append(ret, "GOMIPS64="+gomips)
+		default:
+			return nil, fmt.Errorf("A MIPS floating point mode cannot be used with architecture %s", p.Arch)
+		}
+	}
+	return ret, nil
+}
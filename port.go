@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Port is a port exposed by the image
+type Port struct {
+	// The port number
+	Number int `yaml:"number" json:"number"`
+	// The protocol (tcp, the default, or udp)
+	Protocol string `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	// What the port is for (e.g., grpc-api), which is recorded in a label
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+}
+
+// The parsePort function parses a port given as number[/protocol]
+func parsePort(s string) (Port, error) {
+	ret := Port{}
+	parts := strings.SplitN(s, "/", 2)
+	num, err := strconv.ParseInt(parts[0], 0, 0)
+	if err != nil {
+		return ret, fmt.Errorf("Invalid port number: %s", s)
+	}
+	ret.Number = int(num)
+	if len(parts) == 2 {
+		ret.Protocol = parts[1]
+	}
+	return ret, nil
+}
+
+// The parsePorts function parses (and validates) the ports given with
+// --port.
+func parsePorts(list []string) ([]Port, error) {
+	ret := []Port{}
+	for _, s := range list {
+		port, err := parsePort(s)
+		if err != nil {
+			return nil, err
+		}
+		err = port.validate()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, port)
+	}
+	return ret, nil
+}
+
+// The mergePorts function adds the given ports to a list of ports,
+// unless they are already in it (so the ones in the list keep their
+// names).
+func mergePorts(ports []Port, extra []Port) []Port {
+	for _, e := range extra {
+		listed := false
+		for _, p := range ports {
+			listed = listed || p.String() == e.String()
+		}
+		if !listed {
+			ports = append(ports, e)
+		}
+	}
+	return ports
+}
+
+// The String method returns the port in the form used by EXPOSE (the
+// protocol is only included if it isn't tcp).
+func (p Port) String() string {
+	if p.Protocol == "" || p.Protocol == "tcp" {
+		return strconv.Itoa(p.Number)
+	}
+	return fmt.Sprintf("%d/%s", p.Number, p.Protocol)
+}
+
+// The label method returns the key of the label that records the name
+// of the port (e.g., org.hidalgo.port.8080 or org.hidalgo.port.53.udp).
+func (p Port) label() string {
+	return "org.hidalgo.port." + strings.Replace(p.String(), "/", ".", -1)
+}
+
+// The validate method checks that the port is in range and the protocol
+// is one Docker supports.
+func (p Port) validate() error {
+	if p.Number < 1 || p.Number > 65535 {
+		return fmt.Errorf("Invalid port number: %d", p.Number)
+	}
+	switch p.Protocol {
+	case "", "tcp", "udp", "sctp":
+		return nil
+	default:
+		return fmt.Errorf("Invalid protocol for port %d: %s", p.Number, p.Protocol)
+	}
+}
+
+// portFields is used to unmarshal a port given with its fields (rather
+// than just a number)
+type portFields Port
+
+// The UnmarshalYAML method allows ports to be given as either a number,
+// a string (number/protocol) or with their fields.
+func (p *Port) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	num := 0
+	if err := unmarshal(&num); err == nil {
+		*p = Port{Number: num}
+		return nil
+	}
+	s := ""
+	if err := unmarshal(&s); err == nil {
+		port, err := parsePort(s)
+		if err != nil {
+			return err
+		}
+		*p = port
+		return nil
+	}
+	fields := portFields{}
+	err := unmarshal(&fields)
+	if err != nil {
+		return err
+	}
+	*p = Port(fields)
+	return nil
+}
+
+// The UnmarshalJSON method allows ports to be given as either a number,
+// a string (number/protocol) or with their fields.
+func (p *Port) UnmarshalJSON(data []byte) error {
+	num := 0
+	if err := json.Unmarshal(data, &num); err == nil {
+		*p = Port{Number: num}
+		return nil
+	}
+	s := ""
+	if err := json.Unmarshal(data, &s); err == nil {
+		port, err := parsePort(s)
+		if err != nil {
+			return err
+		}
+		*p = port
+		return nil
+	}
+	fields := portFields{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	*p = Port(fields)
+	return nil
+}
+
+// The portLabels method returns the labels that record the names of the
+// (named) ports.
+func (c Config) portLabels() map[string]string {
+	ret := map[string]string{}
+	for _, p := range c.Ports {
+		if p.Name != "" {
+			ret[p.label()] = p.Name
+		}
+	}
+	return ret
+}
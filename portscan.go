@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A foundPort is a port that the source of a package appears to listen
+// on (and where in the source it was found)
+type foundPort struct {
+	Port
+	Where string
+}
+
+// The scanPorts function looks through the source of the package in
+// apdir (the files that are built for the platform) for the ports it
+// listens on.  This is just a heuristic: it finds literal addresses
+// passed to http.ListenAndServe, http.ListenAndServeTLS, net.Listen and
+// net.ListenPacket or given as the Addr of an http.Server, along with
+// the defaults of flags that look like addresses (e.g., ":8080") or
+// ports (an int flag with "port" in its name).
+func scanPorts(Options Options, platform Platform, apdir string) ([]foundPort, error) {
+	ret := []foundPort{}
+	err := scanSource(Options, platform, apdir, func(f *ast.File, names map[string]string, where func(ast.Node) string) {
+		found := func(node ast.Node, port Port) {
+			ret = append(ret, foundPort{Port: port, Where: where(node)})
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				pname, fname := selectorName(n.Fun, names)
+				if port, ok := callPort(pname, fname, n.Args); ok {
+					found(n, port)
+				}
+			case *ast.CompositeLit:
+				pname, tname := selectorName(n.Type, names)
+				if pname != "net/http" || tname != "Server" {
+					return true
+				}
+				for _, elt := range n.Elts {
+					kv, ok := elt.(*ast.KeyValueExpr)
+					if !ok {
+						continue
+					}
+					if key, ok := kv.Key.(*ast.Ident); ok && key.Name == "Addr" {
+						if port, ok := addrPort(kv.Value, "tcp"); ok {
+							found(kv, port)
+						}
+					}
+				}
+			}
+			return true
+		})
+	})
+	return ret, err
+}
+
+// The scanSource function parses each of the source files of the
+// package in apdir (those that are built for the platform) and passes it
+// to the given function, along with the import paths of the packages it
+// imports (by the names they have in the file) and a function that
+// returns where (file:line) a node is.
+func scanSource(Options Options, platform Platform, apdir string,
+	scan func(f *ast.File, names map[string]string, where func(ast.Node) string)) error {
+	ctx := goContext(Options, platform)
+	pkg, err := ctx.ImportDir(apdir, 0)
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	for _, file := range pkg.GoFiles {
+		f, err := parser.ParseFile(fset, filepath.Join(pkg.Dir, file), nil, 0)
+		if err != nil {
+			return err
+		}
+
+		// The packages we are interested in may be imported with other
+		// names, so we determine what they are called in this file
+		names := map[string]string{}
+		for _, imp := range f.Imports {
+			p, _ := strconv.Unquote(imp.Path.Value)
+			name := p[strings.LastIndex(p, "/")+1:]
+			if imp.Name != nil {
+				name = imp.Name.Name
+			}
+			names[name] = p
+		}
+
+		scan(f, names, func(node ast.Node) string {
+			return fmt.Sprintf("%s:%d", file, fset.Position(node.Pos()).Line)
+		})
+	}
+	return nil
+}
+
+// The selectorName function returns the import path of the package and the
+// name of the identifier referred to by an expression like http.Server
+// (or empty strings if the expression is something else).
+func selectorName(expr ast.Expr, names map[string]string) (string, string) {
+	sel, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return "", ""
+	}
+	x, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", ""
+	}
+	return names[x.Name], sel.Sel.Name
+}
+
+// The callPort function determines whether a call of the given function
+// (in the package with the given import path) gives a port that is
+// listened on.
+func callPort(pname string, fname string, args []ast.Expr) (Port, bool) {
+	arg := func(i int) ast.Expr {
+		if i < len(args) {
+			return args[i]
+		}
+		return nil
+	}
+	switch pname + "." + fname {
+	case "net/http.ListenAndServe", "net/http.ListenAndServeTLS":
+		return addrPort(arg(0), "tcp")
+	case "net.Listen", "net.ListenPacket":
+		network, ok := stringLit(arg(0))
+		if !ok {
+			return Port{}, false
+		}
+		return addrPort(arg(1), strings.TrimRight(network, "46"))
+	case "flag.String":
+		return addrPort(arg(1), "tcp")
+	case "flag.StringVar":
+		return addrPort(arg(2), "tcp")
+	case "flag.Int":
+		return flagPort(arg(0), arg(1))
+	case "flag.IntVar":
+		return flagPort(arg(1), arg(2))
+	}
+	return Port{}, false
+}
+
+// The stringLit function returns the value of a string literal.
+func stringLit(expr ast.Expr) (string, bool) {
+	lit, ok := expr.(*ast.BasicLit)
+	if !ok || lit.Kind != token.STRING {
+		return "", false
+	}
+	s, err := strconv.Unquote(lit.Value)
+	return s, err == nil
+}
+
+// The addrPort function returns the port in a literal address (e.g.,
+// ":8080" or "localhost:8080").  Port 0 (i.e., any port) doesn't count.
+func addrPort(expr ast.Expr, protocol string) (Port, bool) {
+	addr, ok := stringLit(expr)
+	if !ok {
+		return Port{}, false
+	}
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Port{}, false
+	}
+	num, err := strconv.Atoi(p)
+	if err != nil {
+		return Port{}, false
+	}
+	port := Port{Number: num}
+	if protocol != "tcp" {
+		port.Protocol = protocol
+	}
+	return port, port.Number != 0 && port.validate() == nil
+}
+
+// The flagPort function returns the default value of an int flag whose
+// name suggests it is a port.
+func flagPort(name ast.Expr, value ast.Expr) (Port, bool) {
+	n, ok := stringLit(name)
+	if !ok || !strings.Contains(strings.ToLower(n), "port") {
+		return Port{}, false
+	}
+	lit, ok := value.(*ast.BasicLit)
+	if !ok || lit.Kind != token.INT {
+		return Port{}, false
+	}
+	num, err := strconv.ParseInt(lit.Value, 0, 0)
+	if err != nil {
+		return Port{}, false
+	}
+	port := Port{Number: int(num)}
+	return port, port.Number != 0 && port.validate() == nil
+}
+
+// The detectPorts function compares the ports the package appears to
+// listen on with the ones the image exposes.  Those that are missing
+// are suggested or, with --auto-ports, exposed as well.
+func detectPorts(Options Options, platform Platform, apdir string, config Config) Config {
+	found, err := scanPorts(Options, platform, apdir)
+	if err != nil {
+		// Any problems with the source are reported by the build
+		debugf("Unable to scan the source for ports: %v", err)
+		return config
+	}
+	suggested := map[string]bool{}
+	for _, f := range found {
+		exposed := suggested[f.Port.String()]
+		for _, p := range config.Ports {
+			exposed = exposed || p.String() == f.Port.String()
+		}
+		if exposed {
+			continue
+		}
+		suggested[f.Port.String()] = true
+		if Options.AutoPorts {
+			verbosef("Exposing port %s (found in %s)", f.Port, f.Where)
+			config.Ports = append(config.Ports, f.Port)
+		} else {
+			infof("The package appears to listen on port %s (%s), which isn't exposed (use --auto-ports to expose it)",
+				f.Port, f.Where)
+		}
+	}
+	return config
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This is the port that pprof is conventionally served on
+const pprofPort = 6060
+
+// These are the profiles that are used to build production images (which
+// must never expose pprof)
+var productionProfiles = []string{"prod", "production"}
+
+// The production function returns the production profile given in the
+// options (or "" if there isn't one).
+func production(Options Options) string {
+	for _, p := range Options.Profile {
+		for _, prod := range productionProfiles {
+			if p == prod {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// The importsPProf function determines whether any of the (non-test) Go
+// files in dir import net/http/pprof (which registers its handlers with
+// http.DefaultServeMux, so any server using it exposes them).
+func importsPProf(dir string) (bool, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, parser.ImportsOnly)
+	if err != nil {
+		return false, err
+	}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, imp := range file.Imports {
+				if p, _ := strconv.Unquote(imp.Path.Value); p == "net/http/pprof" {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// The checkPProf function applies --with-pprof to the configuration (by
+// adding the pprof port) and, when building a production image, makes
+// sure that pprof isn't exposed (either by the configuration or by the
+// package importing net/http/pprof).
+func checkPProf(Options Options, apdir string, config Config) (Config, error) {
+	prod := production(Options)
+	if prod != "" && Options.WithPProf {
+		return config, &UsageError{fmt.Errorf("--with-pprof cannot be used with the %s profile", prod)}
+	}
+
+	imports, err := importsPProf(apdir)
+	if err != nil {
+		return config, &BuildError{fmt.Errorf("Unable to check for pprof: %v", err)}
+	}
+
+	if Options.WithPProf {
+		if !imports {
+			warnf("The package doesn't import net/http/pprof, so pprof may not be served on port %d", pprofPort)
+		}
+		for _, p := range config.Ports {
+			if p.Number == pprofPort && p.Protocol == "" {
+				return config, nil
+			}
+		}
+		verbosef("Exposing pprof on port %d", pprofPort)
+		config.Ports = append(config.Ports, Port{Number: pprofPort, Name: "pprof"})
+		return config, nil
+	}
+
+	if prod == "" {
+		return config, nil
+	}
+	for _, p := range config.Ports {
+		if p.Number == pprofPort || p.Name == "pprof" {
+			return config, &ConfigError{fmt.Errorf("The pprof port (%s) must not be exposed by %s images", p, prod)}
+		}
+	}
+	if imports {
+		return config, &BuildError{fmt.Errorf("The package imports net/http/pprof, which exposes profiling data on http.DefaultServeMux, so no %s image will be built", prod)}
+	}
+	return config, nil
+}
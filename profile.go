@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+)
+
+// A Profile is a set of directives that override the rest of the
+// configuration when the profile is given with --profile (e.g., to use
+// a different base image and tag for development images).
+type Profile struct {
+	// Environment variables (instead of the ones at the top level)
+	Env []string `yaml:"env" json:"env"`
+	// Environment variables that must be set (which are in Env as well)
+	Required []string `yaml:"required" json:"required"`
+	// Ports to expose (instead of the ones at the top level)
+	Ports []Port `yaml:"port" json:"port"`
+	// Base images by platform (overriding the ones at the top level
+	// for the same platforms)
+	From map[string]string `yaml:"from" json:"from"`
+	// Name to tag the image with (unless one is given with -t)
+	Tag string `yaml:"tag" json:"tag"`
+}
+
+// The apply method overrides the configuration with the directives in
+// the profile.
+func (p Profile) apply(c Config) Config {
+	if p.Env != nil {
+		c.Env = p.Env
+		c.Required = p.Required
+	}
+	if p.Ports != nil {
+		c.Ports = p.Ports
+	}
+	if len(p.From) > 0 {
+		from := map[string]string{}
+		for platform, image := range c.From {
+			from[platform] = image
+		}
+		for platform, image := range p.From {
+			from[platform] = image
+		}
+		c.From = from
+	}
+	if p.Tag != "" {
+		c.Tag = p.Tag
+	}
+	return c
+}
+
+// The known method determines whether the configuration knows about the
+// given profile (i.e., whether it defines it or has directives that
+// depend on it).
+func (c Config) known(profile string) bool {
+	if _, defined := c.Profiles[profile]; defined {
+		return true
+	}
+	for _, w := range c.When {
+		if _, kind, name, err := parseCondition(w.If); err == nil && kind == "profile" && name == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// The profileTag function returns the options with the tag given by the
+// selected profiles (in the configuration of the package in pdir), unless
+// a tag was given with -t.
+func profileTag(Options Options, pdir string) (Options, error) {
+	if Options.Tag != "" || len(Options.Profile) == 0 {
+		return Options, nil
+	}
+	apdir, _, err := packageName(pdir)
+	if err != nil {
+		return Options, &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return Options, &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	if config.Tag != "" {
+		verbosef("Tagging image as %s (from the profile)", config.Tag)
+		Options.Tag = config.Tag
+	}
+	return Options, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// These match the lines that start each step of a build in the output of
+// the classic builder and of BuildKit (with plain progress output).
+var (
+	classicStep  = regexp.MustCompile(`^Step (\d+)/(\d+) : (.*)$`)
+	buildkitStep = regexp.MustCompile(`^#\d+ \[(?:[^\]]* )?(\d+)/(\d+)\] (.*)$`)
+)
+
+// This is the number of lines of output that are kept for the current
+// step (so they can be shown if the step fails)
+const failureLines = 40
+
+// A buildProgress is where the output of a build is written.  Rather
+// than passing all of the output through, it reports each step as it
+// starts (along with the time since the build started) and a summary at
+// the end.  The complete output is only shown at -vvv (or, for the step
+// that failed, if the build fails).
+type buildProgress struct {
+	// Where the complete output goes (nil if it isn't shown)
+	raw io.Writer
+	// When the build started
+	start time.Time
+	// The current step and when it started
+	step      string
+	stepStart time.Time
+	// The number of steps so far
+	steps int
+	// The step that took the longest (and how long it took)
+	slowest     string
+	slowestTime time.Duration
+	// Any incomplete line of output
+	partial []byte
+	// The last lines of output from the current step
+	lines []string
+}
+
+// The newBuildProgress function creates a buildProgress for a build that
+// is just starting.
+func newBuildProgress() *buildProgress {
+	b := &buildProgress{start: time.Now()}
+	if logAt(LevelTrace) {
+		b.raw = os.Stderr
+	}
+	return b
+}
+
+// The Write method processes the output of the build one line at a time.
+func (b *buildProgress) Write(p []byte) (int, error) {
+	b.partial = append(b.partial, p...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.line(strings.TrimRight(string(b.partial[:i]), "\r"))
+		b.partial = b.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// The line method processes a single line of output.
+func (b *buildProgress) line(l string) {
+	if b.raw != nil {
+		fmt.Fprintln(b.raw, l)
+	}
+
+	m := classicStep.FindStringSubmatch(l)
+	if m == nil {
+		m = buildkitStep.FindStringSubmatch(l)
+	}
+	if m == nil {
+		b.lines = append(b.lines, l)
+		if len(b.lines) > failureLines {
+			b.lines = b.lines[1:]
+		}
+		return
+	}
+
+	// A new step is starting
+	b.endStep()
+	b.step = fmt.Sprintf("Step %s/%s: %s", m[1], m[2], m[3])
+	b.stepStart = time.Now()
+	b.steps++
+	b.lines = nil
+	if b.raw == nil {
+		infof("  [%5.1fs] %s", time.Since(b.start).Seconds(), b.step)
+	}
+}
+
+// The endStep method records how long the current step took.
+func (b *buildProgress) endStep() {
+	if b.step == "" {
+		return
+	}
+	if d := time.Since(b.stepStart); d > b.slowestTime {
+		b.slowest = b.step
+		b.slowestTime = d
+	}
+}
+
+// The finish method is called once the build is done (with the error,
+// if any, that it failed with).  If the build failed, the end of the
+// output (which wasn't shown) is reported.  Otherwise, a summary is.
+func (b *buildProgress) finish(err error) {
+	if len(b.partial) > 0 {
+		b.line(string(b.partial))
+		b.partial = nil
+	}
+	b.endStep()
+
+	if err != nil {
+		if b.raw == nil && len(b.lines) > 0 {
+			what := b.step
+			if what == "" {
+				what = "the build"
+			}
+			errorf("Output of %s:", what)
+			for _, l := range b.lines {
+				errorf("  %s", l)
+			}
+		}
+		return
+	}
+
+	steps := "steps"
+	if b.steps == 1 {
+		steps = "step"
+	}
+	infof("Build finished in %.1fs (%d %s)", time.Since(b.start).Seconds(), b.steps, steps)
+	if b.slowest != "" {
+		verbosef("  Slowest step: %s (%.1fs)", b.slowest, b.slowestTime.Seconds())
+	}
+}
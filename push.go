@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// This is the key 'docker login' stores the credentials for Docker Hub
+// under
+const dockerHubAuth = "https://index.docker.io/v1/"
+
+// The checkPush function makes sure that, if the image is to be pushed,
+// we are able to push it.
+func checkPush(Options Options) error {
+	if !Options.push {
+		return nil
+	}
+	if Options.Tag == "" {
+		return fmt.Errorf("A tag is required to push the image")
+	}
+	if len(Options.Agent) > 0 {
+		return fmt.Errorf("Images built by a build agent cannot be pushed")
+	}
+	return nil
+}
+
+// The retryPush function pushes the image with the given tag (using the
+// given push function) and, if that fails (e.g., because of a network
+// problem), tries again (up to the number of times given in the
+// options).  Layers that were uploaded by an earlier attempt are
+// already in the registry, so they aren't uploaded again.
+func retryPush(Options Options, tag string, push func(tag string) (string, error)) (string, error) {
+	defer Options.record.phase("push", time.Now())
+	digest := ""
+	err := retry(Options, "push of "+tag, Options.PushRetries, func() error {
+		var err error
+		digest, err = push(tag)
+		return err
+	})
+	return digest, err
+}
+
+// The registryOf function returns the registry an image (given by its
+// tag) is pushed to.  Like Docker, the first component of the name is
+// only a registry if it looks like a host name (otherwise, the image is
+// on Docker Hub).
+func registryOf(tag string) string {
+	i := strings.Index(tag, "/")
+	if i < 0 {
+		return "docker.io"
+	}
+	host := tag[:i]
+	if host == "localhost" || strings.ContainsAny(host, ".:") {
+		return host
+	}
+	return "docker.io"
+}
+
+// The registryAuth function encodes the credentials (if any) for the
+// registry the tagged image is pushed to for the X-Registry-Auth header.
+// Credentials given in the options or the configuration are used if
+// there are any, otherwise those stored by 'docker login' (in the
+// Docker configuration or the credential helper it names) are.  The
+// daemon requires the header, so (empty) credentials are always
+// returned.
+func registryAuth(Options Options, tag string) (string, error) {
+	auth, found, err := pushAuth(Options, tag)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		auth = storedAuth(tag)
+	}
+	encoded, _ := json.Marshal(auth)
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+// The storedAuth function returns the credentials stored by 'docker
+// login' for the registry the tagged image is pushed to.
+func storedAuth(tag string) authConfig {
+	registry := registryOf(tag)
+	config, err := readDockerConfig()
+	if err != nil {
+		warnf("Unable to read Docker credentials: %v", err)
+	}
+
+	// A credential helper for the registry (or for all of them) is what
+	// 'docker login' stored the credentials in
+	helper := config.CredHelpers[registry]
+	if helper == "" {
+		helper = config.CredsStore
+	}
+	if helper != "" {
+		server := registry
+		if registry == "docker.io" {
+			server = dockerHubAuth
+		}
+		auth, err := helperAuth(helper, server)
+		if err == nil {
+			return auth
+		}
+		debugf("  %v", err)
+	}
+
+	auth := authConfig{}
+	auths, err := registryAuths()
+	if err != nil {
+		warnf("Unable to read Docker credentials: %v", err)
+	}
+	for server, a := range auths {
+		// The servers may be given as URLs (e.g., for Docker Hub)
+		host := strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+		host = strings.SplitN(host, "/", 2)[0]
+		if host == registry || (registry == "docker.io" && server == dockerHubAuth) {
+			auth = a
+		}
+	}
+	return auth
+}
+
+// A pushMessage is one of the (JSON) progress messages streamed back by
+// the daemon during a push.
+type pushMessage struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux struct {
+		Digest string `json:"Digest"`
+	} `json:"aux"`
+}
+
+// The push method pushes the image with the given tag to its registry
+// (with the given, encoded, credentials).  It returns the digest of the
+// image that was pushed.
+func (e *engineClient) push(tag string, auth string) (string, error) {
+	// The daemon wants the name and the tag separately
+	name, version := tag, ""
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		name, version = tag[:i], tag[i+1:]
+	}
+	query := url.Values{}
+	if version != "" {
+		query.Set("tag", version)
+	}
+
+	req, err := http.NewRequest("POST", e.base+"/images/"+name+"/push?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Registry-Auth", auth)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to reach the Docker daemon at %s: %v", e.host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Docker daemon refused to push %s: %s: %s", tag, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	// Report the progress of each layer (but only when it changes)
+	digest := ""
+	status := map[string]string{}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		msg := pushMessage{}
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("Error reading output from Docker daemon: %v", err)
+		}
+		if msg.Error != "" {
+			if msg.ErrorDetail.Message != "" {
+				return "", fmt.Errorf("%s", msg.ErrorDetail.Message)
+			}
+			return "", fmt.Errorf("%s", msg.Error)
+		}
+		if msg.Aux.Digest != "" {
+			digest = msg.Aux.Digest
+		}
+		if msg.Status != "" && status[msg.ID] != msg.Status {
+			status[msg.ID] = msg.Status
+			if msg.ID != "" {
+				verbosef("  %s: %s", msg.ID, msg.Status)
+			} else {
+				verbosef("  %s", msg.Status)
+			}
+		}
+	}
+	return digest, nil
+}
+
+// The commandPush function pushes the image with the given tag by
+// running the given command (e.g., docker or podman) with the given
+// environment.  It returns the digest of the image that was pushed (if
+// the command reports it).
+func commandPush(Options Options, name string, env []string, tag string) (string, error) {
+	// Use the credentials given for the registry (if any)
+	env, done, err := pushEnv(Options, name, env, tag)
+	defer done()
+	if err != nil {
+		return "", err
+	}
+
+	// Podman and buildah write the digest to a file, docker reports it
+	// in its output
+	args := []string{"push"}
+	digestfile := ""
+	if name == "podman" || name == "buildah" {
+		f, err := newIIDFile()
+		if err != nil {
+			return "", err
+		}
+		digestfile = f
+		args = append(args, "--digestfile", digestfile)
+	}
+	cmd := exec.Command(name, append(args, tag)...)
+	cmd.Env = env
+	out := &digestWriter{w: progress()}
+	cmd.Stdout = out
+	// Errors are reported on stderr, and we need to know what they are
+	// (to tell whether the push is worth retrying)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+
+	debugf("  Complete push command: '%s'", cmdString(cmd))
+
+	err = cmd.Run()
+	if digestfile != "" {
+		out.digest = readIIDFile(digestfile)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Error pushing %s: %v\n%s", tag, err, strings.TrimSpace(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		debugf("  Output of push command:\n%s", stderr.String())
+	}
+	return out.digest, nil
+}
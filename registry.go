@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// This is the environment variable the password for --registry-user is
+// taken from (so it doesn't show up in the process list)
+const registryPasswordVar = "HIDALGO_REGISTRY_PASSWORD"
+
+// A Registry gives the credentials to push images to a registry with
+// (instead of the ones stored by 'docker login').  Either the username
+// and password are given (typically with the password as a reference to
+// an environment variable) or a credential helper is.
+type Registry struct {
+	// The user name and password
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password" json:"password"`
+	// The name of a Docker credential helper (e.g., ecr-login for
+	// docker-credential-ecr-login)
+	Helper string `yaml:"helper" json:"helper"`
+}
+
+// The validate method checks that the credentials for the registry are
+// complete.
+func (r Registry) validate(host string) error {
+	if r.Helper != "" && (r.Username != "" || r.Password != "") {
+		return fmt.Errorf("Registry %s has both a credential helper and a username and password", host)
+	}
+	if r.Helper == "" && (r.Username == "" || r.Password == "") {
+		return fmt.Errorf("Registry %s needs a username and password (or a credential helper)", host)
+	}
+	return nil
+}
+
+// The pushAuth function determines the credentials (if any were given)
+// to push the tagged image with.  A user given with --registry-user
+// takes precedence over the credentials in the configuration.  If it
+// returns false, the credentials stored by 'docker login' are used.
+func pushAuth(Options Options, tag string) (authConfig, bool, error) {
+	registry := registryOf(tag)
+	server := registry
+	if registry == "docker.io" {
+		server = dockerHubAuth
+	}
+
+	if Options.RegistryUser != "" {
+		password := os.Getenv(registryPasswordVar)
+		if password == "" {
+			return authConfig{}, false, fmt.Errorf("No password for %s (set %s)", Options.RegistryUser, registryPasswordVar)
+		}
+		return authConfig{Username: Options.RegistryUser, Password: password, ServerAddress: server}, true, nil
+	}
+
+	r, exists := Options.registries[registry]
+	if !exists {
+		return authConfig{}, false, nil
+	}
+	if r.Helper != "" {
+		auth, err := helperAuth(r.Helper, server)
+		return auth, err == nil, err
+	}
+	// The username and password are only expanded when they are needed
+	// (so the password needn't be set unless the image is pushed)
+	username, err := expandEnv(r.Username, nil)
+	if err != nil {
+		return authConfig{}, false, err
+	}
+	password, err := expandEnv(r.Password, nil)
+	if err != nil {
+		return authConfig{}, false, err
+	}
+	return authConfig{Username: username, Password: password, ServerAddress: server}, true, nil
+}
+
+// A helperCredentials is what a Docker credential helper returns
+type helperCredentials struct {
+	ServerURL string
+	Username  string
+	Secret    string
+}
+
+// The helperAuth function gets the credentials for the server from the
+// given Docker credential helper (i.e., docker-credential-<helper>).
+func helperAuth(helper string, server string) (authConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = bytes.NewBufferString(server)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	debugf("  Getting credentials for %s from docker-credential-%s", server, helper)
+	out, err := cmd.Output()
+	if err != nil {
+		return authConfig{}, fmt.Errorf("Unable to get credentials for %s from docker-credential-%s: %v %s",
+			server, helper, err, stderr.String())
+	}
+	creds := helperCredentials{}
+	err = json.Unmarshal(out, &creds)
+	if err != nil {
+		return authConfig{}, fmt.Errorf("Invalid credentials from docker-credential-%s: %v", helper, err)
+	}
+	// An identity token is returned with this (fake) user name
+	if creds.Username == "<token>" {
+		return authConfig{IdentityToken: creds.Secret, ServerAddress: server}, nil
+	}
+	return authConfig{Username: creds.Username, Password: creds.Secret, ServerAddress: server}, nil
+}
+
+// The pushEnv function returns the environment to run the command (e.g.,
+// docker or podman) that pushes the tagged image in.  If credentials were
+// given for the registry, they are written to a temporary configuration
+// file that the command is pointed at (so the configuration of 'docker
+// login' isn't touched).  The returned function removes it.
+func pushEnv(Options Options, name string, env []string, tag string) ([]string, func(), error) {
+	done := func() {}
+	auth, found, err := pushAuth(Options, tag)
+	if err != nil || !found {
+		return env, done, err
+	}
+
+	dir, err := ioutil.TempDir("", "hidalgo-auth")
+	if err != nil {
+		return env, done, err
+	}
+	done = func() { os.RemoveAll(dir) }
+	entry := map[string]string{}
+	if auth.IdentityToken != "" {
+		entry["identitytoken"] = auth.IdentityToken
+	} else {
+		entry["auth"] = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{auth.ServerAddress: entry},
+	})
+	if err != nil {
+		return env, done, err
+	}
+	file := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		return env, done, err
+	}
+
+	if env == nil {
+		env = os.Environ()
+	}
+	if name == "podman" || name == "buildah" {
+		env = append(env, "REGISTRY_AUTH_FILE="+file)
+	} else {
+		env = append(env, "DOCKER_CONFIG="+dir)
+	}
+	verbosef("Pushing %s with the credentials given for %s", tag, registryOf(tag))
+	return env, done, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// This matches the (hex encoded) SHA-256 checksum of a remote file
+var fileSum = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// This is how long we wait for a remote file to be downloaded
+const downloadTimeout = 10 * time.Minute
+
+// The remote method determines whether the file is downloaded (at build
+// time) rather than found in the package directory.
+func (f File) remote() bool {
+	return strings.HasPrefix(f.Src, "https://") || strings.HasPrefix(f.Src, "http://")
+}
+
+// The remoteName function returns the name of the file at the given URL
+// (i.e., the last element of its path).
+func remoteName(src string) (string, error) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", fmt.Errorf("Invalid URL for file %s: %v", src, err)
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("Unable to determine the file name of %s (give its path in the URL)", src)
+	}
+	return name, nil
+}
+
+// The downloadFile function downloads the file at the given URL to dst,
+// checking that its SHA-256 checksum is sum (if one is given, otherwise
+// it warns that the file isn't verified).
+func downloadFile(src string, dst string, sum string) error {
+	if sum == "" {
+		warnf("File %s has no sha256 checksum, so it isn't verified", src)
+	}
+	verbosef("Downloading %s", src)
+
+	client := &http.Client{Timeout: downloadTimeout}
+	resp, err := client.Get(src)
+	if err != nil {
+		return fmt.Errorf("Unable to download %s: %v", src, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to download %s: %s", src, resp.Status)
+	}
+
+	// Write the file while computing its checksum
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to download %s: %v", src, err)
+	}
+
+	// Make sure it is the file we expected
+	if got := fmt.Sprintf("%x", h.Sum(nil)); sum != "" && got != strings.ToLower(sum) {
+		return fmt.Errorf("Checksum of %s is %s, expected %s", src, got, strings.ToLower(sum))
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// The reportFile function returns where the report of the build of the
+// package in apdir is written (or "" if it isn't).  Relative paths are
+// relative to the package directory.  The image for each of the
+// platforms of a multi-platform image has its own report (with the
+// platform added to the name, just like it is to the tag).
+func reportFile(Options Options, apdir string) string {
+	file := Options.Report
+	if file == "" {
+		return ""
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(apdir, file)
+	}
+	if Options.platformOf != "" {
+		ext := filepath.Ext(file)
+		file = strings.TrimSuffix(file, ext) + "-" + strings.Replace(Options.Platform, "/", "-", -1) + ext
+	}
+	return file
+}
+
+// The isReport function determines whether the file p is a report
+// written by a previous build of the package in apdir (for any of the
+// platforms).
+func isReport(Options Options, apdir string, p string) bool {
+	Options.platformOf = ""
+	file := reportFile(Options, apdir)
+	if file == "" {
+		return false
+	}
+	ext := filepath.Ext(file)
+	matched, _ := filepath.Match(strings.TrimSuffix(file, ext)+"-*"+ext, p)
+	return p == file || matched
+}
+
+// ReportInputs are the inputs to a build (in a build report)
+type ReportInputs struct {
+	// The fingerprint of the build (see Fingerprint)
+	Fingerprint string `json:"fingerprint"`
+	// The git commit and branch of the package directory (empty if
+	// unknown)
+	Commit string `json:"commit"`
+	Branch string `json:"branch"`
+	// The version in the configuration (if any)
+	Version string `json:"version,omitempty"`
+	// The Go toolchain (and GOFLAGS) and the base image
+	Toolchain string `json:"toolchain"`
+	GoFlags   string `json:"goflags,omitempty"`
+	Base      string `json:"base"`
+	// Hashes of the source, the configuration, the options, the values
+	// of the environment variables baked into the image and the
+	// Dockerfile template
+	SourceHash   string `json:"sourceHash"`
+	ConfigHash   string `json:"configHash"`
+	FlagsHash    string `json:"flagsHash"`
+	EnvHash      string `json:"envHash"`
+	TemplateHash string `json:"templateHash"`
+}
+
+// BuildReport is written (with --report) once the image is built, so
+// the provenance of the image can be audited later.
+type BuildReport struct {
+	// The Go package that was built and the platform it was built for
+	Package  string `json:"package"`
+	Platform string `json:"platform"`
+	// The time of the build (RFC 3339, UTC)
+	Time string `json:"time"`
+	// What went into the build...
+	Inputs ReportInputs `json:"inputs"`
+	// ...and what came out of it
+	Images []ImageRecord `json:"images"`
+}
+
+// The writeReport function writes the report of the build (if asked to).
+func writeReport(Options Options, apdir string, name string, platform Platform, stamp Stamp,
+	fp Fingerprint, images []builtImage) error {
+	file := reportFile(Options, apdir)
+	if file == "" {
+		return nil
+	}
+	report := BuildReport{
+		Package:  name,
+		Platform: platform.String(),
+		Time:     stamp.Date,
+		Inputs: ReportInputs{
+			Fingerprint:  fp.String(),
+			Commit:       stamp.Commit,
+			Branch:       stamp.Branch,
+			Version:      stamp.Version,
+			Toolchain:    fp.Toolchain,
+			GoFlags:      fp.GoFlags,
+			Base:         fp.Base,
+			SourceHash:   fp.Source,
+			ConfigHash:   fp.Config,
+			FlagsHash:    fp.Flags,
+			EnvHash:      fp.Env,
+			TemplateHash: fp.Template,
+		},
+		Images: []ImageRecord{},
+	}
+	for _, image := range images {
+		report.Images = append(report.Images, ImageRecord{Tag: image.Tag, ID: image.ID,
+			Digest: image.Digest, Platform: platform.String()})
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write build report %s: %v", file, err)
+	}
+	verbosef("Build report written to %s", file)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The sourceDateEpoch function determines the time (in seconds since
+// the epoch) that a reproducible build of the package in apdir is
+// stamped with.  Like other reproducible build tools, we use
+// SOURCE_DATE_EPOCH if it is set and, otherwise, the time of the last
+// commit (so that building the same commit always gives the same
+// result).
+func sourceDateEpoch(apdir string) (int64, error) {
+	if value := os.Getenv("SOURCE_DATE_EPOCH"); value != "" {
+		epoch, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid SOURCE_DATE_EPOCH: %s", value)
+		}
+		return epoch, nil
+	}
+	cmd := exec.Command("git", "log", "-1", "--format=%ct")
+	cmd.Dir = apdir
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to determine the time of the last commit (set SOURCE_DATE_EPOCH instead): %v", err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// The reproducible function determines (and records in the options) the
+// time a reproducible build of the package in apdir is stamped with.
+// The options are returned unchanged if the build needn't be
+// reproducible.
+func reproducible(Options Options, apdir string) (Options, error) {
+	if !Options.Reproducible {
+		return Options, nil
+	}
+	epoch, err := sourceDateEpoch(apdir)
+	if err != nil {
+		return Options, err
+	}
+	Options.epoch = epoch
+	verbosef("Reproducible build (SOURCE_DATE_EPOCH=%d)", epoch)
+	return Options, nil
+}
+
+// The buildTime function returns the time the build is stamped with
+// (which is fixed for a reproducible build).
+func buildTime(Options Options) time.Time {
+	if Options.Reproducible {
+		return time.Unix(Options.epoch, 0).UTC()
+	}
+	return time.Now().UTC()
+}
+
+// The normalizeTimes function sets the modification times of the named
+// files (in dir) to the time the build is stamped with (for a
+// reproducible build).  The files are added to the image with their
+// modification times, so otherwise every build would differ.
+func normalizeTimes(Options Options, dir string, names []string) error {
+	if !Options.Reproducible {
+		return nil
+	}
+	t := buildTime(Options)
+	for _, name := range names {
+		err := os.Chtimes(filepath.Join(dir, name), t, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// These are (parts of) the messages of errors that trying again won't
+// fix (e.g., the credentials are wrong, the image doesn't exist or a
+// step of the Dockerfile failed).  Anything else (e.g., a connection
+// that was reset, a timeout or a registry that is overloaded) is worth
+// another try.
+var fatalErrors = []string{
+	"unauthorized",
+	"authentication required",
+	"no basic auth credentials",
+	"denied",
+	"forbidden",
+	"invalid reference format",
+	"name unknown",
+	"manifest unknown",
+	"manifest invalid",
+	"not found",
+	"no such image",
+	"dockerfile parse error",
+	"unknown instruction",
+	"returned a non-zero code",
+	"did not complete successfully",
+}
+
+// The retryable function determines whether an operation that failed
+// with the given error might succeed if it is tried again.
+func retryable(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, fatal := range fatalErrors {
+		if strings.Contains(msg, fatal) {
+			return false
+		}
+	}
+	return true
+}
+
+// The retry function performs an operation (described by what) and, if
+// it fails with an error that might go away (see retryable), tries again
+// up to the given number of times.  The time between attempts starts at
+// the backoff given in the options and doubles after each attempt.
+func retry(Options Options, what string, retries int, f func() error) error {
+	wait := Options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		if !retryable(err) {
+			verbosef("Not retrying %s (the error is not one that goes away)", what)
+			return err
+		}
+		warnf("%v", err)
+		warnf("  Retrying %s in %v (%d of %d)", what, wait, attempt+1, retries)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
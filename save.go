@@ -0,0 +1,239 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The saving function returns true if the options call for the image to
+// be saved (to a file, an OCI image layout or another host).
+func saving(Options Options) bool {
+	return Options.SaveTo != "" || Options.OCILayout != "" || Options.SSHCopyTo != ""
+}
+
+// The checkSave function makes sure that, if the image is to be saved,
+// we are able to save it.
+func checkSave(Options Options) error {
+	if !saving(Options) {
+		if Options.SaveOnly {
+			return fmt.Errorf("--save-only requires --save-to, --oci-layout or --ssh-copy-to")
+		}
+		return nil
+	}
+	if Options.Tag == "" {
+		return fmt.Errorf("A tag is required to save the image")
+	}
+	if len(Options.Agent) > 0 {
+		return fmt.Errorf("Images built by a build agent cannot be saved")
+	}
+	if be := backends[Options.Backend]; be.save == nil && !be.daemonless {
+		return fmt.Errorf("Images built with %s cannot be saved", Options.Backend)
+	}
+	if Options.SaveOnly && Options.Dry {
+		return fmt.Errorf("--save-only can't be used for a dry run")
+	}
+	return nil
+}
+
+// The saveImage function writes the image (in docker-archive format, as
+// written by the save function) to the file and/or loads it on the host
+// (over ssh) given in the options.  If the name of the file ends in .gz,
+// the image is compressed (docker load and podman load handle that).
+// The image can also be added to an OCI image layout (which it is
+// converted to as it is saved).
+func saveImage(Options Options, save func(w io.Writer) error) error {
+	writers := []io.Writer{}
+
+	// Write the image to a file...
+	var file *os.File
+	var zip *gzip.Writer
+	if Options.SaveTo != "" {
+		f, err := os.Create(Options.SaveTo)
+		if err != nil {
+			return fmt.Errorf("Unable to create %s: %v", Options.SaveTo, err)
+		}
+		defer f.Close()
+		file = f
+		if strings.HasSuffix(Options.SaveTo, ".gz") {
+			zip = gzip.NewWriter(f)
+			writers = append(writers, zip)
+		} else {
+			writers = append(writers, f)
+		}
+	}
+
+	// ...and/or convert it to an OCI image layout...
+	var layout *io.PipeWriter
+	converted := make(chan error, 1)
+	if Options.OCILayout != "" {
+		r, w := io.Pipe()
+		layout = w
+		go func() {
+			err := ociLayout(r, Options.OCILayout, Options.Tag)
+			// Stop the save if the conversion failed (otherwise, read
+			// whatever is left)
+			if err != nil {
+				r.CloseWithError(err)
+			} else {
+				io.Copy(ioutil.Discard, r)
+			}
+			converted <- err
+		}()
+		writers = append(writers, w)
+	}
+
+	// ...and/or send it to the command that loads it on another host
+	var load *exec.Cmd
+	var stdin io.WriteCloser
+	if Options.SSHCopyTo != "" {
+		args := append([]string{Options.SSHCopyTo, "--"}, strings.Fields(Options.SSHLoad)...)
+		load = exec.Command("ssh", args...)
+		load.Stdout = progress()
+		load.Stderr = os.Stderr
+		pipe, err := load.StdinPipe()
+		if err != nil {
+			return err
+		}
+		stdin = pipe
+
+		debugf("  Complete load command: '%s'", cmdString(load))
+
+		err = load.Start()
+		if err != nil {
+			return fmt.Errorf("Error running cmd '%s': %v", cmdString(load), err)
+		}
+		writers = append(writers, stdin)
+	}
+
+	serr := save(io.MultiWriter(writers...))
+
+	// Let the conversion know the whole image has been read (and wait
+	// for it to finish)
+	if layout != nil {
+		layout.CloseWithError(serr)
+		cerr := <-converted
+		if cerr != nil {
+			return fmt.Errorf("Unable to write image %s to %s: %v", Options.Tag, Options.OCILayout, cerr)
+		}
+		if serr == nil {
+			infof("Image %s written to %s (as %s)", Options.Tag, Options.OCILayout, ociRef(Options.Tag))
+		}
+	}
+
+	// Let the remote command know there is nothing more to load (and
+	// then wait for it to finish)
+	if load != nil {
+		stdin.Close()
+		lerr := load.Wait()
+		if serr == nil && lerr != nil {
+			return fmt.Errorf("Error loading image on %s: %v", Options.SSHCopyTo, lerr)
+		}
+		if lerr == nil {
+			infof("Image %s loaded on %s", Options.Tag, Options.SSHCopyTo)
+		}
+	}
+	if serr != nil {
+		return fmt.Errorf("Error saving image %s: %v", Options.Tag, serr)
+	}
+	if file != nil {
+		if zip != nil {
+			err := zip.Close()
+			if err != nil {
+				return fmt.Errorf("Error writing %s: %v", Options.SaveTo, err)
+			}
+		}
+		err := file.Close()
+		if err != nil {
+			return fmt.Errorf("Error writing %s: %v", Options.SaveTo, err)
+		}
+		infof("Image %s saved to %s", Options.Tag, Options.SaveTo)
+	}
+	return nil
+}
+
+// The commandSave function returns a function that saves an image by
+// running the given command (which writes the image to its stdout).
+func commandSave(name string, args []string, env []string) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		cmd := exec.Command(name, args...)
+		cmd.Env = env
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+
+		debugf("  Complete save command: '%s'", cmdString(cmd))
+
+		return cmd.Run()
+	}
+}
+
+// The save method writes the image with the given tag to w (in the
+// docker-archive format).
+func (e *engineClient) save(tag string, w io.Writer) error {
+	resp, err := e.client.Get(e.base + "/images/get?" + url.Values{"names": {tag}}.Encode())
+	if err != nil {
+		return fmt.Errorf("Unable to reach the Docker daemon at %s: %v", e.host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker daemon refused to save %s: %s", tag, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// The removeSaved function removes the image from the daemon (or the
+// local storage of the backend) once it has been saved, if the options
+// call for it to be saved instead of kept there.
+func removeSaved(Options Options) error {
+	// An image that was built without a daemon isn't in one
+	if !Options.SaveOnly || backends[Options.Backend].daemonless {
+		return nil
+	}
+	tool := Options.Backend
+	if tool == "docker" || tool == "sdocker" {
+		tool = dockerCommand(Options)
+		if tool == "docker" || Options.Host != "" {
+			host := Options.Host
+			if host == "" {
+				host = os.Getenv("DOCKER_HOST")
+			}
+			engine, err := newEngineClient(host, Options)
+			if err == nil {
+				return engine.remove(Options.Tag)
+			}
+		}
+	}
+	cmd := exec.Command(tool, "rmi", Options.Tag)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to remove %s: %v\n%s", Options.Tag, err, strings.TrimSpace(string(out)))
+	}
+	verbosef("Image %s removed (it was only saved)", Options.Tag)
+	return nil
+}
+
+// The remove method removes the image with the given tag from the
+// daemon.  Only the tag is removed if other images share its layers.
+func (e *engineClient) remove(tag string) error {
+	req, err := http.NewRequest("DELETE", e.base+"/images/"+tag, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to reach the Docker daemon at %s: %v", e.host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker daemon refused to remove %s: %s", tag, resp.Status)
+	}
+	verbosef("Image %s removed (it was only saved)", tag)
+	return nil
+}
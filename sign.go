@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// The checkSign function makes sure that, if the images are to be
+// signed, we are able to sign them.  Only pushed images can be signed
+// (the signature is stored in the registry, next to the image).
+func checkSign(Options Options) error {
+	if !Options.Sign {
+		return nil
+	}
+	if !Options.push {
+		return fmt.Errorf("Only pushed images can be signed (use 'hidalgo push')")
+	}
+	if Options.SignKey == "" {
+		return fmt.Errorf("A key is required to sign images")
+	}
+	return nil
+}
+
+// The digestRef function returns the reference to the image with the
+// given tag by its digest (e.g., registry/app:1.2 pushed as sha256:...
+// is registry/app@sha256:...).  Signing by digest makes sure that the
+// image that was signed is the one that was pushed (even if the tag has
+// moved since).
+func digestRef(tag string, digest string) string {
+	name := tag
+	if i := strings.LastIndex(tag, ":"); i > strings.LastIndex(tag, "/") {
+		name = tag[:i]
+	}
+	return name + "@" + digest
+}
+
+// The signImages function signs each of the images that was pushed with
+// cosign (using the key given in the options).  Any credentials cosign
+// needs (e.g., COSIGN_PASSWORD) are taken from the environment.
+func signImages(Options Options, images []builtImage) error {
+	if !Options.Sign {
+		return nil
+	}
+	for _, image := range images {
+		if image.Digest == "" {
+			return fmt.Errorf("The digest of %s is unknown, so it can't be signed", image.Tag)
+		}
+		ref := digestRef(image.Tag, image.Digest)
+
+		cmd := exec.Command(Options.Cosign, "sign", "--yes", "--key", Options.SignKey, ref)
+		cmd.Stdout = progress()
+		cmd.Stderr = os.Stderr
+
+		debugf("  Complete sign command: '%s'", cmdString(cmd))
+
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("Error signing %s: %v", ref, err)
+		}
+		infof("Image signed: %s", ref)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// These are the linker flags that leave out the symbol table and the
+// DWARF debug information
+const stripFlags = "-s -w"
+
+// The linkerFlags function returns the flags for the Go linker given by
+// the user, along with the ones that strip the executables (with
+// --strip).
+func linkerFlags(Options Options) string {
+	if !Options.Strip {
+		return Options.LDFlags
+	}
+	return strings.TrimSpace(stripFlags + " " + Options.LDFlags)
+}
+
+// The reportBinarySizes function reports the sizes of the executables
+// (in dir) when they are stripped (so the effect on the image footprint
+// can be seen).
+func reportBinarySizes(Options Options, dir string, bins []Binary) {
+	if !Options.Strip {
+		return
+	}
+	for _, bin := range bins {
+		info, err := os.Stat(filepath.Join(dir, bin.Name))
+		if err != nil {
+			verbosef("Unable to determine the size of %s: %v", bin.Name, err)
+			continue
+		}
+		infof("Executable %s is %s (stripped)", bin.Path, megabytes(info.Size()))
+	}
+}
+
+// The reportImageSize function reports the size of the image that was
+// built when the executables are stripped.  Not every way of building
+// images leaves the image where we can inspect it (e.g., a build agent),
+// so failing to find the size isn't a problem.
+func reportImageSize(Options Options, image builtImage) {
+	if !Options.Strip {
+		return
+	}
+	ref := image.Tag
+	if ref == "" {
+		ref = image.ID
+	}
+	if ref == "" {
+		return
+	}
+	size, err := imageSize(Options, ref)
+	if err != nil {
+		verbosef("Unable to determine the size of the image: %v", err)
+		return
+	}
+	infof("Image %s is %s", ref, megabytes(size))
+}
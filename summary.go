@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// These are the severities of vulnerabilities (in the order they are
+// reported)
+var severities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+// The summarizing function returns true if the options call for a
+// summary of the image to be written (or posted).
+func summarizing(Options Options) bool {
+	return Options.Summary != "" || Options.GitHubPR != 0
+}
+
+// The checkSummary function makes sure that, if a summary of the image
+// is to be posted to a pull request, we know where to post it.
+func checkSummary(Options Options) error {
+	if Options.GitHubPR == 0 {
+		return nil
+	}
+	if os.Getenv("GITHUB_TOKEN") == "" || os.Getenv("GITHUB_REPOSITORY") == "" {
+		return fmt.Errorf("GITHUB_TOKEN and GITHUB_REPOSITORY must be set to comment on a pull request")
+	}
+	return nil
+}
+
+// The (image) size method returns the size (in bytes) of the image with
+// the given tag.
+func (e *engineClient) size(tag string) (int64, error) {
+	resp, err := e.client.Get(e.base + "/images/" + tag + "/json")
+	if err != nil {
+		return 0, fmt.Errorf("Unable to reach the Docker daemon at %s: %v", e.host, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Unable to inspect %s: %s", tag, resp.Status)
+	}
+	info := struct {
+		Size int64 `json:"Size"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info.Size, err
+}
+
+// The imageSize function returns the size (in bytes) of the image with
+// the given tag.  The Docker Engine API is used if that is how the image
+// was built, otherwise the build tool is asked.
+func imageSize(Options Options, tag string) (int64, error) {
+	tool := Options.Backend
+	if backends[tool].daemonless {
+		return 0, fmt.Errorf("Images built without a daemon aren't in one to inspect")
+	}
+	if tool == "docker" || tool == "sdocker" {
+		tool = dockerCommand(Options)
+		if tool == "docker" || Options.Host != "" {
+			host := Options.Host
+			if host == "" {
+				host = os.Getenv("DOCKER_HOST")
+			}
+			engine, err := newEngineClient(host, Options)
+			if err == nil {
+				return engine.size(tag)
+			}
+		}
+	}
+	out, err := exec.Command(tool, "image", "inspect", "--format", "{{.Size}}", tag).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Unable to inspect %s: %v", tag, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// The megabytes function formats a size (in bytes) in megabytes
+func megabytes(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/1e6)
+}
+
+// The scanResults function reads the (JSON) results of a vulnerability
+// scan (by Trivy or Grype) and counts the vulnerabilities by severity.
+func scanResults(file string) (map[string]int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	results := struct {
+		// Trivy
+		Results []struct {
+			Vulnerabilities []struct {
+				Severity string `json:"Severity"`
+			} `json:"Vulnerabilities"`
+		} `json:"Results"`
+		// Grype
+		Matches []struct {
+			Vulnerability struct {
+				Severity string `json:"severity"`
+			} `json:"vulnerability"`
+		} `json:"matches"`
+	}{}
+	err = json.Unmarshal(data, &results)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read scan results from %s (only Trivy and Grype JSON are supported): %v", file, err)
+	}
+
+	counts := map[string]int{}
+	count := func(severity string) {
+		severity = strings.ToUpper(severity)
+		if !contains(severities, severity) {
+			severity = "UNKNOWN"
+		}
+		counts[severity]++
+	}
+	for _, r := range results.Results {
+		for _, v := range r.Vulnerabilities {
+			count(v.Severity)
+		}
+	}
+	for _, m := range results.Matches {
+		count(m.Vulnerability.Severity)
+	}
+	return counts, nil
+}
+
+// The contains function determines whether a list of strings contains
+// the given string.
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The summary function generates a (markdown) summary of the image built
+// for the named package, for reviewers of a pull request.
+func summary(Options Options, name string, image builtImage, fp Fingerprint) string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "### Image for `%s`\n\n", name)
+	fmt.Fprintf(b, "| | |\n|---|---|\n")
+	if image.Tag != "" {
+		fmt.Fprintf(b, "| Tag | `%s` |\n", image.Tag)
+	}
+	if image.Digest != "" {
+		fmt.Fprintf(b, "| Digest | `%s` |\n", image.Digest)
+	}
+	if image.ID != "" {
+		fmt.Fprintf(b, "| ID | `%s` |\n", image.ID)
+	}
+	fmt.Fprintf(b, "| Platform | `%s` |\n", Options.Platform)
+	fmt.Fprintf(b, "| Fingerprint | `%s` |\n", fp)
+
+	// The size of the image (and how it compares to the base image)
+	ref := image.Tag
+	if ref == "" {
+		ref = image.ID
+	}
+	if ref != "" {
+		size, err := imageSize(Options, ref)
+		if err != nil {
+			warnf("Unable to determine the size of the image: %v", err)
+		} else if Options.SummaryBase == "" {
+			fmt.Fprintf(b, "| Size | %s |\n", megabytes(size))
+		} else if base, err := imageSize(Options, Options.SummaryBase); err != nil {
+			warnf("Unable to determine the size of %s: %v", Options.SummaryBase, err)
+			fmt.Fprintf(b, "| Size | %s |\n", megabytes(size))
+		} else {
+			delta := fmt.Sprintf("%+.1f MB", float64(size-base)/1e6)
+			if base > 0 {
+				delta += fmt.Sprintf(", %+.1f%%", 100*float64(size-base)/float64(base))
+			}
+			fmt.Fprintf(b, "| Size | %s (%s vs `%s`) |\n", megabytes(size), delta, Options.SummaryBase)
+		}
+	}
+
+	// The results of any vulnerability scan
+	if Options.SummaryScan != "" {
+		counts, err := scanResults(Options.SummaryScan)
+		if err != nil {
+			warnf("%v", err)
+		} else {
+			fmt.Fprintf(b, "\n#### Vulnerabilities\n\n")
+			fmt.Fprintf(b, "| %s |\n", strings.Join(severities, " | "))
+			fmt.Fprintf(b, "|%s\n", strings.Repeat("---|", len(severities)))
+			values := []string{}
+			for _, s := range severities {
+				values = append(values, strconv.Itoa(counts[s]))
+			}
+			fmt.Fprintf(b, "| %s |\n", strings.Join(values, " | "))
+		}
+	}
+	return b.String()
+}
+
+// The postComment function posts a comment on a GitHub pull request (in
+// the repository given by GITHUB_REPOSITORY, using GITHUB_TOKEN).
+func postComment(pr int, body string) error {
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	u := fmt.Sprintf("%s/repos/%s/issues/%d/comments", strings.TrimSuffix(api, "/"), os.Getenv("GITHUB_REPOSITORY"), pr)
+
+	data, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("GITHUB_TOKEN"))
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	debugf("  Posting summary to %s", u)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to reach GitHub: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GitHub refused comment: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// The summarize function writes the summary of the image to the file
+// given in the options (if any) and posts it to the pull request given
+// in the options (if any).
+func summarize(Options Options, name string, image builtImage, fp Fingerprint) error {
+	text := summary(Options, name, image, fp)
+	if Options.Summary != "" {
+		err := copyTo(Options.Summary, text)
+		if err != nil {
+			return fmt.Errorf("Error writing summary to %s: %v", Options.Summary, err)
+		}
+	}
+	if Options.GitHubPR != 0 {
+		err := postComment(Options.GitHubPR, text)
+		if err != nil {
+			return err
+		}
+		infof("Summary posted to pull request #%d", Options.GitHubPR)
+	}
+	return nil
+}
+
+// The copyTo function writes the text to the named file (or os.Stdout,
+// if the name is '-').
+func copyTo(name string, text string) error {
+	if name == "-" {
+		_, err := fmt.Print(text)
+		return err
+	}
+	return ioutil.WriteFile(name, []byte(text), 0644)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TagData is what a tag template (e.g.,
+// 'myrepo/{{.Package}}:{{.Version}}-{{.GitSHA}}') is evaluated against
+type TagData struct {
+	// The name of the package (the last element of its import path) and
+	// its import path
+	Package    string
+	ImportPath string
+	// The version in the configuration or, if there isn't one, the
+	// output of 'git describe' (e.g., v1.2.0-3-g1a2b3c4)
+	Version string
+	// The output of 'git describe', the (short) git commit and branch of
+	// the package directory (empty if unknown)
+	Describe string
+	GitSHA   string
+	Branch   string
+	// The date of the build (e.g., 20240131)
+	Date string
+	// The platform the image is for (empty for a multi-platform image)
+	OS       string
+	Arch     string
+	Platform string
+}
+
+// The tagTemplate function determines whether a tag is a template (to
+// be evaluated for each package).
+func tagTemplate(tag string) bool {
+	return strings.Contains(tag, "{{")
+}
+
+// The expandTag function evaluates the tag (if it is a template) for the
+// package in pdir and returns the options with the result as the tag.
+func expandTag(Options Options, pdir string) (Options, error) {
+	if !tagTemplate(Options.Tag) {
+		return Options, nil
+	}
+	t, err := template.New("tag").Option("missingkey=error").Parse(Options.Tag)
+	if err != nil {
+		return Options, &UsageError{fmt.Errorf("Invalid tag template %s: %v", Options.Tag, err)}
+	}
+
+	apdir, name, err := packageName(pdir)
+	if err != nil {
+		return Options, &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return Options, &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	date := time.Now().UTC()
+	if Options.Reproducible {
+		epoch, err := sourceDateEpoch(apdir)
+		if err != nil {
+			return Options, &BuildError{err}
+		}
+		date = time.Unix(epoch, 0).UTC()
+	}
+
+	data := TagData{
+		Package:    path.Base(name),
+		ImportPath: name,
+		Version:    config.Version,
+		Describe:   gitDescribe(apdir),
+		Branch:     strings.Replace(gitBranch(apdir), "/", "-", -1),
+		Date:       date.Format("20060102"),
+	}
+	if data.Version == "" {
+		data.Version = data.Describe
+	}
+	if commit := gitCommit(apdir); len(commit) >= 7 {
+		data.GitSHA = commit[:7]
+	}
+	if Options.Platforms == "" {
+		platform, err := parsePlatform(Options.Platform)
+		if err != nil {
+			return Options, &ConfigError{err}
+		}
+		data.OS = platform.OS
+		data.Arch = platform.Arch
+		data.Platform = strings.Replace(platform.String(), "/", "-", -1)
+	}
+
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return Options, &UsageError{fmt.Errorf("Unable to evaluate tag template %s: %v", Options.Tag, err)}
+	}
+	verbosef("Tagging image as %s (from %s)", buf.String(), Options.Tag)
+	Options.Tag = buf.String()
+	return Options, nil
+}
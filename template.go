@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// The templateText function returns the text of the Dockerfile template.
+// This is either the file given with --template or the built in one.
+func templateText(Options Options) (string, error) {
+	if Options.Template == "" {
+		return dockerTemplate, nil
+	}
+	contents, err := ioutil.ReadFile(Options.Template)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read template %s: %v", Options.Template, err)
+	}
+	return string(contents), nil
+}
+
+// The loadTemplate function parses the Dockerfile template.  Referring
+// to a value that isn't in the template context is an error (rather
+// than silently generating "<no value>").
+func loadTemplate(Options Options) (*template.Template, error) {
+	text, err := templateText(Options)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New("Dockerfile").Funcs(dockerfileFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing Dockerfile template: %v", err)
+	}
+	return t, nil
+}
+
+// This matches the names of variables given with 'var' (which are
+// referred to as .vars.NAME in templates)
+var templateVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// The templateContext function builds up the context information for
+// evaluating the Dockerfile template.  Every value is always present
+// (even if it is empty) so that templates can test for them.
+func templateContext(name string, stamp Stamp, from string, env map[string]string, labels map[string]string,
+	bins []Binary, dbin Binary, config Config) map[string]interface{} {
+	context := map[string]interface{}{}
+	// Start with what is being built (and when)
+	context["package"] = name
+	context["version"] = config.Version
+	context["buildtime"] = stamp.Date
+	context["git"] = map[string]string{
+		"commit": stamp.Commit,
+		"branch": stamp.Branch,
+	}
+
+	// Add any variables given in the configuration
+	context["vars"] = map[string]string{}
+	if config.Vars != nil {
+		context["vars"] = config.Vars
+	}
+
+	// Add those environment variables to the template context
+	context["env"] = env
+
+	// Now add any ports that need to be exposed.
+	context["ports"] = config.Ports
+	verbosef("Exported ports: %v", config.Ports)
+
+	// Now add the names of all the binaries that were built
+	names := []string{}
+	for _, bin := range bins {
+		names = append(names, bin.Name)
+	}
+	context["binaries"] = names
+	context["executables"] = bins
+
+	// Now add any labels describing the build
+	context["labels"] = labels
+	verbosef("Labels: %v", labels)
+
+	// Now add the CA bundle (if any)
+	context["certs"] = ""
+	if config.Certs {
+		context["certs"] = certsFile
+	}
+
+	// Now add the files from the package directory (if any)
+	context["files"] = ""
+	if len(plainPatterns(config.Files)) > 0 {
+		context["files"] = filesDir
+	}
+	context["filedest"] = fileDest(config)
+	context["copies"] = fileCopies(config)
+
+	// Now add the time zone database (if any)
+	context["tzdata"] = ""
+	if config.Tzdata {
+		context["tzdata"] = zoneinfoFile
+	}
+
+	// Now add any volumes that should be declared
+	context["volumes"] = config.Volumes
+	verbosef("Volumes: %v", config.Volumes)
+
+	// Now determine how the executable is run.  Either the executable
+	// is the ENTRYPOINT and the arguments are the CMD (so they can be
+	// overridden by 'docker run') or the executable and its arguments
+	// together form the CMD.
+	exe := dbin.Path
+	cmd := append([]string{exe}, config.Args...)
+	context["entrypoint"] = []string(nil)
+	if config.Entrypoint {
+		context["entrypoint"] = []string{exe}
+		cmd = config.Args
+	}
+	context["cmd"] = []string(nil)
+	if len(cmd) > 0 {
+		context["cmd"] = cmd
+	}
+	verbosef("Command arguments: %v (entrypoint: %v)", config.Args, config.Entrypoint)
+
+	// Now add the build arguments (with their default values)
+	context["buildargs"] = map[string]string{}
+	if config.BuildArgs != nil {
+		context["buildargs"] = config.BuildArgs
+	}
+	verbosef("Build arguments: %v", config.BuildArgs)
+
+	// Now specify the Docker image that we will build our image from
+	context["from"] = from
+	verbosef("Base Docker image to build FROM: %s", from)
+
+	return context
+}
+
+// The undefinedFields function returns the names of all the values that
+// the template refers to but that aren't in the context.  Only
+// references to the top level of the context (i.e., not inside of a
+// range or with, where "." is something else) are checked.
+func undefinedFields(t *template.Template, context map[string]interface{}) []string {
+	missing := map[string]bool{}
+	check := func(name string) {
+		if _, exists := context[name]; !exists {
+			missing[name] = true
+		}
+	}
+
+	var walk func(node parse.Node, top bool)
+	walk = func(node parse.Node, top bool) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c, top)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, top)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c, top)
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				walk(a, top)
+			}
+		case *parse.FieldNode:
+			if top {
+				check(n.Ident[0])
+			}
+		case *parse.VariableNode:
+			// $.name always refers to the top level
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				check(n.Ident[1])
+			}
+		case *parse.IfNode:
+			walk(n.Pipe, top)
+			walk(n.List, top)
+			walk(n.ElseList, top)
+		case *parse.RangeNode:
+			walk(n.Pipe, top)
+			walk(n.List, false)
+			walk(n.ElseList, top)
+		case *parse.WithNode:
+			walk(n.Pipe, top)
+			walk(n.List, false)
+			walk(n.ElseList, top)
+		case *parse.TemplateNode:
+			walk(n.Pipe, top)
+		}
+	}
+	for _, tmpl := range t.Templates() {
+		if tmpl.Tree != nil {
+			walk(tmpl.Tree.Root, true)
+		}
+	}
+
+	ret := []string{}
+	for name := range missing {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// TemplateCommand groups the commands for working with Dockerfile
+// templates.
+type TemplateCommand struct {
+	Check TemplateCheckCommand `command:"check" description:"Check a Dockerfile template and render a preview"`
+}
+
+// TemplateCheckCommand describes 'hidalgo template check', which checks
+// the Dockerfile template (given with --template) against the context
+// for a package and prints the resulting Dockerfile.  Nothing is
+// compiled, so template errors can be found quickly.
+type TemplateCheckCommand struct {
+	// The (global) options hidalgo was run with
+	options *Options
+}
+
+// The Execute method checks the template against the package in the
+// given directory (or the current directory).
+func (c *TemplateCheckCommand) Execute(args []string) error {
+	Options := *c.options
+	setLogLevel(Options)
+
+	dirs, err := packageDirs(args)
+	if err != nil {
+		return &UsageError{err}
+	}
+	if len(dirs) != 1 {
+		return &UsageError{fmt.Errorf("Templates can only be checked against a single directory")}
+	}
+
+	apdir, name, err := packageName(dirs[0])
+	if err != nil {
+		return &UsageError{fmt.Errorf("Unable to determine package name: %v", err)}
+	}
+	platform, err := parsePlatform(Options.Platform)
+	if err != nil {
+		return &ConfigError{err}
+	}
+	config, err := loadConfig(apdir, Options)
+	if err != nil {
+		return &ConfigError{fmt.Errorf("Invalid configuration: %v", err)}
+	}
+	config, err = checkPProf(Options, apdir, config)
+	if err != nil {
+		return err
+	}
+	Options, err = reproducible(Options, apdir)
+	if err != nil {
+		return &BuildError{err}
+	}
+
+	t, err := loadTemplate(Options)
+	if err != nil {
+		return &BuildError{err}
+	}
+
+	// Build the same context a real build would
+	plan, err := planImage(Options, platform, apdir, name, config)
+	if err != nil {
+		return err
+	}
+	context := plan.context(name)
+
+	missing := undefinedFields(t, context)
+	if len(missing) > 0 {
+		names := []string{}
+		for name := range context {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return &BuildError{fmt.Errorf("The template refers to undefined values: %s (the defined values are: %s)",
+			strings.Join(missing, ", "), strings.Join(names, ", "))}
+	}
+
+	// Render a preview of the Dockerfile
+	err = t.Execute(os.Stdout, context)
+	if err != nil {
+		return &BuildError{fmt.Errorf("Error rendering template: %v", err)}
+	}
+	infof("Template OK")
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// This is the name of the time zone database in the build directory
+const zoneinfoFile = "zoneinfo.zip"
+
+// The zoneinfo function finds the time zone database (as distributed
+// with Go) that is copied into images (with 'tzdata true;').  ZONEINFO
+// is used if it is set (so a different database can be given).
+func zoneinfo() (string, error) {
+	if file := os.Getenv("ZONEINFO"); file != "" {
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			return "", fmt.Errorf("Time zone database given by ZONEINFO is not a file: %s", file)
+		}
+		return file, nil
+	}
+	goroot := goEnv("GOROOT")
+	if goroot == "" {
+		return "", fmt.Errorf("Unable to determine GOROOT")
+	}
+	file := filepath.Join(goroot, "lib", "time", zoneinfoFile)
+	if _, err := os.Stat(file); err != nil {
+		return "", fmt.Errorf("Unable to find the time zone database (set ZONEINFO to the one to use)")
+	}
+	return file, nil
+}
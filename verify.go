@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// The check function runs one of the pre-build verification commands in
+// the package directory.  If the command fails, its output is included
+// in the error.
+func check(what string, cmd *exec.Cmd, apdir string) error {
+	cmd.Dir = apdir
+
+	verbosef("Running %s: '%s'", what, cmdString(cmd))
+
+	output, err := combinedOutput(cmd)
+	if err != nil {
+		return fmt.Errorf("%s failed.  Output of '%s':\n%s\n%v", what, cmdString(cmd), output, err)
+	}
+
+	if len(output) > 0 && !logAt(LevelTrace) {
+		debugf("Output of %s:\n%s", what, output)
+	}
+	return nil
+}
+
+// The verify function runs the (optional) verification steps that must
+// pass before we build anything: go vet, a linter and the package tests.
+// These are run natively (i.e., not cross-compiled) since the tests
+// need to run on this machine.
+func verify(Options Options, config Config, name string, apdir string) error {
+	if config.Vet {
+		err := check("go vet", exec.Command("go", "vet", name+"/..."), apdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if config.Lint != "" {
+		err := check("linter", shellCommand(config.Lint), apdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	if Options.Test || config.Test {
+		err := check("tests", exec.Command("go", "test", name+"/..."), apdir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
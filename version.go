@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// These are the variables (in package main) that are set by the linker
+// when a version is specified in the configuration.
+const (
+	versionVar = "main.version"
+	commitVar  = "main.commit"
+	dateVar    = "main.date"
+)
+
+// Stamp contains the values that identify a particular build.
+type Stamp struct {
+	// The version from the configuration file
+	Version string
+	// The VCS commit of the package directory (empty if unknown)
+	Commit string
+	// The VCS branch of the package directory (empty if unknown or
+	// detached)
+	Branch string
+	// Where the source can be found, i.e., the URL of the git remote
+	// (empty if unknown)
+	Source string
+	// The time of the build (RFC 3339, UTC)
+	Date string
+}
+
+// The gitCommit function returns the current git commit of the given
+// directory (or the empty string if it isn't in a git repository).
+func gitCommit(dir string) string {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// The gitBranch function returns the current git branch of the given
+// directory (or the empty string if it isn't in a git repository or
+// no branch is checked out).
+func gitBranch(dir string) string {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	branch := strings.TrimSpace(string(out))
+	if branch == "HEAD" {
+		return ""
+	}
+	return branch
+}
+
+// The gitSource function returns the URL of the origin remote of the
+// given directory (or the empty string if it isn't in a git repository or
+// has no origin).  Since the URL ends up in a label, any credentials in
+// it are removed and SSH remotes (e.g., git@github.com:owner/repo.git)
+// are turned into the equivalent https URL.
+func gitSource(dir string) string {
+	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return sourceURL(strings.TrimSpace(string(out)))
+}
+
+// The sourceURL function turns the URL of a git remote into one that
+// can be shared (see gitSource).  Remotes on this machine can't be, so
+// there is no URL for them.
+func sourceURL(remote string) string {
+	if !strings.Contains(remote, "://") {
+		// An scp-like address (user@host:path)
+		at := strings.Index(remote, "@")
+		colon := strings.Index(remote, ":")
+		if colon < 0 || colon < at {
+			return ""
+		}
+		return "https://" + remote[at+1:colon] + "/" + strings.TrimPrefix(remote[colon+1:], "/")
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Scheme == "file" {
+		return ""
+	}
+	u.User = nil
+	if u.Scheme == "ssh" || u.Scheme == "git" {
+		u.Scheme = "https"
+		u.Host = u.Hostname()
+	}
+	return u.String()
+}
+
+// The newStamp function collects the information used to stamp a build
+// (at the given time) of the package in the given directory.
+func newStamp(dir string, version string, date time.Time) Stamp {
+	return Stamp{
+		Version: version,
+		Commit:  gitCommit(dir),
+		Branch:  gitBranch(dir),
+		Source:  gitSource(dir),
+		Date:    date.UTC().Format(time.RFC3339),
+	}
+}
+
+// The ldflags method returns the linker flags that set the version, commit
+// and date variables in the main package.  These are combined with any
+// linker flags specified by the user.
+func (s Stamp) ldflags(user string) string {
+	flags := []string{}
+	if user != "" {
+		flags = append(flags, user)
+	}
+	flags = append(flags, "-X "+versionVar+"="+s.Version)
+	if s.Commit != "" {
+		flags = append(flags, "-X "+commitVar+"="+s.Commit)
+	}
+	flags = append(flags, "-X "+dateVar+"="+s.Date)
+	return strings.Join(flags, " ")
+}
+
+// The labels method returns the (standard OCI) image labels that
+// describe the build, so the image can be traced back to the commit it
+// was built from.  The version is only included if there is one.
+func (s Stamp) labels() map[string]string {
+	ret := map[string]string{
+		"org.opencontainers.image.created": s.Date,
+	}
+	if s.Version != "" {
+		ret["org.opencontainers.image.version"] = s.Version
+	}
+	if s.Commit != "" {
+		ret["org.opencontainers.image.revision"] = s.Commit
+	}
+	if s.Source != "" {
+		ret["org.opencontainers.image.source"] = s.Source
+	}
+	return ret
+}
+
+// The gitDescribe function returns a description of the current git
+// commit of the given directory relative to the most recent tag (e.g.,
+// v1.2.0-3-g1a2b3c4, with -dirty added if there are uncommitted changes)
+// or the empty string if it isn't in a git repository.
+func gitDescribe(dir string) string {
+	cmd := exec.Command("git", "describe", "--tags", "--always", "--dirty")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Build contexts larger than this (in bytes) are worth a warning (they
+// take a long time to send to Docker and usually mean something was
+// added to the image by mistake)
+const maxContextSize = 200 * 1000 * 1000
+
+// JSONWarning is the structured form of a warning that is written (to
+// os.Stdout, along with any errors) when --json-errors is given.
+type JSONWarning struct {
+	// Always "warning" (to distinguish it from an error)
+	Kind string `json:"kind"`
+	// A description of the problem
+	Message string `json:"message"`
+}
+
+// The reportWarnings function summarizes the warnings reported during
+// the build (which would otherwise be lost in the output) and returns
+// the exit status of the build.  With --warnings-as-errors, a build with
+// warnings fails (even if it succeeded otherwise).  This is the end of
+// the build, so the results are written as JSON here (if asked for).
+func reportWarnings(Options Options, status int) int {
+	ws := takeWarnings()
+	if len(ws) > 0 {
+		infof("%d warning(s):", len(ws))
+		for _, w := range ws {
+			infof("  %s", w)
+		}
+		if Options.JSONErrors && !jsonOutput(Options) {
+			enc := json.NewEncoder(os.Stdout)
+			for _, w := range ws {
+				enc.Encode(JSONWarning{Kind: "warning", Message: w})
+			}
+		}
+
+		if Options.WarnErrors && status == ExitOK {
+			status = report(Options, "", &BuildError{fmt.Errorf("%d warning(s) treated as errors", len(ws))})
+		}
+	}
+	writeOutput(Options, status, ws)
+	return status
+}
+
+// The pinned function returns true if the (base) image is given by
+// digest or by a tag other than "latest" (so the image we build from
+// doesn't change unexpectedly).
+func pinned(image string) bool {
+	if image == "scratch" || strings.Contains(image, "@") {
+		return true
+	}
+	i := strings.LastIndex(image, ":")
+	if i < strings.LastIndex(image, "/") {
+		return false
+	}
+	return i >= 0 && image[i+1:] != "latest"
+}
+
+// The contextSize function returns the total size (in bytes) of the
+// build context in the build directory.
+func contextSize(dir string) (int64, error) {
+	files, err := contextFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	total := int64(0)
+	for _, name := range files {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
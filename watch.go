@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// This is how often the package directory is checked for changes
+const watchInterval = 1 * time.Second
+
+// A snapshot records the modification time and size of every file
+// we are watching, indexed by path.
+type snapshot map[string]string
+
+// The takeSnapshot function walks the package directory and records
+// the state of all Go source files, the configuration files and the
+// environment file.  Hidden directories (e.g., .git) are skipped.  The
+// files the configuration includes and the environment files given in
+// the options are recorded as well (wherever they are).
+func takeSnapshot(Options Options, dir string) (snapshot, error) {
+	ret := snapshot{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if p != dir && strings.HasPrefix(name, ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(name) == ".go" || configFile(name) || name == defaultEnvFile {
+			ret[p] = fmt.Sprintf("%v/%d", info.ModTime(), info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return ret, err
+	}
+
+	extra := append([]string{}, Options.EnvFile...)
+	for _, name := range configFiles {
+		extra = append(extra, includedFiles(filepath.Join(dir, name), nil)...)
+	}
+	for _, p := range extra {
+		// A file that doesn't exist (yet) is a change once it does
+		if info, err := os.Stat(p); err == nil {
+			ret[p] = fmt.Sprintf("%v/%d", info.ModTime(), info.Size())
+		}
+	}
+	return ret, nil
+}
+
+// The configFile function determines whether a file (given by its name)
+// is one of the configuration files we look for in a package directory.
+func configFile(name string) bool {
+	for _, c := range configFiles {
+		if name == c {
+			return true
+		}
+	}
+	return false
+}
+
+// The changed function compares two snapshots and returns the first
+// path (if any) that was added, removed or modified.
+func (s snapshot) changed(other snapshot) (string, bool) {
+	for p, v := range s {
+		if ov, exists := other[p]; !exists || ov != v {
+			return p, true
+		}
+	}
+	for p := range other {
+		if _, exists := s[p]; !exists {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// The watch function performs an initial build and then polls the
+// package directory, performing a new build each time the source
+// changes.  It only returns if the directory can no longer be read.
+func watch(Options Options, pdir string) int {
+	last, err := takeSnapshot(Options, pdir)
+	if err != nil {
+		return report(Options, pdir, &UsageError{fmt.Errorf("Unable to watch %s: %v", pdir, err)})
+	}
+
+	for {
+		// Perform a build.  Failures are reported but we keep watching
+		// since the next change will (hopefully) fix them.
+		status := reportWarnings(Options, run(Options, pdir))
+		if status == 0 {
+			infof("Build complete, watching %s for changes", pdir)
+		} else {
+			errorf("Build failed (status %d), watching %s for changes", status, pdir)
+		}
+
+		// If the build ran 'go generate', the files it generated aren't
+		// changes (or we would rebuild forever)
+		if generates(Options, pdir) {
+			last, err = takeSnapshot(Options, pdir)
+			if err != nil {
+				return report(Options, pdir, &UsageError{fmt.Errorf("Unable to watch %s: %v", pdir, err)})
+			}
+		}
+
+		// Wait until something changes...
+		for {
+			time.Sleep(watchInterval)
+			cur, err := takeSnapshot(Options, pdir)
+			if err != nil {
+				return report(Options, pdir, &UsageError{fmt.Errorf("Unable to watch %s: %v", pdir, err)})
+			}
+			if p, changed := cur.changed(last); changed {
+				last = cur
+				infof("Change detected in %s, rebuilding", p)
+				break
+			}
+		}
+
+		// ...and then wait until things settle down (e.g., an editor or
+		// 'git checkout' writing several files) before rebuilding.
+		for {
+			time.Sleep(watchInterval)
+			cur, err := takeSnapshot(Options, pdir)
+			if err != nil {
+				return report(Options, pdir, &UsageError{fmt.Errorf("Unable to watch %s: %v", pdir, err)})
+			}
+			if _, changed := cur.changed(last); !changed {
+				break
+			}
+			last = cur
+		}
+	}
+}
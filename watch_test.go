@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Changes to any of the configuration files (and the files they include)
+// are noticed
+func TestSnapshotConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hidalgo-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	common := filepath.Join(dir, "common.yaml")
+	files := map[string]string{
+		filepath.Join(dir, "hidalgo.yaml"): "include: [common.yaml]\n",
+		common:                             "env: [PORT]\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name := range files {
+		before, err := takeSnapshot(Options{}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+		after, err := takeSnapshot(Options{}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p, changed := after.changed(before); !changed || p != name {
+			t.Errorf("Change to %s not detected (got %q)", name, p)
+		}
+	}
+}